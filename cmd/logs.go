@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/colinzuo/tunip/internal/logsearch"
+	"github.com/colinzuo/tunip/pkg/logp"
+	"github.com/colinzuo/tunip/pkg/logp/logfiles"
+)
+
+var (
+	logsLevel   string
+	logsLoggers []string
+	logsSince   string
+	logsUntil   string
+	logsFields  []string
+	logsGrep    string
+	logsFormat  string
+)
+
+// logsCmd represents the logs command
+var logsCmd = &cobra.Command{
+	Use:   "logs [file...]",
+	Short: "Search and pretty-print JSON log files",
+	Long: `Search the current and rotated (including gzip compressed) JSON log files
+in time order. Without arguments the files of the configured file output are
+read.`,
+	Run: logs,
+}
+
+func init() {
+	rootCmd.AddCommand(logsCmd)
+
+	pflag.StringVar(&logsLevel, "logsLevel", "debug", "Minimum level of entries to show (debug, info, warn, error, dpanic, panic, fatal)")
+	pflag.StringSliceVar(&logsLoggers, "logsLogger", nil, "Only show entries of these loggers and their children")
+	pflag.StringVar(&logsSince, "logsSince", "", "Only show entries at or after this time (timestamp or duration ago, e.g. 2h)")
+	pflag.StringVar(&logsUntil, "logsUntil", "", "Only show entries before this time (timestamp or duration ago)")
+	pflag.StringArrayVar(&logsFields, "logsField", nil, "Only show entries with field key=value")
+	pflag.StringVar(&logsGrep, "logsGrep", "", "Only show entries whose message matches this regular expression")
+	pflag.StringVar(&logsFormat, "logsFormat", "console", "Output format: console, json or csv")
+	for _, keyName := range []string{"logsLevel", "logsLogger", "logsSince", "logsUntil", "logsField", "logsGrep", "logsFormat"} {
+		logsCmd.Flags().AddFlag(pflag.CommandLine.Lookup(keyName))
+	}
+}
+
+// logs main function for logs command
+func logs(cmd *cobra.Command, args []string) {
+	logger := logp.NewLogger(ModuleName)
+	logger.Infof("Enter logs with args %v", args)
+
+	filter, err := logsFilter(time.Now())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	files, err := logsFiles(args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	renderer, err := logsearch.NewRenderer(logsFormat, os.Stdout)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	stats, err := logsearch.Search(files, filter, renderer.Render)
+	if flushErr := renderer.Flush(); err == nil {
+		err = flushErr
+	}
+	logger.Infof("Leave logs with stats %+v", stats)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func logsFilter(now time.Time) (*logsearch.Filter, error) {
+	filter := &logsearch.Filter{Loggers: logsLoggers}
+
+	var err error
+	if filter.Level, err = logsearch.ParseLevel(logsLevel); err != nil {
+		return nil, err
+	}
+	if filter.Since, err = logsearch.ParseTime(logsSince, now); err != nil {
+		return nil, err
+	}
+	if filter.Until, err = logsearch.ParseTime(logsUntil, now); err != nil {
+		return nil, err
+	}
+
+	if len(logsFields) > 0 {
+		filter.Fields = make(map[string]string, len(logsFields))
+		for _, kv := range logsFields {
+			i := strings.Index(kv, "=")
+			if i <= 0 {
+				return nil, fmt.Errorf("invalid field filter '%s', expected key=value", kv)
+			}
+			filter.Fields[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	if logsGrep != "" {
+		if filter.Message, err = regexp.Compile(logsGrep); err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+// logsFiles returns the files given as arguments, or the current and rotated
+// files of the configured file output.
+func logsFiles(args []string) ([]logfiles.File, error) {
+	if len(args) == 0 {
+		cfg := logp.GetFileConfig()
+		return logfiles.List(cfg.Path, cfg.Name)
+	}
+
+	var files []logfiles.File
+	for _, arg := range args {
+		files = append(files, logfiles.File{Path: arg, Compressed: filepath.Ext(arg) == ".gz"})
+	}
+	return files, nil
+}
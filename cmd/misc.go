@@ -1,6 +1,12 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
@@ -8,28 +14,191 @@ import (
 	"github.com/colinzuo/tunip/pkg/logp"
 )
 
-var miscConfig string
+var (
+	miscConfig      string
+	miscAgentListen string
+	miscAgents      []string
+)
 
 // miscCmd represents the misc command
 var miscCmd = &cobra.Command{
 	Use:   "misc",
-	Short: "Run misc function according to specified configurations",
+	Short: "Run misc tests enabled in specified configurations",
 	Args:  cobra.NoArgs,
 	Run:   misc,
 }
 
+// miscListCmd represents the misc list command
+var miscListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List registered misc tests",
+	Args:  cobra.NoArgs,
+	Run:   miscList,
+}
+
+// miscRunCmd represents the misc run command
+var miscRunCmd = &cobra.Command{
+	Use:   "run <name>...",
+	Short: "Run the named misc tests, enabled or not",
+	Args:  cobra.MinimumNArgs(1),
+	Run:   miscRun,
+}
+
+// miscCompareCmd represents the misc compare command
+var miscCompareCmd = &cobra.Command{
+	Use:   "compare <base.json> <new.json>",
+	Short: "Compare a misc test report against a baseline, exit 1 on regression or missing metric",
+	Args:  cobra.ExactArgs(2),
+	Run:   miscCompare,
+}
+
+// miscAgentCmd represents the misc agent command
+var miscAgentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Serve shares of distributed perf tests to misc coordinate",
+	Long: `Serve shares of distributed perf tests to misc coordinate. The agent requires
+coordinators to present a shared token, distributed.token of the misc config
+or, if that is empty, the ` + miscmanager.DistributedTokenEnv + ` environment variable, and
+doesn't start without one.`,
+	Args: cobra.NoArgs,
+	Run:  miscAgent,
+}
+
+// miscCoordinateCmd represents the misc coordinate command
+var miscCoordinateCmd = &cobra.Command{
+	Use:   "coordinate",
+	Short: "Split the perf test across misc agents and merge their results",
+	Long: `Split the workers, requests and rates of perf_test evenly across the agents,
+start them together and merge the histograms they recorded into one report.
+Agents are started with misc agent. For a local try, start the two agents of
+the example misc config with the same token:
+
+  export ` + miscmanager.DistributedTokenEnv + `=<secret>
+  tunip misc agent &
+  tunip misc agent --miscAgentListen 127.0.0.1:9101 &
+  tunip misc coordinate
+
+Agents and coordinators share distributed.token of the misc config or, if that
+is empty, the ` + miscmanager.DistributedTokenEnv + ` environment variable.`,
+	Args: cobra.NoArgs,
+	Run:  miscCoordinate,
+}
+
 func init() {
 	rootCmd.AddCommand(miscCmd)
+	miscCmd.AddCommand(miscListCmd)
+	miscCmd.AddCommand(miscRunCmd)
+	miscCmd.AddCommand(miscCompareCmd)
+	miscCmd.AddCommand(miscAgentCmd)
+	miscCmd.AddCommand(miscCoordinateCmd)
 
 	keyName := "miscConfig"
 	pflag.StringVar(&miscConfig, keyName, "./configs/misc.json", "Misc configurations")
-	miscCmd.Flags().AddFlag(pflag.CommandLine.Lookup(keyName))
+	miscCmd.PersistentFlags().AddFlag(pflag.CommandLine.Lookup(keyName))
+
+	keyName = "miscAgentListen"
+	pflag.StringVar(&miscAgentListen, keyName, "127.0.0.1:9100", "Address misc agent listens on")
+	miscAgentCmd.Flags().AddFlag(pflag.CommandLine.Lookup(keyName))
+
+	keyName = "miscAgents"
+	pflag.StringSliceVar(&miscAgents, keyName, nil, "Agents to coordinate, host:port (default is distributed.agents of the misc config)")
+	miscCoordinateCmd.Flags().AddFlag(pflag.CommandLine.Lookup(keyName))
 }
 
 // misc main function for misc command
 func misc(cmd *cobra.Command, args []string) {
+	runMiscTests(nil)
+}
+
+// miscRun main function for misc run command
+func miscRun(cmd *cobra.Command, args []string) {
+	runMiscTests(args)
+}
+
+func runMiscTests(names []string) {
 	logger := logp.NewLogger(ModuleName)
-	logger.Infof("Enter with miscConfig %s", miscConfig)
+	logger.Infof("Enter with miscConfig %s, tests %v", miscConfig, names)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	results, err := miscmanager.Run(ctx, miscConfig, names)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, result := range results {
+		if result.Failed() {
+			failed = true
+			fmt.Printf("%s: FAIL after %s: %s\n", result.Name, result.Duration, result.Error)
+		} else {
+			fmt.Printf("%s: OK after %s\n", result.Name, result.Duration)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// miscAgent main function for misc agent command
+func miscAgent(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := miscmanager.RunAgent(ctx, miscConfig, miscAgentListen); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+}
+
+// miscCoordinate main function for misc coordinate command
+func miscCoordinate(cmd *cobra.Command, args []string) {
+	logger := logp.NewLogger(ModuleName)
+	logger.Infof("Enter with miscConfig %s, agents %v", miscConfig, miscAgents)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	result, err := miscmanager.Coordinate(ctx, miscConfig, miscAgents)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if result.Failed() {
+		fmt.Printf("%s: FAIL after %s: %s\n", result.Name, result.Duration, result.Error)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK after %s\n", result.Name, result.Duration)
+}
+
+// miscList main function for misc list command
+func miscList(cmd *cobra.Command, args []string) {
+	infos, err := miscmanager.List(miscConfig)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	for _, info := range infos {
+		state := "not configured"
+		if info.Enabled {
+			state = "enabled"
+		} else if info.Configured {
+			state = "disabled"
+		}
+		fmt.Printf("%-20s %s\n", info.Name, state)
+	}
+}
 
-	miscmanager.Run(miscConfig)
+// miscCompare main function for misc compare command
+func miscCompare(cmd *cobra.Command, args []string) {
+	comparisons, err := miscmanager.CompareReports(miscConfig, args[0], args[1])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if miscmanager.PrintComparisons(os.Stdout, comparisons) {
+		os.Exit(1)
+	}
 }
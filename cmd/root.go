@@ -48,9 +48,10 @@ func init() {
 	// will be global for your application.
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is ./configs/tunip.json or $HOME/tunip.json)")
 
-	// for log
+	// for log. The flags are parsed by cobra once added to the commands;
+	// parsing pflag.CommandLine here would reject the flags of commands
+	// registered after this init.
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
-	pflag.Parse()
 	viper.BindPFlags(pflag.CommandLine)
 
 	rootCmd.PersistentFlags().AddFlag(pflag.CommandLine.Lookup("verbose"))
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/colinzuo/tunip/internal/logship"
+	"github.com/colinzuo/tunip/pkg/logp"
+)
+
+var (
+	shipOutput     string
+	shipURL        string
+	shipSyslogAddr string
+	shipCheckpoint string
+	shipBatchSize  int
+	shipPoll       time.Duration
+)
+
+// shipCmd represents the ship command
+var shipCmd = &cobra.Command{
+	Use:   "ship",
+	Short: "Follow the log files and forward their lines",
+	Long: `Tail the current and rotated log files of the configured file output and
+forward their lines to stdout, an HTTP endpoint or syslog. The position of
+the last acknowledged line is checkpointed, so restarts and rotations don't
+lose lines.`,
+	Args: cobra.NoArgs,
+	Run:  ship,
+}
+
+func init() {
+	rootCmd.AddCommand(shipCmd)
+
+	pflag.StringVar(&shipOutput, "shipOutput", "stdout", "Output to forward to: stdout, http or syslog")
+	pflag.StringVar(&shipURL, "shipURL", "", "Endpoint of the http output")
+	pflag.StringVar(&shipSyslogAddr, "shipSyslogAddr", "", "Address of the syslog output, e.g. udp://localhost:514 (default is the local daemon)")
+	pflag.StringVar(&shipCheckpoint, "shipCheckpoint", "", "Checkpoint file (default is <log file>.checkpoint)")
+	pflag.IntVar(&shipBatchSize, "shipBatchSize", 500, "Maximum number of lines per batch")
+	pflag.DurationVar(&shipPoll, "shipPoll", time.Second, "Interval between checks for new lines")
+	for _, keyName := range []string{"shipOutput", "shipURL", "shipSyslogAddr", "shipCheckpoint", "shipBatchSize", "shipPoll"} {
+		shipCmd.Flags().AddFlag(pflag.CommandLine.Lookup(keyName))
+	}
+}
+
+// ship main function for ship command
+func ship(cmd *cobra.Command, args []string) {
+	logger := logp.NewLogger(ModuleName)
+	logger.Infof("Enter ship with output %s", shipOutput)
+
+	sink, err := logship.NewSink(logship.SinkConfig{
+		Output:     shipOutput,
+		URL:        shipURL,
+		SyslogAddr: shipSyslogAddr,
+		Timeout:    10 * time.Second,
+	}, os.Stdout)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	defer sink.Close()
+
+	files := logp.GetFileConfig()
+	follower := logship.NewFollower(logship.Config{
+		Dir:          files.Path,
+		Name:         files.Name,
+		Checkpoint:   shipCheckpoint,
+		PollInterval: shipPoll,
+		BatchSize:    shipBatchSize,
+	}, sink)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := follower.Run(ctx); err != nil {
+		logger.Errorf("ship failed: %s", err)
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -34,5 +34,11 @@ func main() {
 
 	logger.Info("Hello, world!")
 
-	logger.With("json_extract", auditEvent{Type: "TUNIP_TEST", GUID: "20180614"}).Info("Hello Again")
+	event := auditEvent{Type: "TUNIP_TEST", GUID: "20180614"}
+	logger.With("json_extract", event).Info("Hello Again")
+
+	if err := logp.Audit().Log(event.Type, event); err != nil && err != logp.ErrAuditDisabled {
+		logger.Errorf("audit failed: %s", err)
+	}
+	logp.Sync()
 }
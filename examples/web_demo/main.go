@@ -10,9 +10,9 @@ import (
 
 	"github.com/colinzuo/tunip/pkg/logp"
 	"github.com/colinzuo/tunip/pkg/logp/configure"
+	"github.com/colinzuo/tunip/pkg/utils"
 	"github.com/colinzuo/tunip/thirdparty/github.com/gin-contrib/cors"
 	"github.com/colinzuo/tunip/thirdparty/github.com/gin-contrib/static"
-	"github.com/colinzuo/tunip/utils"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
@@ -39,8 +39,10 @@ func main() {
 
 	configure.Logging(appName)
 	logger := logp.NewLogger("gin")
+	utils.RedirectGin()
 
 	router := gin.New()
+	router.Use(utils.Tracing())
 	router.Use(utils.Ginzap(logger))
 	router.Use(gin.Recovery())
 	router.Use(cors.Default())
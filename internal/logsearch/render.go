@@ -0,0 +1,120 @@
+package logsearch
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Renderer writes entries in some output format.
+type Renderer interface {
+	Render(e *Entry) error
+	Flush() error
+}
+
+// NewRenderer returns a renderer for the format console, json or csv.
+func NewRenderer(format string, w io.Writer) (Renderer, error) {
+	switch format {
+	case "", "console":
+		return &consoleRenderer{w: w}, nil
+	case "json":
+		return &jsonRenderer{enc: json.NewEncoder(w)}, nil
+	case "csv":
+		return newCSVRenderer(w), nil
+	default:
+		return nil, errors.Errorf("unknown format '%s'", format)
+	}
+}
+
+// consoleRenderer mimics the logp console encoder.
+type consoleRenderer struct {
+	w io.Writer
+}
+
+func (r *consoleRenderer) Render(e *Entry) error {
+	parts := []string{e.Time.Format(TimeLayout), strings.ToUpper(e.Level)}
+	if e.Logger != "" {
+		parts = append(parts, "["+e.Logger+"]")
+	}
+	if e.Caller != "" {
+		parts = append(parts, e.Caller)
+	}
+	parts = append(parts, e.Message)
+	if len(e.Fields) > 0 {
+		parts = append(parts, fieldsJSON(e))
+	}
+	line := strings.Join(parts, "\t") + "\n"
+	if e.Stacktrace != "" {
+		line += e.Stacktrace + "\n"
+	}
+	_, err := io.WriteString(r.w, line)
+	return err
+}
+
+func (r *consoleRenderer) Flush() error {
+	return nil
+}
+
+type jsonRenderer struct {
+	enc *json.Encoder
+}
+
+func (r *jsonRenderer) Render(e *Entry) error {
+	m := make(map[string]interface{}, len(e.Fields)+6)
+	for k, v := range e.Fields {
+		m[k] = v
+	}
+	m[KeyTime] = e.Time.Format(TimeLayout)
+	m[KeyLevel] = e.Level
+	m[KeyMessage] = e.Message
+	for k, v := range map[string]string{KeyLogger: e.Logger, KeyCaller: e.Caller, KeyStacktrace: e.Stacktrace} {
+		if v != "" {
+			m[k] = v
+		}
+	}
+	return r.enc.Encode(m)
+}
+
+func (r *jsonRenderer) Flush() error {
+	return nil
+}
+
+type csvRenderer struct {
+	w      *csv.Writer
+	header bool
+}
+
+func newCSVRenderer(w io.Writer) *csvRenderer {
+	return &csvRenderer{w: csv.NewWriter(w)}
+}
+
+func (r *csvRenderer) Render(e *Entry) error {
+	if !r.header {
+		r.header = true
+		if err := r.w.Write([]string{KeyTime, KeyLevel, KeyLogger, KeyCaller, KeyMessage, "fields"}); err != nil {
+			return err
+		}
+	}
+	fields := ""
+	if len(e.Fields) > 0 {
+		fields = fieldsJSON(e)
+	}
+	return r.w.Write([]string{e.Time.Format(TimeLayout), e.Level, e.Logger, e.Caller, e.Message, fields})
+}
+
+func (r *csvRenderer) Flush() error {
+	r.w.Flush()
+	return r.w.Error()
+}
+
+func fieldsJSON(e *Entry) string {
+	data, err := json.Marshal(e.Fields)
+	if err != nil {
+		return fmt.Sprint(e.Fields)
+	}
+	return string(data)
+}
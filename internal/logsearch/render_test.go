@@ -0,0 +1,56 @@
+package logsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderers(t *testing.T) {
+	entries := parseTestEntries(t)
+
+	cases := []struct {
+		format string
+		check  func(string)
+	}{
+		{"console", func(out string) {
+			lines := strings.Split(out, "\n")
+			assert.Equal(t, "2021-06-01T10:00:00.000+08:00\tINFO\t[main]\tstarted\t{\"port\":8080}", lines[0])
+			assert.Equal(t, "main.go:1", lines[3], "stacktrace on its own line")
+		}},
+		{"json", func(out string) {
+			var m map[string]interface{}
+			if assert.NoError(t, json.Unmarshal([]byte(strings.Split(out, "\n")[2]), &m)) {
+				assert.Equal(t, "job 2 failed", m[KeyMessage])
+				assert.Equal(t, "dispatcher", m[KeyLogger])
+				assert.Equal(t, map[string]interface{}{"id": float64(2)}, m["job"])
+				assert.Equal(t, "2021-06-01T10:00:02.000+08:00", m[KeyTime])
+			}
+		}},
+		{"csv", func(out string) {
+			lines := strings.Split(strings.TrimSpace(out), "\n")
+			if assert.Len(t, lines, 4) {
+				assert.Equal(t, "timestamp,level,logger,caller,message,fields", lines[0])
+				assert.Equal(t, `2021-06-01T10:00:01.000+08:00,debug,main.worker,,job 1,"{""job"":{""id"":1}}"`, lines[2])
+			}
+		}},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		r, err := NewRenderer(c.format, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			assert.NoError(t, r.Render(e), c.format)
+		}
+		assert.NoError(t, r.Flush(), c.format)
+		c.check(buf.String())
+	}
+
+	_, err := NewRenderer("xml", &bytes.Buffer{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,225 @@
+// Package logsearch reads JSON log files written by logp and filters their
+// entries.
+package logsearch
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/colinzuo/tunip/pkg/logp/logfiles"
+)
+
+// TimeLayout is the timestamp layout used by logp.
+const TimeLayout = "2006-01-02T15:04:05.000-07:00"
+
+// Keys of the JSON encoder, see logp encoding.
+const (
+	KeyTime       = "timestamp"
+	KeyLevel      = "level"
+	KeyLogger     = "logger"
+	KeyCaller     = "caller"
+	KeyMessage    = "message"
+	KeyStacktrace = "stacktrace"
+)
+
+// Entry is a decoded log entry.
+type Entry struct {
+	Time       time.Time
+	Level      string
+	Logger     string
+	Caller     string
+	Message    string
+	Stacktrace string
+	Fields     map[string]interface{}
+}
+
+// ParseEntry decodes one JSON line written by logp.
+func ParseEntry(line []byte) (*Entry, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return nil, err
+	}
+	e := &Entry{Fields: raw}
+	ts, _ := raw[KeyTime].(string)
+	t, err := time.Parse(TimeLayout, ts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %q", ts)
+	}
+	e.Time = t
+	e.Level = take(raw, KeyLevel)
+	e.Logger = take(raw, KeyLogger)
+	e.Caller = take(raw, KeyCaller)
+	e.Message = take(raw, KeyMessage)
+	e.Stacktrace = take(raw, KeyStacktrace)
+	delete(raw, KeyTime)
+	return e, nil
+}
+
+func take(m map[string]interface{}, key string) string {
+	v, _ := m[key].(string)
+	delete(m, key)
+	return v
+}
+
+// ParseTime parses a filter bound given as a logp timestamp, RFC3339 or a
+// duration before now. The zero time is returned for an empty value.
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{TimeLayout, time.RFC3339Nano} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s'", value)
+}
+
+// ParseLevel parses a minimum level for a filter. Besides the names zap
+// writes, it accepts the names of the logp config, e.g. warning.
+func ParseLevel(value string) (zapcore.Level, error) {
+	var level zapcore.Level
+	if strings.EqualFold(value, "warning") {
+		return zapcore.WarnLevel, nil
+	}
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return level, fmt.Errorf("invalid level '%s'", value)
+	}
+	return level, nil
+}
+
+// Filter selects entries. Zero values match everything but Level.
+type Filter struct {
+	Level   zapcore.Level     // Minimum level, the zero value is info.
+	Loggers []string          // Logger names, matching children too.
+	Since   time.Time         // Inclusive.
+	Until   time.Time         // Exclusive.
+	Fields  map[string]string // Field values compared as strings.
+	Message *regexp.Regexp
+}
+
+// Match reports whether e passes the filter.
+func (f *Filter) Match(e *Entry) bool {
+	if f.Level > zapcore.DebugLevel {
+		var level zapcore.Level
+		if err := level.UnmarshalText([]byte(e.Level)); err == nil && level < f.Level {
+			return false
+		}
+	}
+	if len(f.Loggers) > 0 && !f.matchLogger(e.Logger) {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	for k, v := range f.Fields {
+		fv, found := e.Fields[k]
+		if !found || fieldString(fv) != v {
+			return false
+		}
+	}
+	if f.Message != nil && !f.Message.MatchString(e.Message) {
+		return false
+	}
+	return true
+}
+
+func (f *Filter) matchLogger(name string) bool {
+	for _, l := range f.Loggers {
+		if name == l || strings.HasPrefix(name, l+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func fieldString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return "null"
+	case map[string]interface{}, []interface{}:
+		data, _ := json.Marshal(v)
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Stats counts what a search went through.
+type Stats struct {
+	Files   int
+	Lines   int
+	Matched int
+	Skipped int // Lines that are not logp JSON entries.
+}
+
+// ErrNotJSON is returned by Search when none of the lines read is a JSON
+// entry, as for files written with the console encoding.
+var ErrNotJSON = errors.New("no JSON log entries found, the file output is not JSON (set json: true in the log config)")
+
+// Search reads files in order and calls fn for every entry matching the
+// filter. Lines that can't be decoded are skipped, but if no line could be
+// decoded ErrNotJSON is returned. Entries before Since are skipped cheaply by
+// ignoring backups rotated before it.
+func Search(files []logfiles.File, filter *Filter, fn func(*Entry) error) (Stats, error) {
+	var stats Stats
+	for _, file := range files {
+		if !filter.Since.IsZero() && !file.IsCurrent() && file.Rotated.Before(filter.Since) {
+			continue
+		}
+		stats.Files++
+		if err := searchFile(file.Path, filter, fn, &stats); err != nil {
+			return stats, err
+		}
+	}
+	if stats.Lines > 0 && stats.Skipped == stats.Lines {
+		return stats, ErrNotJSON
+	}
+	return stats, nil
+}
+
+func searchFile(path string, filter *Filter, fn func(*Entry) error, stats *Stats) error {
+	r, err := logfiles.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return scan(r, filter, fn, stats)
+}
+
+func scan(r io.Reader, filter *Filter, fn func(*Entry) error, stats *Stats) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		stats.Lines++
+		e, err := ParseEntry(scanner.Bytes())
+		if err != nil {
+			stats.Skipped++
+			continue
+		}
+		if !filter.Match(e) {
+			continue
+		}
+		stats.Matched++
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,191 @@
+package logsearch
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/colinzuo/tunip/pkg/logp/logfiles"
+)
+
+const testLines = `{"level":"info","timestamp":"2021-06-01T10:00:00.000+08:00","logger":"main","message":"started","port":8080}
+{"level":"debug","timestamp":"2021-06-01T10:00:01.000+08:00","logger":"main.worker","message":"job 1","job":{"id":1}}
+not a log line
+{"level":"error","timestamp":"2021-06-01T10:00:02.000+08:00","logger":"dispatcher","message":"job 2 failed","job":{"id":2},"stacktrace":"main.go:1"}
+`
+
+func parseTestEntries(t *testing.T) []*Entry {
+	var entries []*Entry
+	for _, line := range strings.Split(strings.TrimSpace(testLines), "\n") {
+		if e, err := ParseEntry([]byte(line)); err == nil {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) != 3 {
+		t.Fatalf("parsed %d entries", len(entries))
+	}
+	return entries
+}
+
+func TestParseEntry(t *testing.T) {
+	e, err := ParseEntry([]byte(`{"level":"warn","timestamp":"2021-06-01T10:00:00.123+08:00","logger":"a","caller":"a.go:1","message":"m","k":"v"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "warn", e.Level)
+	assert.Equal(t, "a", e.Logger)
+	assert.Equal(t, "a.go:1", e.Caller)
+	assert.Equal(t, "m", e.Message)
+	assert.Equal(t, map[string]interface{}{"k": "v"}, e.Fields)
+	assert.Equal(t, 123*time.Millisecond, time.Duration(e.Time.Nanosecond()))
+
+	_, err = ParseEntry([]byte(`{"message":"no time"}`))
+	assert.Error(t, err)
+	_, err = ParseEntry([]byte(`plain`))
+	assert.Error(t, err)
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		in       string
+		expected time.Time
+	}{
+		{"", time.Time{}},
+		{"2h", now.Add(-2 * time.Hour)},
+		{"2021-06-01T10:00:00.000+08:00", time.Date(2021, 6, 1, 2, 0, 0, 0, time.UTC)},
+		{"2021-06-01T10:00:00Z", time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		got, err := ParseTime(c.in, now)
+		if assert.NoError(t, err, c.in) {
+			assert.True(t, c.expected.Equal(got), "%s: %s", c.in, got)
+		}
+	}
+	_, err := ParseTime("yesterday", now)
+	assert.Error(t, err)
+}
+
+func TestParseLevel(t *testing.T) {
+	for in, expected := range map[string]zapcore.Level{
+		"debug":   zapcore.DebugLevel,
+		"warn":    zapcore.WarnLevel,
+		"warning": zapcore.WarnLevel,
+		"ERROR":   zapcore.ErrorLevel,
+		"fatal":   zapcore.FatalLevel,
+	} {
+		level, err := ParseLevel(in)
+		if assert.NoError(t, err, in) {
+			assert.Equal(t, expected, level, in)
+		}
+	}
+	_, err := ParseLevel("verbose")
+	assert.Error(t, err)
+}
+
+func TestFilterMatch(t *testing.T) {
+	warn, err := ParseEntry([]byte(`{"level":"warn","timestamp":"2021-06-01T10:00:03.000+08:00","logger":"main","message":"disk almost full"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := append(parseTestEntries(t), warn)
+	at := func(s string) time.Time {
+		ts, _ := time.Parse(TimeLayout, s)
+		return ts
+	}
+	// The zero level is info.
+	debug := zapcore.DebugLevel
+	cases := []struct {
+		name    string
+		filter  Filter
+		matched []string
+	}{
+		{"all", Filter{Level: debug}, []string{"started", "job 1", "job 2 failed", "disk almost full"}},
+		{"level", Filter{Level: zapcore.InfoLevel}, []string{"started", "job 2 failed", "disk almost full"}},
+		{"warn level", Filter{Level: zapcore.WarnLevel}, []string{"job 2 failed", "disk almost full"}},
+		{"logger and children", Filter{Level: debug, Loggers: []string{"main"}}, []string{"started", "job 1", "disk almost full"}},
+		{"logger prefix only", Filter{Level: debug, Loggers: []string{"mai"}}, nil},
+		{"since", Filter{Level: debug, Since: at("2021-06-01T10:00:01.000+08:00")}, []string{"job 1", "job 2 failed", "disk almost full"}},
+		{"until", Filter{Level: debug, Until: at("2021-06-01T10:00:01.000+08:00")}, []string{"started"}},
+		{"number field", Filter{Level: debug, Fields: map[string]string{"port": "8080"}}, []string{"started"}},
+		{"object field", Filter{Level: debug, Fields: map[string]string{"job": `{"id":2}`}}, []string{"job 2 failed"}},
+		{"message", Filter{Level: debug, Message: regexp.MustCompile(`^job \d$`)}, []string{"job 1"}},
+	}
+	for _, c := range cases {
+		var matched []string
+		for _, e := range entries {
+			if c.filter.Match(e) {
+				matched = append(matched, e.Message)
+			}
+		}
+		assert.Equal(t, c.matched, matched, c.name)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A compressed backup rotated before the filter and the current file.
+	backup := filepath.Join(dir, "app-2021-06-01T01-00-00.000.log.gz")
+	f, err := os.Create(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	zw.Write([]byte(testLines))
+	zw.Close()
+	f.Close()
+	current := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(current, []byte(testLines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := logfiles.List(dir, "app.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []string
+	collect := func(e *Entry) error {
+		messages = append(messages, e.Message)
+		return nil
+	}
+	stats, err := Search(files, &Filter{Level: zapcore.ErrorLevel}, collect)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"job 2 failed", "job 2 failed"}, messages)
+	assert.Equal(t, Stats{Files: 2, Lines: 8, Matched: 2, Skipped: 2}, stats)
+
+	messages = nil
+	since := time.Date(2021, 6, 1, 5, 0, 0, 0, time.UTC)
+	stats, err = Search(files, &Filter{Since: since}, collect)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Files, "the backup rotated before since is skipped")
+}
+
+func TestSearchNotJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	console := "2021-06-01T10:00:00.000+0800\tINFO\tmain\tstarted\n"
+	if err := ioutil.WriteFile(path, []byte(console), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := Search([]logfiles.File{{Path: path}}, &Filter{}, func(*Entry) error { return nil })
+	assert.Equal(t, ErrNotJSON, err)
+	assert.Equal(t, Stats{Files: 1, Lines: 1, Skipped: 1}, stats)
+}
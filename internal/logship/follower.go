@@ -0,0 +1,402 @@
+// Package logship follows the rotating log files written by logp and
+// forwards their lines to a Sink. The position of the last acknowledged line
+// is saved in a checkpoint file so that a restarted follower neither skips
+// nor resends lines, across lumberjack rotations and compressions.
+//
+// Delivery is at-least-once: a batch whose acknowledgement is lost before the
+// checkpoint is saved is sent again.
+package logship
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/colinzuo/tunip/pkg/logp"
+	"github.com/colinzuo/tunip/pkg/logp/logfiles"
+)
+
+// ModuleName for log
+const (
+	ModuleName string = "Ship"
+)
+
+// Config contains the configuration options of the Follower.
+type Config struct {
+	Dir          string        // Directory of the log files.
+	Name         string        // Name of the current log file.
+	Checkpoint   string        // Checkpoint file, defaults to <Dir>/<Name>.checkpoint.
+	PollInterval time.Duration // How often the current file is checked for new lines.
+	BatchSize    int           // Maximum number of lines per batch.
+	MaxBackoff   time.Duration // Maximum delay between retries of a failed batch.
+}
+
+// Follower tails the log files and forwards their lines.
+type Follower struct {
+	cfg    Config
+	sink   Sink
+	logger *logp.Logger
+
+	src      *source
+	batch    []string
+	batchPos Position // Position after the last line of batch.
+}
+
+// source is an open log file being read line by line.
+type source struct {
+	file    logfiles.File
+	rc      io.ReadCloser
+	osFile  *os.File // nil for compressed files.
+	r       *bufio.Reader
+	pos     Position // Position after the last complete line read.
+	partial []byte   // Trailing line without newline yet.
+	opened  time.Time
+}
+
+// NewFollower returns a Follower forwarding to sink.
+func NewFollower(cfg Config, sink Sink) *Follower {
+	if cfg.Checkpoint == "" {
+		cfg.Checkpoint = filepath.Join(cfg.Dir, cfg.Name+".checkpoint")
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 500
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	return &Follower{cfg: cfg, sink: sink, logger: logp.NewLogger(ModuleName)}
+}
+
+// Run forwards lines until ctx is done. Lines read so far are forwarded once
+// more before returning.
+func (f *Follower) Run(ctx context.Context) error {
+	logger := f.logger
+	defer f.closeSource()
+
+	pos, err := LoadCheckpoint(f.cfg.Checkpoint)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Enter Run with checkpoint %+v", pos)
+	defer logger.Info("Leave Run")
+
+	files, err := logfiles.List(f.cfg.Dir, f.cfg.Name)
+	if err != nil {
+		return err
+	}
+	queue, offset := f.resume(files, pos)
+
+	for {
+		// Rotated files are read to the end, the current one is followed.
+		for len(queue) > 0 && ctx.Err() == nil {
+			file := queue[0]
+			queue = queue[1:]
+			if err := f.open(file, offset); err != nil {
+				return err
+			}
+			offset = 0
+			if file.IsCurrent() {
+				break
+			}
+			if err := f.readToEnd(ctx); err != nil {
+				return err
+			}
+			f.closeSource()
+		}
+
+		if err := f.follow(ctx); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			f.ship(ctx)
+			return nil
+		}
+
+		// The followed file was rotated, pick up every file written since.
+		files, err = logfiles.List(f.cfg.Dir, f.cfg.Name)
+		if err != nil {
+			return err
+		}
+		queue = f.after(files)
+		f.closeSource()
+	}
+}
+
+// resume returns the files to read given the checkpoint and the offset in
+// the first one.
+func (f *Follower) resume(files []logfiles.File, pos Position) ([]logfiles.File, int64) {
+	if pos.IsZero() {
+		if n := len(files); n > 0 && files[n-1].IsCurrent() {
+			return files[n-1:], 0
+		}
+		return nil, 0
+	}
+	for i, file := range files {
+		if matches(file, pos) {
+			return files[i:], pos.Offset
+		}
+	}
+	f.logger.Warnf("Checkpointed file %s not found, lines may have been lost; starting from the oldest file", pos.Path)
+	return files, 0
+}
+
+// after returns the files rotated after the current source.
+func (f *Follower) after(files []logfiles.File) []logfiles.File {
+	for i, file := range files {
+		if !file.IsCurrent() && matches(file, f.src.pos) {
+			return files[i+1:]
+		}
+	}
+	// Fall back to the files rotated since the source was opened.
+	var queue []logfiles.File
+	for _, file := range files {
+		if file.IsCurrent() || file.Rotated.After(f.src.opened) {
+			queue = append(queue, file)
+		}
+	}
+	return queue
+}
+
+func (f *Follower) open(file logfiles.File, offset int64) error {
+	rc, err := logfiles.Open(file.Path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", file.Path)
+	}
+	src := &source{file: file, rc: rc, opened: time.Now()}
+	src.pos.Path = file.Path
+
+	if osFile, ok := rc.(*os.File); ok {
+		src.osFile = osFile
+		info, err := osFile.Stat()
+		if err != nil {
+			rc.Close()
+			return err
+		}
+		src.pos.Inode = infoInode(info)
+		if offset > info.Size() {
+			f.logger.Warnf("%s is shorter than checkpoint offset %d, was truncated", file.Path, offset)
+			offset = 0
+		}
+		if _, err := osFile.Seek(offset, io.SeekStart); err != nil {
+			rc.Close()
+			return err
+		}
+	} else if _, err := io.CopyN(ioutil.Discard, rc, offset); err != nil {
+		rc.Close()
+		return errors.Wrapf(err, "failed to skip to offset %d of %s", offset, file.Path)
+	}
+	src.pos.Offset = offset
+	src.r = bufio.NewReader(rc)
+	f.src = src
+	f.logger.Infof("Reading %s from offset %d", file.Path, offset)
+	return f.updateFingerprint()
+}
+
+func (f *Follower) closeSource() {
+	if f.src != nil {
+		f.src.rc.Close()
+		f.src = nil
+	}
+}
+
+// updateFingerprint hashes the leading bytes of the source, until it has
+// fingerprintSize of them.
+func (f *Follower) updateFingerprint() error {
+	src := f.src
+	if src.pos.FingerprintLen >= fingerprintSize {
+		return nil
+	}
+
+	var r io.Reader
+	if src.osFile != nil {
+		r = io.NewSectionReader(src.osFile, 0, fingerprintSize)
+	} else {
+		rc, err := logfiles.Open(src.file.Path)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		r = rc
+	}
+	fp, n, err := fingerprint(r)
+	if err != nil {
+		return errors.Wrapf(err, "failed to fingerprint %s", src.file.Path)
+	}
+	src.pos.Fingerprint, src.pos.FingerprintLen = fp, n
+	return nil
+}
+
+// readLines reads the complete lines available in the source, shipping full
+// batches.
+func (f *Follower) readLines(ctx context.Context) error {
+	src := f.src
+	for {
+		line, err := src.r.ReadBytes('\n')
+		if err == io.EOF {
+			src.partial = append(src.partial, line...)
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", src.file.Path)
+		}
+		if len(src.partial) > 0 {
+			line = append(src.partial, line...)
+			src.partial = nil
+		}
+		src.pos.Offset += int64(len(line))
+		if err := f.add(ctx, line); err != nil {
+			return err
+		}
+	}
+}
+
+// readToEnd reads a file that won't grow anymore, including a last line
+// without newline.
+func (f *Follower) readToEnd(ctx context.Context) error {
+	if err := f.readLines(ctx); err != nil {
+		return err
+	}
+	if src := f.src; len(src.partial) > 0 {
+		src.pos.Offset += int64(len(src.partial))
+		line := src.partial
+		src.partial = nil
+		if err := f.add(ctx, line); err != nil {
+			return err
+		}
+	}
+	return f.ship(ctx)
+}
+
+func (f *Follower) add(ctx context.Context, line []byte) error {
+	n := len(line)
+	for n > 0 && (line[n-1] == '\n' || line[n-1] == '\r') {
+		n--
+	}
+	if n == 0 {
+		f.batchPos = f.src.pos
+		return nil
+	}
+	if err := f.updateFingerprint(); err != nil {
+		return err
+	}
+	f.batch = append(f.batch, string(line[:n]))
+	f.batchPos = f.src.pos
+	if len(f.batch) >= f.cfg.BatchSize {
+		return f.ship(ctx)
+	}
+	return nil
+}
+
+// follow reads the current file as it grows. It returns when ctx is done or
+// after the file was rotated and read to its end.
+func (f *Follower) follow(ctx context.Context) error {
+	for {
+		if f.src == nil {
+			// Wait for the current file to be created.
+			files, err := logfiles.List(f.cfg.Dir, f.cfg.Name)
+			if err == nil && len(files) > 0 && files[len(files)-1].IsCurrent() {
+				if err := f.open(files[len(files)-1], 0); err != nil {
+					return err
+				}
+			}
+		}
+
+		if f.src != nil {
+			if err := f.readLines(ctx); err != nil {
+				return err
+			}
+			if err := f.ship(ctx); err != nil {
+				return err
+			}
+
+			rotated, err := f.checkRotation()
+			if err != nil {
+				return err
+			}
+			if rotated {
+				return f.readToEnd(ctx)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(f.cfg.PollInterval):
+		}
+	}
+}
+
+// checkRotation reports whether the path of the current file now refers to
+// another file. A truncated file is read again from the start.
+func (f *Follower) checkRotation() (bool, error) {
+	src := f.src
+	info, err := os.Stat(src.file.Path)
+	if os.IsNotExist(err) {
+		// Renamed, the new file isn't created yet.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if inode := infoInode(info); inode != 0 && inode != src.pos.Inode {
+		return true, nil
+	}
+	if info.Size() < src.pos.Offset+int64(len(src.partial)) {
+		f.logger.Warnf("%s was truncated, reading from the start", src.file.Path)
+		if _, err := src.osFile.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		src.r.Reset(src.osFile)
+		src.partial = nil
+		src.pos.Offset = 0
+		src.pos.FingerprintLen = 0
+		return false, f.updateFingerprint()
+	}
+	return false, nil
+}
+
+// ship sends the pending batch, retrying with backoff while ctx is not done,
+// and saves the checkpoint once it is acknowledged.
+func (f *Follower) ship(ctx context.Context) error {
+	if len(f.batch) == 0 {
+		if f.batchPos != (Position{}) {
+			// Skipped empty lines only, still move the checkpoint forward.
+			err := SaveCheckpoint(f.cfg.Checkpoint, f.batchPos)
+			f.batchPos = Position{}
+			return err
+		}
+		return nil
+	}
+
+	backoff := 100 * time.Millisecond
+	for {
+		err := f.sink.Send(f.batch)
+		if err == nil {
+			break
+		}
+		f.logger.Warnf("Failed to send %d lines: %s", len(f.batch), err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > f.cfg.MaxBackoff {
+			backoff = f.cfg.MaxBackoff
+		}
+	}
+
+	// Don't log successful batches, the follower may be shipping its own log.
+	f.batch = f.batch[:0]
+	err := SaveCheckpoint(f.cfg.Checkpoint, f.batchPos)
+	f.batchPos = Position{}
+	return err
+}
@@ -0,0 +1,131 @@
+package logship
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memorySink struct {
+	mu    sync.Mutex
+	lines []string
+	fail  int
+}
+
+func (s *memorySink) Send(lines []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail > 0 {
+		s.fail--
+		return fmt.Errorf("unavailable")
+	}
+	s.lines = append(s.lines, lines...)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func (s *memorySink) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.lines)
+}
+
+func appendLines(t *testing.T, path string, from, to int) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i := from; i < to; i++ {
+		fmt.Fprintf(f, "line %d\n", i)
+	}
+}
+
+func rotate(t *testing.T, dir string, ts string, compress bool) {
+	backup := filepath.Join(dir, "app-"+ts+".log")
+	if err := os.Rename(filepath.Join(dir, "app.log"), backup); err != nil {
+		t.Fatal(err)
+	}
+	if !compress {
+		return
+	}
+	content, _ := ioutil.ReadFile(backup)
+	f, _ := os.Create(backup + ".gz")
+	gz := gzip.NewWriter(f)
+	gz.Write(content)
+	gz.Close()
+	f.Close()
+	os.Remove(backup)
+}
+
+func runFollower(t *testing.T, cfg Config, sink *memorySink, until int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- NewFollower(cfg, sink).Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sink.count() < until && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestFollower(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logship")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	cfg := Config{Dir: dir, Name: "app.log", PollInterval: 10 * time.Millisecond, BatchSize: 3}
+	sink := &memorySink{fail: 1}
+
+	appendLines(t, path, 0, 5)
+	runFollower(t, cfg, sink, 5)
+
+	// While stopped the file is rotated and compressed, and more is written.
+	appendLines(t, path, 5, 8)
+	rotate(t, dir, "2021-09-01T10-00-00.000", true)
+	appendLines(t, path, 8, 10)
+	rotate(t, dir, "2021-09-01T11-00-00.000", false)
+	appendLines(t, path, 10, 12)
+	runFollower(t, cfg, sink, 12)
+
+	// Rotation and truncation while following.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- NewFollower(cfg, sink).Run(ctx) }()
+	appendLines(t, path, 12, 14)
+	time.Sleep(50 * time.Millisecond)
+	rotate(t, dir, "2021-09-01T12-00-00.000", false)
+	appendLines(t, path, 14, 16)
+	deadline := time.Now().Add(5 * time.Second)
+	for sink.count() < 16 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	os.Truncate(path, 0)
+	appendLines(t, path, 16, 17)
+	for sink.count() < 17 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	assert.NoError(t, <-done)
+
+	var expected []string
+	for i := 0; i < 17; i++ {
+		expected = append(expected, fmt.Sprintf("line %d", i))
+	}
+	assert.Equal(t, expected, sink.lines)
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package logship
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileInode(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return infoInode(info), nil
+}
+
+func infoInode(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,115 @@
+package logship
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/colinzuo/tunip/pkg/logp/logfiles"
+)
+
+// fingerprintSize is the number of leading bytes identifying a file. It lets
+// the follower recognize a file after lumberjack compressed it, when its
+// inode is gone.
+const fingerprintSize = 1024
+
+// Position identifies a file and an offset within its (uncompressed) content.
+type Position struct {
+	Path           string `json:"path"` // Informational, files are renamed on rotation.
+	Inode          uint64 `json:"inode"`
+	Fingerprint    string `json:"fingerprint"`
+	FingerprintLen int    `json:"fingerprint_len"`
+	Offset         int64  `json:"offset"`
+}
+
+// IsZero reports whether no position was recorded yet.
+func (p Position) IsZero() bool {
+	return p.Inode == 0 && p.FingerprintLen == 0 && p.Offset == 0
+}
+
+// LoadCheckpoint reads the position saved in path. A missing file yields the
+// zero Position.
+func LoadCheckpoint(path string) (Position, error) {
+	var pos Position
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return pos, nil
+	}
+	if err != nil {
+		return pos, errors.Wrap(err, "failed to read checkpoint")
+	}
+	if err := json.Unmarshal(content, &pos); err != nil {
+		return pos, errors.Wrapf(err, "failed to parse checkpoint %s", path)
+	}
+	return pos, nil
+}
+
+// SaveCheckpoint atomically replaces the checkpoint in path.
+func SaveCheckpoint(path string, pos Position) error {
+	content, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to write checkpoint")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(content); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write checkpoint")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), path), "failed to write checkpoint")
+}
+
+// fingerprint hashes up to fingerprintSize leading bytes of r.
+func fingerprint(r io.Reader) (string, int, error) {
+	buf := make([]byte, fingerprintSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", 0, err
+	}
+	return hashPrefix(buf[:n]), n, nil
+}
+
+func hashPrefix(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// matches reports whether file is the one identified by pos. Uncompressed
+// files are compared by inode and fingerprint, compressed ones by
+// fingerprint only.
+func matches(file logfiles.File, pos Position) bool {
+	if !file.Compressed && pos.Inode != 0 {
+		inode, err := fileInode(file.Path)
+		if err != nil || inode != pos.Inode {
+			return false
+		}
+	}
+	if pos.FingerprintLen == 0 {
+		return !file.Compressed && pos.Inode != 0
+	}
+
+	r, err := logfiles.Open(file.Path)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	buf := make([]byte, pos.FingerprintLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return false
+	}
+	return hashPrefix(buf) == pos.Fingerprint
+}
@@ -0,0 +1,95 @@
+package logship
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/colinzuo/tunip/pkg/tracing"
+)
+
+// Sink forwards batches of log lines. A nil error acknowledges the batch.
+type Sink interface {
+	Send(lines []string) error
+	Close() error
+}
+
+// SinkConfig contains the configuration options of the sink.
+type SinkConfig struct {
+	Output     string // stdout, http or syslog.
+	URL        string // Endpoint of the http output.
+	SyslogAddr string // network://host:port of the syslog output, empty for the local daemon.
+	Timeout    time.Duration
+}
+
+// NewSink returns the sink for cfg.Output.
+func NewSink(cfg SinkConfig, stdout io.Writer) (Sink, error) {
+	switch cfg.Output {
+	case "", "stdout":
+		return &writerSink{w: stdout}, nil
+	case "http":
+		if cfg.URL == "" {
+			return nil, errors.New("http output requires a url")
+		}
+		return &httpSink{url: cfg.URL, client: tracing.NewHTTPClient(cfg.Timeout)}, nil
+	case "syslog":
+		return newSyslogSink(cfg.SyslogAddr)
+	default:
+		return nil, errors.Errorf("unknown output '%s'", cfg.Output)
+	}
+}
+
+type writerSink struct {
+	w io.Writer
+}
+
+func (s *writerSink) Send(lines []string) error {
+	_, err := io.WriteString(s.w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// httpSink posts batches as newline delimited JSON. Lines that aren't JSON,
+// e.g. of console encoded files, are sent as {"message": line}. Any 2xx
+// status acknowledges the batch.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpSink) Send(lines []string) error {
+	var body bytes.Buffer
+	for _, line := range lines {
+		if json.Valid([]byte(line)) {
+			body.WriteString(line)
+		} else {
+			data, _ := json.Marshal(map[string]string{"message": line})
+			body.Write(data)
+		}
+		body.WriteByte('\n')
+	}
+	rsp, err := s.client.Post(s.url, "application/x-ndjson", &body)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("http output failed with status %d", rsp.StatusCode)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package logship
+
+import (
+	"github.com/pkg/errors"
+)
+
+func newSyslogSink(addr string) (Sink, error) {
+	return nil, errors.New("syslog output is not supported on this platform")
+}
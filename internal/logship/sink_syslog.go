@@ -0,0 +1,58 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package logship
+
+import (
+	"log/syslog"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/colinzuo/tunip/internal/logsearch"
+)
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(addr string) (Sink, error) {
+	network := ""
+	if i := strings.Index(addr, "://"); i >= 0 {
+		network, addr = addr[:i], addr[i+3:]
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_LOCAL0, "tunip")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to syslog")
+	}
+	return &syslogSink{w: w}, nil
+}
+
+// Send writes every line with the severity matching its logp level.
+func (s *syslogSink) Send(lines []string) error {
+	for _, line := range lines {
+		level := ""
+		if e, err := logsearch.ParseEntry([]byte(line)); err == nil {
+			level = e.Level
+		}
+		var err error
+		switch level {
+		case "debug":
+			err = s.w.Debug(line)
+		case "warn", "warning":
+			err = s.w.Warning(line)
+		case "error", "dpanic", "panic", "fatal":
+			err = s.w.Err(line)
+		default:
+			err = s.w.Info(line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,35 @@
+package logship
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSink(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+	}))
+	defer server.Close()
+
+	sink, err := NewSink(SinkConfig{Output: "http", URL: server.URL, Timeout: time.Second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	lines := []string{`{"level":"info","message":"started"}`, "2021-06-01T10:00:00.000+0800\tINFO\t\"quoted\""}
+	if err := sink.Send(lines); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"level":"info","message":"started"}` + "\n" +
+		`{"message":"2021-06-01T10:00:00.000+0800\tINFO\t\"quoted\""}` + "\n"
+	assert.Equal(t, expected, body)
+}
@@ -0,0 +1,136 @@
+package miscmanager
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Comparison is the change of one metric between two reports.
+type Comparison struct {
+	Metric    string
+	Base      float64
+	New       float64
+	Change    float64 // Percent of Base, infinite if Base is 0.
+	Missing   bool    // The metric isn't in both reports, a failure too.
+	Regressed bool
+}
+
+func float64Ptr(v float64) *float64 {
+	return &v
+}
+
+// defaultThresholds are used for the load tests when misc.json configures
+// none, the other tests have no latency or throughput at the top level.
+var defaultThresholds = []Threshold{
+	{Metric: "latency.p50_ms", MaxIncrease: float64Ptr(10)},
+	{Metric: "latency.p99_ms", MaxIncrease: float64Ptr(10)},
+	{Metric: "throughput", MaxDecrease: float64Ptr(10)},
+	{Metric: "failed", MaxIncrease: float64Ptr(0)},
+}
+
+// defaultThresholdTests are the tests with a LatencyReport at the top level.
+var defaultThresholdTests = map[string]bool{perfTestName: true, "replay_test": true}
+
+// thresholdsOf returns the thresholds of the named test.
+func (c CompareConfig) thresholdsOf(name string) ([]Threshold, error) {
+	if thresholds := c.Tests[name]; len(thresholds) > 0 {
+		return thresholds, nil
+	}
+	if len(c.Thresholds) > 0 {
+		return c.Thresholds, nil
+	}
+	if defaultThresholdTests[name] {
+		return defaultThresholds, nil
+	}
+	return nil, errors.Errorf("no thresholds for %s, configure compare.tests.%s", name, name)
+}
+
+// Compare checks the metrics of the current report against a baseline.
+func Compare(base, current *Report, thresholds []Threshold) []Comparison {
+	if len(thresholds) == 0 {
+		thresholds = defaultThresholds
+	}
+	baseMetrics, newMetrics := base.Metrics(), current.Metrics()
+
+	comparisons := make([]Comparison, 0, len(thresholds))
+	for _, t := range thresholds {
+		c := Comparison{Metric: t.Metric}
+		var baseFound, newFound bool
+		c.Base, baseFound = baseMetrics[t.Metric]
+		c.New, newFound = newMetrics[t.Metric]
+		if !baseFound || !newFound {
+			c.Missing = true
+			comparisons = append(comparisons, c)
+			continue
+		}
+
+		switch {
+		case c.Base == c.New:
+			c.Change = 0
+		case c.Base == 0:
+			c.Change = math.Inf(1)
+			if c.New < 0 {
+				c.Change = math.Inf(-1)
+			}
+		default:
+			c.Change = (c.New - c.Base) / math.Abs(c.Base) * 100
+		}
+		if t.MaxIncrease != nil && c.Change > *t.MaxIncrease {
+			c.Regressed = true
+		}
+		if t.MaxDecrease != nil && -c.Change > *t.MaxDecrease {
+			c.Regressed = true
+		}
+		comparisons = append(comparisons, c)
+	}
+	return comparisons
+}
+
+// PrintComparisons writes the comparisons as a table and returns whether
+// any metric regressed or is missing.
+func PrintComparisons(w io.Writer, comparisons []Comparison) bool {
+	regressed := false
+	fmt.Fprintf(w, "%-24s %14s %14s %10s  %s\n", "metric", "base", "new", "change", "status")
+	for _, c := range comparisons {
+		if c.Missing {
+			fmt.Fprintf(w, "%-24s %14s %14s %10s  %s\n", c.Metric, "-", "-", "-", "MISSING")
+			regressed = true
+			continue
+		}
+		status := "ok"
+		if c.Regressed {
+			status = "REGRESSION"
+			regressed = true
+		}
+		fmt.Fprintf(w, "%-24s %14.3f %14.3f %9.1f%%  %s\n", c.Metric, c.Base, c.New, c.Change, status)
+	}
+	return regressed
+}
+
+// CompareReports loads two reports of the same test and compares them with
+// the thresholds configured in misc.json.
+func CompareReports(configPath, basePath, newPath string) ([]Comparison, error) {
+	config, err := ParseConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	base, err := LoadReport(basePath)
+	if err != nil {
+		return nil, err
+	}
+	current, err := LoadReport(newPath)
+	if err != nil {
+		return nil, err
+	}
+	if base.Name != current.Name {
+		return nil, errors.Errorf("cannot compare a report of %s with a report of %s", current.Name, base.Name)
+	}
+	thresholds, err := config.Compare.thresholdsOf(base.Name)
+	if err != nil {
+		return nil, err
+	}
+	return Compare(base, current, thresholds), nil
+}
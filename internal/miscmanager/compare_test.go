@@ -0,0 +1,122 @@
+package miscmanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func latencyReport(name string, p99, throughput float64, failed int64) *Report {
+	return &Report{Result: Result{Name: name, Details: LatencyReport{Failed: failed, Throughput: throughput,
+		Latency: LatencySummary{P50: p99 / 2, P99: p99}}}}
+}
+
+func TestCompare(t *testing.T) {
+	base := latencyReport(perfTestName, 10, 1000, 0)
+	thresholds := []Threshold{
+		{Metric: "latency.p99_ms", MaxIncrease: float64Ptr(10)},
+		{Metric: "throughput", MaxDecrease: float64Ptr(5)},
+		{Metric: "failed", MaxIncrease: float64Ptr(0)},
+		{Metric: "latency.p999_ms_typo"},
+	}
+	cases := []struct {
+		name      string
+		current   *Report
+		regressed []string
+	}{
+		{"same", latencyReport(perfTestName, 10, 1000, 0), nil},
+		{"within thresholds", latencyReport(perfTestName, 10.9, 960, 0), nil},
+		{"slower", latencyReport(perfTestName, 11.5, 1000, 0), []string{"latency.p99_ms"}},
+		{"less throughput", latencyReport(perfTestName, 9, 900, 0), []string{"throughput"}},
+		{"failures from none", latencyReport(perfTestName, 10, 1000, 1), []string{"failed"}},
+	}
+	for _, c := range cases {
+		comparisons := Compare(base, c.current, thresholds)
+		var regressed []string
+		for _, comparison := range comparisons {
+			if comparison.Regressed {
+				regressed = append(regressed, comparison.Metric)
+			}
+		}
+		assert.Equal(t, c.regressed, regressed, c.name)
+		assert.True(t, comparisons[3].Missing, c.name)
+	}
+
+	comparisons := Compare(base, latencyReport(perfTestName, 10, 1000, 1), thresholds)
+	assert.True(t, math.IsInf(comparisons[2].Change, 1))
+	assert.InDelta(t, 0, comparisons[0].Change, 1e-9)
+}
+
+func TestPrintComparisons(t *testing.T) {
+	var out bytes.Buffer
+	ok := []Comparison{{Metric: "throughput", Base: 100, New: 101, Change: 1}}
+	assert.False(t, PrintComparisons(&out, ok))
+	assert.Contains(t, out.String(), "ok")
+
+	out.Reset()
+	assert.True(t, PrintComparisons(&out, append(ok, Comparison{Metric: "latency.p50_ms", Missing: true})),
+		"missing metrics fail the comparison")
+	assert.Contains(t, out.String(), "MISSING")
+
+	out.Reset()
+	assert.True(t, PrintComparisons(&out, append(ok, Comparison{Metric: "failed", Regressed: true})))
+	assert.Contains(t, out.String(), "REGRESSION")
+}
+
+func TestThresholdsOf(t *testing.T) {
+	custom := []Threshold{{Metric: "peak_heap_sys", MaxIncrease: float64Ptr(10)}}
+	global := []Threshold{{Metric: "throughput", MaxDecrease: float64Ptr(1)}}
+
+	thresholds, err := CompareConfig{}.thresholdsOf(perfTestName)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultThresholds, thresholds)
+	_, err = CompareConfig{}.thresholdsOf("memory_test")
+	assert.Error(t, err, "no defaults for tests without a latency report")
+
+	config := CompareConfig{Thresholds: global, Tests: map[string][]Threshold{"memory_test": custom}}
+	thresholds, _ = config.thresholdsOf("memory_test")
+	assert.Equal(t, custom, thresholds)
+	thresholds, _ = config.thresholdsOf(perfTestName)
+	assert.Equal(t, global, thresholds)
+}
+
+func TestCompareReports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, v interface{}) string {
+		path := filepath.Join(dir, name)
+		content, _ := json.Marshal(v)
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	config := write("misc.json", map[string]interface{}{})
+	base := write("base.json", latencyReport(perfTestName, 10, 1000, 0))
+	slower := write("slower.json", latencyReport(perfTestName, 20, 1000, 0))
+	other := write("other.json", &Report{Result: Result{Name: "memory_test", Details: MemoryReport{PeakHeapSys: 1}}})
+
+	comparisons, err := CompareReports(config, base, slower)
+	if assert.NoError(t, err) {
+		var out bytes.Buffer
+		assert.True(t, PrintComparisons(&out, comparisons))
+		assert.Contains(t, out.String(), "latency.p50_ms")
+	}
+
+	_, err = CompareReports(config, base, other)
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "cannot compare"))
+	}
+	_, err = CompareReports(config, other, other)
+	assert.Error(t, err, "memory_test has no thresholds")
+}
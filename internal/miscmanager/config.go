@@ -1,37 +1,61 @@
 package miscmanager
 
+import (
+	"encoding/json"
+)
+
 // ModuleName for log
 const (
 	ModuleName string = "Misc"
 )
 
-// PerfTestConfig performance test config
-type PerfTestConfig struct {
-	Enabled   bool `json:"enabled"`
-	MaxWorker int  `json:"maxworker"`
-	Number    int  `json:"number"`
+// Config config for Generator. Every other top level key of misc.json is
+// the section of the test with that name, see Register. A section is run by
+// default if it has "enabled": true.
+type Config struct {
+	ServerAddr string `json:"server_addr"`
+
+	Report   ReportConfig   `json:"report"`
+	Compare  CompareConfig  `json:"compare"`
+	Progress ProgressConfig `json:"progress"`
+
+	Distributed DistributedConfig `json:"distributed"`
+
+	Tests map[string]json.RawMessage `json:"-"`
 }
 
-// ViperTestConfig viper test config
-type ViperTestConfig struct {
-	Enabled bool   `json:"enabled"`
-	Key     string `json:"key"`
+// configKeys are the top level keys of misc.json that aren't tests.
+var configKeys = []string{"server_addr", "report", "compare", "progress", "distributed"}
+
+// ReportConfig describes the report files written after each test.
+type ReportConfig struct {
+	Dir     string   `json:"dir"`     // Reports are not written if empty.
+	Formats []string `json:"formats"` // json, csv and html, defaults to all.
 }
 
-// CpuBusyTestConfig CPU Busy test config
-type CpuBusyTestConfig struct {
-	Enabled   bool `json:"enabled"`
-	MaxWorker int  `json:"maxworker"`
-	Number    int  `json:"number"`
+// CompareConfig contains the thresholds used by misc compare. Tests has the
+// thresholds of specific tests, the others use Thresholds, or defaults if
+// the test is a load test and none are configured.
+type CompareConfig struct {
+	Thresholds []Threshold            `json:"thresholds"`
+	Tests      map[string][]Threshold `json:"tests"`
 }
 
-// Config config for Generator
-type Config struct {
-	ServerAddr string `json:"server_addr"`
+// DistributedConfig describes the agents a distributed perf test is split
+// across by misc coordinate.
+type DistributedConfig struct {
+	Agents     []string `json:"agents"`      // Addresses of misc agent, host:port.
+	StartDelay int      `json:"start_delay"` // Milliseconds between handing out the work and starting it.
+	Token      string   `json:"token"`       // Shared secret of agents and coordinators, agents don't start without.
+}
 
-	PerfTest    *PerfTestConfig    `json:"perf_test,omitempty"`
-	ViperTest   *ViperTestConfig   `json:"viper_test,omitempty"`
-	CpuBusyTest *CpuBusyTestConfig `json:"cpu_busy_test,omitempty"`
+// Threshold bounds the change of a metric, in percent of its baseline
+// value. Metrics are the dotted paths of the numbers in the details of a
+// report, e.g. latency.p99_ms.
+type Threshold struct {
+	Metric      string   `json:"metric"`
+	MaxIncrease *float64 `json:"max_increase,omitempty"`
+	MaxDecrease *float64 `json:"max_decrease,omitempty"`
 }
 
 // API response error code
@@ -60,6 +84,19 @@ const (
 	ErrMsgFailedToParseRspBody = "ErrMsgFailedToParseRspBody"
 )
 
+// errMsgs maps error codes to their message.
+var errMsgs = map[int]string{
+	ErrCodeOk:                   ErrMsgOk,
+	ErrCodeFailedToReadBody:     ErrMsgFailedToReadBody,
+	ErrCodeFailedToParseBody:    ErrMsgFailedToParseBody,
+	ErrCodeTimeout:              ErrMsgTimeout,
+	ErrCodeGeneral:              ErrMsgGeneral,
+	ErrCodeBadFormat:            ErrMsgBadFormat,
+	ErrCodeUnexpected:           ErrMsgUnexpected,
+	ErrCodeHTTPErr:              ErrMsgHTTPErr,
+	ErrCodeFailedToParseRspBody: ErrMsgFailedToParseRspBody,
+}
+
 // API response key
 const (
 	KeyErrCode = "err_code"
@@ -74,4 +111,5 @@ const (
 // Request Type
 const (
 	RequestSampleWorkerReq = "RequestSampleWorkerReq"
+	RequestHTTPWorkerReq   = "RequestHTTPWorkerReq"
 )
@@ -1,54 +1,218 @@
 package miscmanager
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/colinzuo/tunip/pkg/logp"
 )
 
-// CpuBusyContext def
-type CpuBusyContext struct {
-	config   *CpuBusyTestConfig
-	counter  int
-	doneChan chan bool
+// CpuBusyTestConfig CPU Busy test config
+type CpuBusyTestConfig struct {
+	MaxWorker   int `json:"maxworker"`   // Busy goroutines, one per core if 0.
+	Utilization int `json:"utilization"` // Target percentage of each core, 1 to 100.
+	Duration    int `json:"duration"`    // In milliseconds.
+	Period      int `json:"period"`      // Duty cycle, busy then idle, in milliseconds.
+	GOMAXPROCS  int `json:"gomaxprocs"`  // Set during the test if not 0.
+}
+
+// CpuBusyReport is the outcome of a CPU busy test. Utilizations are
+// percentages, Achieved and Cores are measured from /proc/stat over the
+// whole machine and are missing where it can't be read.
+type CpuBusyReport struct {
+	Workers     int       `json:"workers"`
+	GOMAXPROCS  int       `json:"gomaxprocs"`
+	Elapsed     float64   `json:"elapsed_s"`
+	Target      float64   `json:"target_utilization"`   // Of each busy core.
+	Expected    float64   `json:"expected_utilization"` // Of the machine.
+	Achieved    *float64  `json:"achieved_utilization,omitempty"`
+	Cores       []float64 `json:"core_utilization,omitempty"`
+	Cycles      int64     `json:"cycles"`
+	Overrun     int64     `json:"overrun"`     // Cycles that ended late.
+	Computation uint64    `json:"computation"` // Result of the busy work, keeps it from being optimized away.
+}
+
+// busyCheckStep is the number of iterations between checks of the clock.
+const busyCheckStep = 1 << 10
+
+type cpuBusyTest struct {
+	config CpuBusyTestConfig
 }
 
-func (m *Manager) cpuBusyTest() {
-	logger := m.logger
-	config := m.config.CpuBusyTest
+func init() {
+	Register(func() Test {
+		return &cpuBusyTest{config: CpuBusyTestConfig{Utilization: 100, Duration: 10000, Period: 100}}
+	})
+}
 
-	logger.Info("Enter cpuBusyTest")
-	defer logger.Info("Leave cpuBusyTest")
+func (t *cpuBusyTest) Name() string {
+	return "cpu_busy_test"
+}
 
-	cpuBusyCtx := &CpuBusyContext{
-		config: config,
+func (t *cpuBusyTest) DefaultConfig() interface{} {
+	return &t.config
+}
+
+func (t *cpuBusyTest) Validate() error {
+	if t.config.MaxWorker < 0 || t.config.GOMAXPROCS < 0 {
+		return errors.New("maxworker and gomaxprocs must not be negative")
+	}
+	if t.config.Utilization <= 0 || t.config.Utilization > 100 {
+		return errors.New("utilization must be between 1 and 100")
+	}
+	if t.config.Duration <= 0 || t.config.Period <= 0 {
+		return errors.New("duration and period must be positive")
 	}
+	return nil
+}
 
-	cpuBusyCtx.doneChan = make(chan bool)
+// busyWorker is the state of one busy goroutine, only touched by it until
+// it is done.
+type busyWorker struct {
+	cycles  int64
+	overrun int64
+	sink    uint64
+}
 
-	for i := 0; i < config.MaxWorker; i++ {
-		workerID := fmt.Sprintf("worker_%d", i)
-		go m.busyWork(workerID, cpuBusyCtx)
+func (t *cpuBusyTest) Run(ctx context.Context, env *Env) Result {
+	logger := env.Logger
+	config := t.config
+
+	if config.GOMAXPROCS > 0 {
+		previous := runtime.GOMAXPROCS(config.GOMAXPROCS)
+		defer runtime.GOMAXPROCS(previous)
+	}
+	procs := runtime.GOMAXPROCS(0)
+	workers := config.MaxWorker
+	if workers == 0 {
+		workers = procs
 	}
+	duration := time.Duration(config.Duration) * time.Millisecond
+	period := time.Duration(config.Period) * time.Millisecond
+	busy := period * time.Duration(config.Utilization) / 100
 
-	for i := 0; i < config.MaxWorker; i++ {
-		<-m.doneChan
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	before, statErr := readCPUStats()
+	if statErr != nil {
+		logger.Warnf("Achieved utilization unavailable: %s", statErr)
 	}
 
-	close(cpuBusyCtx.doneChan)
+	start := time.Now()
+	env.Progress.SetDeadline(start.Add(duration))
+	state := make([]busyWorker, workers)
+	var wg sync.WaitGroup
+	for i := range state {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			t.busyWork(ctx, logger.Named(fmt.Sprintf("worker_%d", i)), env.Progress, &state[i], period, busy)
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	report := CpuBusyReport{Workers: workers, GOMAXPROCS: procs, Elapsed: elapsed.Seconds(),
+		Target: float64(config.Utilization)}
+	// Busy goroutines beyond GOMAXPROCS or the cores only share them.
+	report.Expected = report.Target * float64(minInt(workers, procs, runtime.NumCPU())) / float64(runtime.NumCPU())
+	for _, s := range state {
+		report.Cycles += s.cycles
+		report.Overrun += s.overrun
+		report.Computation += s.sink
+	}
+	if statErr == nil {
+		if after, err := readCPUStats(); err != nil {
+			logger.Warnf("Achieved utilization unavailable: %s", err)
+		} else {
+			achieved := after.all.utilization(before.all)
+			report.Achieved = &achieved
+			for i := 0; i < len(after.cores) && i < len(before.cores); i++ {
+				report.Cores = append(report.Cores, after.cores[i].utilization(before.cores[i]))
+			}
+		}
+	}
+	report.Print(os.Stdout)
+
+	result := Result{Details: report}
+	if ctx.Err() == context.Canceled {
+		result.Error = fmt.Sprintf("interrupted after %s", elapsed.Round(time.Millisecond))
+	}
+	return result
 }
 
-func (m Manager) busyWork(workID string, cpuBusyCtx *CpuBusyContext) {
-	config := cpuBusyCtx.config
-	logger := m.logger.Named(workID)
-	logger.Info("Enter " + workID)
-	defer logger.Info("Leave " + workID)
+// busyWork keeps the CPU busy for the busy part of each period and sleeps
+// for the rest, until ctx is done.
+func (t *cpuBusyTest) busyWork(ctx context.Context, logger *logp.Logger, progress *Progress,
+	state *busyWorker, period, busy time.Duration) {
+	logger.Info("Enter")
+	defer logger.Info("Leave")
 
-	for i := 0; i < config.Number; i++ {
-		if cpuBusyCtx.counter < 10000 {
-			cpuBusyCtx.counter += 1
-		} else {
-			cpuBusyCtx.counter -= 1
+	// Stay on one thread so the load isn't spread over more cores than
+	// GOMAXPROCS allows.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	x := uint64(88172645463325252)
+	for cycle := time.Now(); ctx.Err() == nil; {
+		busyUntil := cycle.Add(busy)
+		for now := time.Now(); now.Before(busyUntil); now = time.Now() {
+			for i := 0; i < busyCheckStep; i++ {
+				// xorshift, cheap and its result is kept.
+				x ^= x << 13
+				x ^= x >> 7
+				x ^= x << 17
+			}
 		}
+		next := cycle.Add(period)
+		if busy < period {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Until(next)):
+			}
+		}
+		// Start over from now rather than catch up if descheduled.
+		if now := time.Now(); now.Sub(next) > period/10 {
+			state.overrun++
+			next = now
+		}
+		cycle = next
+		state.cycles++
+		progress.Add(1)
 	}
+	state.sink = x
+}
 
-	cpuBusyCtx.doneChan <- true
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// Print writes the report as a table.
+func (r CpuBusyReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "workers     %d (gomaxprocs %d)\n", r.Workers, r.GOMAXPROCS)
+	fmt.Fprintf(w, "elapsed     %.3fs\n", r.Elapsed)
+	fmt.Fprintf(w, "cycles      %d (%d overrun)\n", r.Cycles, r.Overrun)
+	fmt.Fprintf(w, "target      %.1f%% per busy core, %.1f%% of the machine\n", r.Target, r.Expected)
+	if r.Achieved == nil {
+		fmt.Fprintln(w, "achieved    unavailable")
+		return
+	}
+	fmt.Fprintf(w, "achieved    %.1f%% of the machine\n", *r.Achieved)
+	for i, u := range r.Cores {
+		fmt.Fprintf(w, "  cpu%-3d %5.1f%%\n", i, u)
+	}
 }
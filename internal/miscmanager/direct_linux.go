@@ -0,0 +1,6 @@
+package miscmanager
+
+import "syscall"
+
+// oDirect opens files for direct I/O, bypassing the page cache.
+const oDirect = syscall.O_DIRECT
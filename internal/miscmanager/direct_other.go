@@ -0,0 +1,7 @@
+//go:build !linux
+// +build !linux
+
+package miscmanager
+
+// oDirect is not supported, direct I/O is only available on linux.
+const oDirect = 0
@@ -0,0 +1,467 @@
+package miscmanager
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+
+	"github.com/colinzuo/tunip/pkg/histogram"
+	"github.com/colinzuo/tunip/pkg/logp"
+	"github.com/colinzuo/tunip/pkg/logp/logfiles"
+)
+
+// Disk benchmark modes.
+const (
+	DiskSeqWrite  = "seq_write"
+	DiskSeqRead   = "seq_read"
+	DiskRandWrite = "rand_write"
+	DiskRandRead  = "rand_read"
+	DiskFsync     = "fsync"  // Latency of fsync after writing a block.
+	DiskReplay    = "replay" // Log lines written through the logp file output.
+)
+
+// diskModes are the modes in the order they are reported.
+var diskModes = []string{DiskSeqWrite, DiskSeqRead, DiskRandWrite, DiskRandRead, DiskFsync, DiskReplay}
+
+const (
+	diskFileName   = "tunip-disk-%d.dat"
+	diskReplayName = "tunip-disk-replay.log"
+
+	// directAlign is the alignment of buffers and blocks for direct I/O.
+	directAlign = 4096
+)
+
+// DiskTestConfig disk I/O benchmark config
+type DiskTestConfig struct {
+	Dir         string           `json:"dir"` // Defaults to the path of the logp files.
+	Modes       []string         `json:"modes"`
+	BlockSize   int              `json:"block_size"`
+	FileSize    int64            `json:"file_size"`   // Of the file of each worker.
+	Concurrency int              `json:"concurrency"` // Workers, each with its own file.
+	Direct      bool             `json:"direct"`      // Bypass the page cache, linux only.
+	Fsyncs      int              `json:"fsyncs"`      // Per worker in fsync mode.
+	Replay      DiskReplayConfig `json:"replay"`
+	Keep        bool             `json:"keep"` // Keep the files written.
+}
+
+// DiskReplayConfig configures the replay mode, which logs the lines of an
+// existing log through a logp file output set up like the configured one.
+type DiskReplayConfig struct {
+	Duration int    `json:"duration"` // In milliseconds.
+	Rate     int    `json:"rate"`     // Lines per second over all workers, unlimited if 0.
+	Source   string `json:"source"`   // Log file replayed, defaults to the logp file.
+	Lines    int    `json:"lines"`    // Lines of the source kept, the most recent.
+}
+
+// DiskResult is the outcome of one mode.
+type DiskResult struct {
+	Ops        int64          `json:"ops"`
+	Bytes      int64          `json:"bytes"`
+	Elapsed    float64        `json:"elapsed_s"`
+	Throughput float64        `json:"throughput_mib_s"`
+	IOPS       float64        `json:"iops"`
+	Latency    LatencySummary `json:"latency"` // Of each operation.
+}
+
+// DiskReport is the outcome of a disk I/O benchmark. Replay bytes are those
+// on disk afterwards, compressed if the logp files are.
+type DiskReport struct {
+	Dir         string                `json:"dir"`
+	BlockSize   int                   `json:"block_size"`
+	FileSize    int64                 `json:"file_size"`
+	Concurrency int                   `json:"concurrency"`
+	Direct      bool                  `json:"direct"`
+	Modes       map[string]DiskResult `json:"modes"`
+}
+
+type diskTest struct {
+	config   DiskTestConfig
+	dir      string
+	prepared bool // The files of the workers are written.
+}
+
+func init() {
+	Register(func() Test {
+		return &diskTest{config: DiskTestConfig{
+			Modes:     []string{DiskSeqWrite, DiskSeqRead, DiskRandWrite, DiskRandRead, DiskFsync},
+			BlockSize: 4096, FileSize: 64 << 20, Concurrency: 1, Fsyncs: 1000,
+			Replay: DiskReplayConfig{Duration: 10000, Lines: 100000},
+		}}
+	})
+}
+
+func (t *diskTest) Name() string {
+	return "disk_test"
+}
+
+func (t *diskTest) DefaultConfig() interface{} {
+	return &t.config
+}
+
+func (t *diskTest) Validate() error {
+	config := t.config
+	if len(config.Modes) == 0 {
+		return errors.New("modes is required")
+	}
+	for _, mode := range config.Modes {
+		known := false
+		for _, m := range diskModes {
+			known = known || m == mode
+		}
+		if !known {
+			return errors.Errorf("unsupported mode '%s'", mode)
+		}
+	}
+	if config.BlockSize <= 0 || config.Concurrency <= 0 || config.Fsyncs <= 0 {
+		return errors.New("block_size, concurrency and fsyncs must be positive")
+	}
+	if config.FileSize < int64(config.BlockSize) {
+		return errors.New("file_size must be at least block_size")
+	}
+	if config.Direct && oDirect == 0 {
+		return errors.New("direct I/O is only supported on linux")
+	}
+	if config.Direct && config.BlockSize%directAlign != 0 {
+		return errors.Errorf("block_size must be a multiple of %d for direct I/O", directAlign)
+	}
+	if config.Replay.Duration <= 0 || config.Replay.Rate < 0 || config.Replay.Lines <= 0 {
+		return errors.New("replay duration and lines must be positive and rate not negative")
+	}
+	return nil
+}
+
+func (t *diskTest) Run(ctx context.Context, env *Env) Result {
+	logger := env.Logger
+	config := t.config
+
+	t.dir = config.Dir
+	if t.dir == "" {
+		t.dir = logp.GetFileConfig().Path
+	}
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return Result{Error: errors.Wrap(err, "create dir").Error()}
+	}
+	if !config.Keep {
+		defer t.cleanup(logger)
+	}
+
+	report := DiskReport{Dir: t.dir, BlockSize: config.BlockSize, FileSize: config.FileSize,
+		Concurrency: config.Concurrency, Direct: config.Direct, Modes: map[string]DiskResult{}}
+	var err error
+	for _, mode := range config.Modes {
+		if ctx.Err() != nil {
+			break
+		}
+		logger.Infof("Running %s in %s", mode, t.dir)
+		var result DiskResult
+		if mode == DiskReplay {
+			result, err = t.replay(ctx, logger, env.Progress)
+		} else {
+			result, err = t.runMode(ctx, mode, env.Progress)
+		}
+		if err != nil {
+			break
+		}
+		report.Modes[mode] = result
+	}
+	report.Print(os.Stdout)
+
+	res := Result{Details: report}
+	if err != nil {
+		res.Error = err.Error()
+	} else if ctx.Err() != nil {
+		res.Error = fmt.Sprintf("interrupted after %d modes", len(report.Modes))
+	}
+	return res
+}
+
+func (t *diskTest) filePath(worker int) string {
+	return filepath.Join(t.dir, fmt.Sprintf(diskFileName, worker))
+}
+
+func (t *diskTest) cleanup(logger *logp.Logger) {
+	paths := []string{}
+	for i := 0; i < t.config.Concurrency; i++ {
+		paths = append(paths, t.filePath(i))
+	}
+	if files, err := logfiles.List(t.dir, diskReplayName); err == nil {
+		for _, f := range files {
+			paths = append(paths, f.Path)
+		}
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Warnf("Failed to remove %s: %s", path, err)
+		}
+	}
+}
+
+// runMode runs a block based mode with a worker per file. The files are
+// written first if the mode needs them and they aren't yet.
+func (t *diskTest) runMode(ctx context.Context, mode string, progress *Progress) (DiskResult, error) {
+	config := t.config
+	if mode != DiskSeqWrite && !t.prepared {
+		if _, err := t.runMode(ctx, DiskSeqWrite, nil); err != nil {
+			return DiskResult{}, err
+		}
+	}
+
+	latencies := make([]*histogram.Histogram, config.Concurrency)
+	bytes := make([]int64, config.Concurrency)
+	errs := make([]error, config.Concurrency)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range latencies {
+		latencies[i] = histogram.New()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bytes[i], errs[i] = t.work(ctx, mode, t.filePath(i), latencies[i], progress)
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	latency := histogram.New()
+	var result DiskResult
+	for i := range latencies {
+		if errs[i] != nil {
+			return DiskResult{}, errs[i]
+		}
+		latency.Merge(latencies[i])
+		result.Bytes += bytes[i]
+	}
+	if mode == DiskSeqWrite && ctx.Err() == nil {
+		t.prepared = true
+	}
+	result.Ops = latency.Count()
+	result.Latency = summarize(latency)
+	result.rates(elapsed)
+	return result, nil
+}
+
+// work performs the operations of a mode on one file and returns the bytes
+// transferred. Writes are flushed to disk before returning.
+func (t *diskTest) work(ctx context.Context, mode, path string, latency *histogram.Histogram,
+	progress *Progress) (int64, error) {
+	config := t.config
+	flags := os.O_RDONLY
+	switch mode {
+	case DiskSeqWrite:
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	case DiskRandWrite, DiskFsync:
+		flags = os.O_WRONLY
+	}
+	if config.Direct {
+		flags |= oDirect
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s open", mode)
+	}
+	defer f.Close()
+
+	block := alignedBlock(config.BlockSize)
+	rand.Read(block)
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	blockSize := int64(config.BlockSize)
+	blocks := config.FileSize / blockSize
+	ops := blocks
+	if mode == DiskFsync {
+		ops = int64(config.Fsyncs)
+	}
+
+	var bytes int64
+	for i := int64(0); i < ops && ctx.Err() == nil; i++ {
+		offset := i % blocks * blockSize
+		if mode == DiskRandWrite || mode == DiskRandRead {
+			offset = rng.Int63n(blocks) * blockSize
+		}
+		opStart := time.Now()
+		switch mode {
+		case DiskSeqWrite, DiskRandWrite:
+			_, err = f.WriteAt(block, offset)
+		case DiskSeqRead, DiskRandRead:
+			_, err = f.ReadAt(block, offset)
+		case DiskFsync:
+			if _, err = f.WriteAt(block, offset); err == nil {
+				opStart = time.Now()
+				err = f.Sync()
+			}
+		}
+		if err != nil {
+			return bytes, errors.Wrapf(err, "%s %s", mode, path)
+		}
+		latency.Record(time.Since(opStart).Microseconds())
+		bytes += blockSize
+		progress.Add(1)
+	}
+	if mode == DiskSeqWrite || mode == DiskRandWrite {
+		if err := f.Sync(); err != nil {
+			return bytes, errors.Wrapf(err, "%s sync %s", mode, path)
+		}
+	}
+	return bytes, nil
+}
+
+// alignedBlock returns a block whose memory is aligned as direct I/O
+// requires.
+func alignedBlock(size int) []byte {
+	buf := make([]byte, size+directAlign)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % directAlign); rem != 0 {
+		offset = directAlign - rem
+	}
+	return buf[offset : offset+size]
+}
+
+// replay logs the lines of the source log through a logp file output in the
+// directory, with the rotation settings of the configured logp files.
+func (t *diskTest) replay(ctx context.Context, logger *logp.Logger, progress *Progress) (DiskResult, error) {
+	config := t.config.Replay
+	lines := t.replayLines(logger)
+
+	cfg := logp.DefaultConfig()
+	cfg.Files = logp.GetFileConfig()
+	cfg.Files.Path, cfg.Files.Name = t.dir, diskReplayName
+	// Keep every backup so that all the bytes written are counted.
+	cfg.Files.MaxBackups, cfg.Files.MaxAge = 0, 0
+	replayLogger, closer := logp.NewFileLogger(cfg)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.Duration)*time.Millisecond)
+	defer cancel()
+	latencies := make([]*histogram.Histogram, t.config.Concurrency)
+	var sent int64
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range latencies {
+		latencies[i] = histogram.New()
+		wg.Add(1)
+		go func(latency *histogram.Histogram) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				n := atomic.AddInt64(&sent, 1) - 1
+				if config.Rate > 0 {
+					intended := start.Add(time.Duration(n) * time.Second / time.Duration(config.Rate))
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(time.Until(intended)):
+					}
+				}
+				opStart := time.Now()
+				replayLogger.Info(lines[n%int64(len(lines))])
+				latency.Record(time.Since(opStart).Microseconds())
+				progress.Add(1)
+			}
+		}(latencies[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if err := closer.Close(); err != nil {
+		return DiskResult{}, errors.Wrap(err, "replay close")
+	}
+
+	latency := histogram.New()
+	for _, l := range latencies {
+		latency.Merge(l)
+	}
+	result := DiskResult{Ops: latency.Count(), Latency: summarize(latency)}
+	files, err := logfiles.List(t.dir, diskReplayName)
+	if err != nil {
+		return DiskResult{}, err
+	}
+	for _, f := range files {
+		if info, err := os.Stat(f.Path); err == nil {
+			result.Bytes += info.Size()
+		}
+	}
+	result.rates(elapsed)
+	return result, nil
+}
+
+// replayLines returns the most recent lines of the source log, or synthetic
+// lines of typical lengths if there are none.
+func (t *diskTest) replayLines(logger *logp.Logger) []string {
+	config := t.config.Replay
+	dir, name := filepath.Dir(config.Source), filepath.Base(config.Source)
+	if config.Source == "" {
+		files := logp.GetFileConfig()
+		dir, name = files.Path, files.Name
+	}
+	files, err := logfiles.List(dir, name)
+	if err != nil {
+		logger.Warnf("No log to replay: %s", err)
+	}
+
+	var lines []string
+	for i := len(files) - 1; i >= 0 && len(lines) < config.Lines; i-- {
+		r, err := logfiles.Open(files[i].Path)
+		if err != nil {
+			logger.Warnf("Skip %s: %s", files[i].Path, err)
+			continue
+		}
+		var fileLines []string
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for scanner.Scan() {
+			fileLines = append(fileLines, scanner.Text())
+		}
+		r.Close()
+		if keep := config.Lines - len(lines); len(fileLines) > keep {
+			fileLines = fileLines[len(fileLines)-keep:]
+		}
+		lines = append(fileLines, lines...)
+	}
+	if len(lines) > 0 {
+		logger.Infof("Replaying %d lines of %s", len(lines), filepath.Join(dir, name))
+		return lines
+	}
+
+	logger.Warnf("Nothing to replay in %s, replaying synthetic lines", filepath.Join(dir, name))
+	const letters = "abcdefghijklmnopqrstuvwxyz "
+	rng := rand.New(rand.NewSource(1))
+	lines = make([]string, 1000)
+	for i := range lines {
+		line := make([]byte, 60+rng.Intn(300))
+		for j := range line {
+			line[j] = letters[rng.Intn(len(letters))]
+		}
+		lines[i] = string(line)
+	}
+	return lines
+}
+
+func (r *DiskResult) rates(elapsed time.Duration) {
+	r.Elapsed = elapsed.Seconds()
+	if elapsed > 0 {
+		r.Throughput = float64(r.Bytes) / (1 << 20) / elapsed.Seconds()
+		r.IOPS = float64(r.Ops) / elapsed.Seconds()
+	}
+}
+
+// Print writes the report as a table.
+func (r DiskReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "dir         %s\n", r.Dir)
+	fmt.Fprintf(w, "files       %d x %d bytes, blocks of %d bytes, direct %t\n",
+		r.Concurrency, r.FileSize, r.BlockSize, r.Direct)
+	fmt.Fprintf(w, "%-10s %9s %9s %9s %9s %9s %9s\n", "mode", "ops", "MiB/s", "iops", "p50 ms", "p99 ms", "max ms")
+	for _, mode := range diskModes {
+		res, found := r.Modes[mode]
+		if !found {
+			continue
+		}
+		fmt.Fprintf(w, "%-10s %9d %9.1f %9.0f %9.3f %9.3f %9.3f\n", mode, res.Ops, res.Throughput, res.IOPS,
+			res.Latency.P50, res.Latency.P99, res.Latency.Max)
+	}
+}
@@ -0,0 +1,32 @@
+package miscmanager
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskRunMode(t *testing.T) {
+	test := &diskTest{dir: t.TempDir(), config: DiskTestConfig{BlockSize: 4096, FileSize: 64 << 10,
+		Concurrency: 2, Fsyncs: 3}}
+
+	// The files are written first for a mode that reads them.
+	result, err := test.runMode(context.Background(), DiskRandRead, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(32), result.Ops)
+	assert.Equal(t, int64(2*64<<10), result.Bytes)
+	for i := 0; i < 2; i++ {
+		info, err := os.Stat(test.filePath(i))
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(64<<10), info.Size())
+		}
+	}
+
+	result, err = test.runMode(context.Background(), DiskFsync, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), result.Ops)
+
+	assert.Len(t, alignedBlock(4096), 4096)
+}
@@ -0,0 +1,489 @@
+package miscmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/colinzuo/tunip/pkg/logp"
+	"github.com/colinzuo/tunip/pkg/tracing"
+)
+
+// Paths served by misc agent.
+const (
+	agentStatusPath = "/misc/agent"
+	agentPerfPath   = "/misc/agent/perf"
+	agentStopPath   = "/misc/agent/stop"
+)
+
+// agentStatusTimeout bounds the check of the agents before a run.
+const agentStatusTimeout = 5 * time.Second
+
+// agentResultSlack is added to the expected length of a run when waiting
+// for the result of an agent, and is how long a stopped agent is given to
+// return what it recorded.
+const agentResultSlack = 30 * time.Second
+
+// DistributedTokenEnv is the environment variable holding the token when
+// distributed.token of the misc config is empty, so the secret needn't be
+// written into the config.
+const DistributedTokenEnv = "TUNIP_MISC_TOKEN"
+
+// errNoToken is returned by agents and coordinators without a token.
+var errNoToken = errors.New("no token, configure distributed.token of the misc config or set " + DistributedTokenEnv)
+
+// token returns the configured token, falling back to DistributedTokenEnv.
+func (c DistributedConfig) token() string {
+	if c.Token != "" {
+		return c.Token
+	}
+	return os.Getenv(DistributedTokenEnv)
+}
+
+// agentJob is the share of a perf test handed to an agent. It starts
+// StartIn after the agent receives it, so that all agents start together
+// whatever their clocks.
+type agentJob struct {
+	Config     PerfTestConfig `json:"config"`
+	ServerAddr string         `json:"server_addr"`
+	StartIn    time.Duration  `json:"start_in"`
+}
+
+type agentStatus struct {
+	Busy bool `json:"busy"`
+}
+
+// agentResult is what an agent recorded, or why it couldn't run.
+type agentResult struct {
+	Error    string            `json:"error,omitempty"`
+	Snapshot *recorderSnapshot `json:"snapshot,omitempty"`
+}
+
+// agent runs the perf tests handed out by coordinators, one at a time.
+type agent struct {
+	logger   *logp.Logger
+	progress ProgressConfig
+	token    string // Required from coordinators as a bearer token.
+	busy     int32
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // Of the running test, if any.
+}
+
+// RunAgent serves perf tests to misc coordinate on addr until ctx is done.
+// Coordinators must present the distributed.token of the config, or
+// DistributedTokenEnv if it is empty.
+func RunAgent(ctx context.Context, configPath string, addr string) error {
+	config, err := ParseConfig(configPath)
+	if err != nil {
+		return err
+	}
+	token := config.Distributed.token()
+	if token == "" {
+		return errNoToken
+	}
+	a := &agent{logger: logp.NewLogger(ModuleName).Named("agent"), progress: config.Progress,
+		token: token}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "agent listen")
+	}
+	a.logger.Infof("Listening on %s", listener.Addr())
+
+	// Running tests are cancelled with ctx, so shutting down doesn't wait
+	// for them to complete.
+	server := &http.Server{Handler: a.handler(), BaseContext: func(net.Listener) context.Context { return ctx }}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return errors.Wrap(err, "agent serve")
+	}
+	return nil
+}
+
+func (a *agent) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(agentStatusPath, a.authorized(a.serveStatus))
+	mux.HandleFunc(agentPerfPath, a.authorized(a.servePerf))
+	mux.HandleFunc(agentStopPath, a.authorized(a.serveStop))
+	return mux
+}
+
+// authorized refuses requests without the token of the agent.
+func (a *agent) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if a.token == "" || token == header || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			a.logger.Warnf("Refused %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			writeJSON(w, http.StatusUnauthorized, agentResult{Error: "invalid token"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (a *agent) serveStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, agentStatus{Busy: atomic.LoadInt32(&a.busy) != 0})
+}
+
+func (a *agent) servePerf(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, agentResult{Error: "POST required"})
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&a.busy, 0, 1) {
+		writeJSON(w, http.StatusConflict, agentResult{Error: "agent busy"})
+		return
+	}
+	defer atomic.StoreInt32(&a.busy, 0)
+
+	var job agentJob
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		writeJSON(w, http.StatusBadRequest, agentResult{Error: errors.Wrap(err, "parse job").Error()})
+		return
+	}
+	test := &perfTest{config: job.Config, startAt: time.Now().Add(job.StartIn)}
+	if err := test.Validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, agentResult{Error: errors.Wrap(err, "invalid config").Error()})
+		return
+	}
+	logger := a.logger.Named(test.Name())
+	jsonConfig, _ := json.Marshal(job.Config)
+	logger.Infof("Run for %s with config: %s", r.RemoteAddr, jsonConfig)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	a.mu.Lock()
+	a.cancel = cancel
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.cancel = nil
+		a.mu.Unlock()
+	}()
+
+	progress := startProgress(a.progress, logger)
+	env := &Env{Logger: logger, ServerAddr: job.ServerAddr, TimeLongForm: timeLongForm, Progress: progress.Progress()}
+	recorder, elapsed, err := test.run(ctx, env)
+	progress.Stop()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, agentResult{Error: err.Error()})
+		return
+	}
+
+	report := recorder.report(elapsed)
+	logReport(logger, report)
+	report.Print(os.Stdout)
+	snapshot := recorder.snapshot(elapsed)
+	result := agentResult{Snapshot: &snapshot}
+	if ctx.Err() != nil {
+		result.Error = fmt.Sprintf("interrupted after %d responses", report.Count)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// serveStop cancels the running test, which still returns what it
+// recorded.
+func (a *agent) serveStop(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	if a.cancel != nil {
+		a.logger.Infof("Stopped by %s", r.RemoteAddr)
+		a.cancel()
+	}
+	a.mu.Unlock()
+	writeJSON(w, http.StatusOK, agentStatus{Busy: atomic.LoadInt32(&a.busy) != 0})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Coordinate splits the perf test of the config across agents, or the
+// agents of the config if none are given, and returns the merged result.
+func Coordinate(ctx context.Context, configPath string, agents []string) (Result, error) {
+	logger := logp.NewLogger(ModuleName)
+	config, err := ParseConfig(configPath)
+	if err != nil {
+		return Result{}, err
+	}
+	if len(agents) == 0 {
+		agents = config.Distributed.Agents
+	}
+	if len(agents) == 0 {
+		return Result{}, errors.New("no agents, configure distributed.agents or pass them")
+	}
+
+	manager := Manager{logger: logger, config: config, timeLongForm: timeLongForm}
+	test, err := manager.newTest(perfTestName)
+	if err != nil {
+		return Result{}, err
+	}
+	token := config.Distributed.token()
+	if token == "" {
+		return Result{}, errNoToken
+	}
+	coordinator := &coordinatorTest{perf: test.(*perfTest), agents: agents, token: token,
+		startDelay: time.Duration(config.Distributed.StartDelay) * time.Millisecond}
+	return manager.runTest(ctx, coordinator), nil
+}
+
+// coordinatorTest runs a perf test split across agents. It is named after
+// the perf test so that their reports compare.
+type coordinatorTest struct {
+	perf       *perfTest
+	agents     []string
+	token      string
+	startDelay time.Duration
+}
+
+func (c *coordinatorTest) Name() string {
+	return c.perf.Name()
+}
+
+func (c *coordinatorTest) DefaultConfig() interface{} {
+	return c.perf.DefaultConfig()
+}
+
+func (c *coordinatorTest) Validate() error {
+	return c.perf.Validate()
+}
+
+func (c *coordinatorTest) Run(ctx context.Context, env *Env) Result {
+	logger := env.Logger
+	configs, err := splitPerfConfig(c.perf.config, len(c.agents))
+	if err != nil {
+		return Result{Error: err.Error()}
+	}
+	client := tracing.NewHTTPClient(0)
+	for _, agent := range c.agents {
+		if err := c.checkAgent(ctx, client, agent); err != nil {
+			return Result{Error: err.Error()}
+		}
+	}
+
+	logger.Infof("Starting on %d agents in %s", len(c.agents), c.startDelay)
+	start := time.Now().Add(c.startDelay)
+	if c.perf.config.Duration > 0 {
+		env.Progress.SetDeadline(start.Add(c.perf.duration()))
+	}
+	// Jobs outlive ctx: when cancelled the agents are stopped rather than
+	// their requests dropped, so that what they recorded is still merged.
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+	if timeout := c.jobTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		jobCtx, cancel = context.WithTimeout(jobCtx, timeout)
+		defer cancel()
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			for _, agent := range c.agents {
+				if err := c.stopAgent(client, agent); err != nil {
+					logger.Warnf("Failed to stop agent %s: %s", agent, err)
+				}
+			}
+			select {
+			case <-time.After(agentResultSlack):
+				cancelJobs()
+			case <-done:
+			}
+		case <-done:
+		}
+	}()
+	results := make([]agentResult, len(c.agents))
+	errs := make([]error, len(c.agents))
+	var wg sync.WaitGroup
+	for i, agent := range c.agents {
+		wg.Add(1)
+		go func(i int, agent string) {
+			defer wg.Done()
+			job := agentJob{Config: configs[i], ServerAddr: env.ServerAddr, StartIn: c.startDelay}
+			results[i], errs[i] = c.postJob(jobCtx, client, agent, job)
+		}(i, agent)
+	}
+	wg.Wait()
+	close(done)
+
+	recorder := newLatencyRecorder(start)
+	var elapsed time.Duration
+	var problems []string
+	for i, agent := range c.agents {
+		if errs[i] != nil {
+			problems = append(problems, fmt.Sprintf("agent %s: %s", agent, errs[i]))
+			continue
+		}
+		if results[i].Error != "" {
+			problems = append(problems, fmt.Sprintf("agent %s: %s", agent, results[i].Error))
+		}
+		if s := results[i].Snapshot; s != nil {
+			logger.Infof("Agent %s: %d responses in %s", agent, s.Latency.Count()+s.Unanswered, s.Elapsed)
+			recorder.merge(*s)
+			if s.Elapsed > elapsed {
+				elapsed = s.Elapsed
+			}
+		}
+	}
+
+	report := recorder.report(elapsed)
+	logReport(logger, report)
+	report.Print(os.Stdout)
+	result := Result{Details: report}
+	if ctx.Err() != nil {
+		result.Error = fmt.Sprintf("interrupted after %d responses", report.Count)
+	} else if len(problems) > 0 {
+		result.Error = strings.Join(problems, "; ")
+	}
+	return result
+}
+
+// jobTimeout bounds the wait for the result of an agent, by the duration
+// of the test or else by its requests all timing out. It is 0 when the test
+// has no bound.
+func (c *coordinatorTest) jobTimeout() time.Duration {
+	config := c.perf.config
+	var run time.Duration
+	switch {
+	case config.Duration > 0:
+		run = c.perf.duration()
+	case config.Number > 0 && config.Timeout > 0:
+		rounds := (config.Number + config.MaxWorker - 1) / config.MaxWorker
+		run = time.Duration(rounds*config.Timeout) * time.Millisecond
+	default:
+		return 0
+	}
+	return c.startDelay + run + shutdownTimeout + agentResultSlack
+}
+
+// newRequest returns a request to an agent carrying the token.
+func (c *coordinatorTest) newRequest(ctx context.Context, method, agent, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, httpBaseURL(agent)+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// checkAgent fails unless the agent is up, accepts the token and is idle.
+func (c *coordinatorTest) checkAgent(ctx context.Context, client *http.Client, agent string) error {
+	ctx, cancel := context.WithTimeout(ctx, agentStatusTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, http.MethodGet, agent, agentStatusPath, nil)
+	if err != nil {
+		return errors.Wrapf(err, "agent %s", agent)
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "agent %s", agent)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusUnauthorized {
+		return errors.Errorf("agent %s refused the token", agent)
+	}
+	var status agentStatus
+	if err := json.NewDecoder(rsp.Body).Decode(&status); err != nil {
+		return errors.Wrapf(err, "agent %s status", agent)
+	}
+	if status.Busy {
+		return errors.Errorf("agent %s busy", agent)
+	}
+	return nil
+}
+
+// stopAgent stops the test running on an agent.
+func (c *coordinatorTest) stopAgent(client *http.Client, agent string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), agentStatusTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, http.MethodPost, agent, agentStopPath, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return errors.Errorf("status %d", rsp.StatusCode)
+	}
+	return nil
+}
+
+// postJob hands a job to an agent and waits for its result until ctx is
+// done.
+func (c *coordinatorTest) postJob(ctx context.Context, client *http.Client, agent string, job agentJob) (agentResult, error) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return agentResult{}, err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, agent, agentPerfPath, body)
+	if err != nil {
+		return agentResult{}, err
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return agentResult{}, err
+	}
+	defer rsp.Body.Close()
+	var result agentResult
+	if err := json.NewDecoder(rsp.Body).Decode(&result); err != nil {
+		return agentResult{}, errors.Wrapf(err, "status %d", rsp.StatusCode)
+	}
+	return result, nil
+}
+
+// splitPerfConfig splits the workers, requests and rates of a perf test
+// evenly across n agents.
+func splitPerfConfig(config PerfTestConfig, n int) ([]PerfTestConfig, error) {
+	if config.Number > 0 && config.Number < n {
+		return nil, errors.Errorf("number %d is less than the %d agents", config.Number, n)
+	}
+	share := func(total, i int) int {
+		s := total / n
+		if i < total%n {
+			s++
+		}
+		return s
+	}
+	configs := make([]PerfTestConfig, n)
+	for i := range configs {
+		c := config
+		c.MaxWorker = share(config.MaxWorker, i)
+		if c.MaxWorker == 0 {
+			c.MaxWorker = 1
+		}
+		c.Number = share(config.Number, i)
+		c.Profile.Rate /= float64(n)
+		c.Profile.From /= float64(n)
+		c.Profile.To /= float64(n)
+		c.Profile.Steps = make([]LoadStepConfig, len(config.Profile.Steps))
+		for j, step := range config.Profile.Steps {
+			c.Profile.Steps[j] = LoadStepConfig{Rate: step.Rate / float64(n), Duration: step.Duration}
+		}
+		configs[i] = c
+	}
+	return configs, nil
+}
@@ -0,0 +1,99 @@
+package miscmanager
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/colinzuo/tunip/pkg/logp"
+)
+
+func TestSplitPerfConfig(t *testing.T) {
+	config := PerfTestConfig{MaxWorker: 5, Number: 10, Profile: LoadProfileConfig{Type: ProfileSteps,
+		Steps: []LoadStepConfig{{Rate: 300, Duration: 1000}}}}
+	configs, err := splitPerfConfig(config, 3)
+	assert.NoError(t, err)
+	if assert.Len(t, configs, 3) {
+		assert.Equal(t, []int{2, 2, 1}, []int{configs[0].MaxWorker, configs[1].MaxWorker, configs[2].MaxWorker})
+		assert.Equal(t, []int{4, 3, 3}, []int{configs[0].Number, configs[1].Number, configs[2].Number})
+		assert.Equal(t, 100.0, configs[2].Profile.Steps[0].Rate)
+	}
+	assert.Equal(t, 300.0, config.Profile.Steps[0].Rate)
+
+	_, err = splitPerfConfig(config, 11)
+	assert.Error(t, err)
+}
+
+func TestCoordinate(t *testing.T) {
+	logger := logp.NewLogger("coordinate")
+	var agents []string
+	for i := 0; i < 2; i++ {
+		server := httptest.NewServer((&agent{logger: logger, token: "secret"}).handler())
+		defer server.Close()
+		agents = append(agents, strings.TrimPrefix(server.URL, "http://"))
+	}
+
+	perf := &perfTest{config: PerfTestConfig{MaxWorker: 2, Number: 101, Profile: LoadProfileConfig{Type: ProfileClosed},
+		Mode: PerfModeLocal}}
+	coordinator := &coordinatorTest{perf: perf, agents: agents, token: "secret", startDelay: 10 * time.Millisecond}
+	result := coordinator.Run(context.Background(), &Env{Logger: logger, TimeLongForm: timeLongForm})
+	assert.False(t, result.Failed(), result.Error)
+	report := result.Details.(LatencyReport)
+	assert.Equal(t, int64(101), report.Count)
+	assert.Equal(t, int64(101), report.Histogram.Count())
+
+	coordinator.token = "wrong"
+	result = coordinator.Run(context.Background(), &Env{Logger: logger, TimeLongForm: timeLongForm})
+	assert.Contains(t, result.Error, "refused the token")
+}
+
+func TestAgentToken(t *testing.T) {
+	handler := (&agent{logger: logp.NewLogger("agent"), token: "secret"}).handler()
+	for _, path := range []string{agentStatusPath, agentPerfPath, agentStopPath} {
+		for _, header := range []string{"", "secret", "Bearer wrong", "Bearer "} {
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}"))
+			if header != "" {
+				req.Header.Set("Authorization", header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code, "%s %q", path, header)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, agentStopPath, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Without a token an agent refuses everyone.
+	w = httptest.NewRecorder()
+	(&agent{logger: logp.NewLogger("agent")}).handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, agentStatusPath, nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestDistributedToken(t *testing.T) {
+	t.Setenv(DistributedTokenEnv, "from env")
+	assert.Equal(t, "from config", DistributedConfig{Token: "from config"}.token())
+	assert.Equal(t, "from env", DistributedConfig{}.token())
+
+	t.Setenv(DistributedTokenEnv, "")
+	assert.Equal(t, errNoToken, RunAgent(context.Background(), "../../configs/misc.json", "127.0.0.1:0"))
+}
+
+func TestCoordinatorJobTimeout(t *testing.T) {
+	c := &coordinatorTest{perf: &perfTest{config: PerfTestConfig{MaxWorker: 4, Duration: 60000}}, startDelay: time.Second}
+	assert.Equal(t, 61*time.Second+shutdownTimeout+agentResultSlack, c.jobTimeout())
+
+	c.perf.config = PerfTestConfig{MaxWorker: 4, Number: 10, Timeout: 1000}
+	assert.Equal(t, 4*time.Second+shutdownTimeout+agentResultSlack, c.jobTimeout())
+
+	c.perf.config = PerfTestConfig{MaxWorker: 4, Number: 10}
+	assert.Equal(t, time.Duration(0), c.jobTimeout())
+}
@@ -0,0 +1,331 @@
+package miscmanager
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/colinzuo/tunip/pkg/histogram"
+)
+
+// LatencySummary summarizes a latency histogram, in milliseconds.
+type LatencySummary struct {
+	Min  float64 `json:"min_ms"`
+	Mean float64 `json:"mean_ms"`
+	P50  float64 `json:"p50_ms"`
+	P90  float64 `json:"p90_ms"`
+	P99  float64 `json:"p99_ms"`
+	P999 float64 `json:"p999_ms"`
+	Max  float64 `json:"max_ms"`
+}
+
+// LatencyReport is the outcome of a load test. Latency is measured from the
+// creation of a request until its response is received; it is split into
+// the time spent queued before a worker picks the request up and the time
+// the worker spends processing it.
+type LatencyReport struct {
+	Count      int64          `json:"count"`
+	Failed     int64          `json:"failed"`
+	Elapsed    float64        `json:"elapsed_s"`
+	Throughput float64        `json:"throughput"` // Responses per second.
+	Latency    LatencySummary `json:"latency"`
+	Queueing   LatencySummary `json:"queueing"`
+	Processing LatencySummary `json:"processing"`
+	Errors     map[int]int64  `json:"errors,omitempty"` // Count of failures by ErrCode.
+
+	// Open-loop profiles only: how far behind schedule requests were sent,
+	// and how many were late by more than a millisecond.
+	GeneratorLag LatencySummary `json:"generator_lag"`
+	Late         int64          `json:"late"`
+
+	Classes map[string]ClassReport `json:"classes,omitempty"` // Only if requests have classes.
+
+	Timeline  []TimelinePoint      `json:"timeline,omitempty"`
+	Histogram *histogram.Histogram `json:"latency_histogram,omitempty"` // Microseconds.
+}
+
+// ClassReport is the outcome of the requests of one priority class.
+type ClassReport struct {
+	Count   int64          `json:"count"`
+	Failed  int64          `json:"failed"`
+	Latency LatencySummary `json:"latency"`
+}
+
+type classStats struct {
+	latency *histogram.Histogram
+	count   int64
+	failed  int64
+}
+
+// TimelinePoint summarizes the responses received during one second of a
+// run.
+type TimelinePoint struct {
+	Second int     `json:"second"` // Since the start of the run.
+	Count  int64   `json:"count"`
+	Errors int64   `json:"errors"`
+	P50    float64 `json:"p50_ms"`
+	P90    float64 `json:"p90_ms"`
+	P99    float64 `json:"p99_ms"`
+	Max    float64 `json:"max_ms"`
+}
+
+type timelineSlot struct {
+	latency *histogram.Histogram
+	errors  int64
+}
+
+// latencyRecorder records latencies in microseconds.
+type latencyRecorder struct {
+	latency    *histogram.Histogram
+	queueing   *histogram.Histogram
+	processing *histogram.Histogram
+	lag        *histogram.Histogram // How late requests were sent, open-loop profiles only.
+	errors     map[int]int64
+	unanswered int64 // Failed without a response.
+	classes    map[string]*classStats
+
+	start    time.Time
+	timeline []timelineSlot
+}
+
+func newLatencyRecorder(start time.Time) *latencyRecorder {
+	return &latencyRecorder{
+		start:      start,
+		latency:    histogram.New(),
+		queueing:   histogram.New(),
+		processing: histogram.New(),
+		lag:        histogram.New(),
+		errors:     map[int]int64{},
+		classes:    map[string]*classStats{},
+	}
+}
+
+func (r *latencyRecorder) class(name string) *classStats {
+	c, found := r.classes[name]
+	if !found {
+		c = &classStats{latency: histogram.New()}
+		r.classes[name] = c
+	}
+	return c
+}
+
+// record records a response to a request of the given class received at
+// the given time.
+func (r *latencyRecorder) record(at time.Time, class string, latency, queueing, processing time.Duration, errCode int) {
+	c := r.class(class)
+	c.count++
+	c.latency.Record(latency.Microseconds())
+	if errCode != ErrCodeOk {
+		c.failed++
+	}
+
+	second := int(at.Sub(r.start) / time.Second)
+	if second < 0 {
+		second = 0
+	}
+	for len(r.timeline) <= second {
+		r.timeline = append(r.timeline, timelineSlot{latency: histogram.New()})
+	}
+	slot := &r.timeline[second]
+	slot.latency.Record(latency.Microseconds())
+	if errCode != ErrCodeOk {
+		slot.errors++
+	}
+
+	r.latency.Record(latency.Microseconds())
+	r.queueing.Record(queueing.Microseconds())
+	r.processing.Record(processing.Microseconds())
+	if errCode != ErrCodeOk {
+		r.errors[errCode]++
+	}
+}
+
+// fail records a request that failed without a response.
+func (r *latencyRecorder) fail(class string, errCode int) {
+	c := r.class(class)
+	c.count++
+	c.failed++
+	r.errors[errCode]++
+	r.unanswered++
+}
+
+func (r *latencyRecorder) report(elapsed time.Duration) LatencyReport {
+	report := LatencyReport{
+		Count:      r.latency.Count() + r.unanswered,
+		Elapsed:    elapsed.Seconds(),
+		Latency:    summarize(r.latency),
+		Queueing:   summarize(r.queueing),
+		Processing: summarize(r.processing),
+		Histogram:  r.latency,
+	}
+	for second, slot := range r.timeline {
+		s := summarize(slot.latency)
+		report.Timeline = append(report.Timeline, TimelinePoint{Second: second, Count: slot.latency.Count(),
+			Errors: slot.errors, P50: s.P50, P90: s.P90, P99: s.P99, Max: s.Max})
+	}
+	// Break down by class unless no request has one.
+	if len(r.classes) > 1 || (len(r.classes) == 1 && r.classes[""] == nil) {
+		report.Classes = make(map[string]ClassReport, len(r.classes))
+		for name, c := range r.classes {
+			report.Classes[name] = ClassReport{Count: c.count, Failed: c.failed, Latency: summarize(c.latency)}
+		}
+	}
+	if r.lag.Count() > 0 {
+		report.GeneratorLag = summarize(r.lag)
+		for _, b := range r.lag.Buckets() {
+			if b.Value >= lateThreshold.Microseconds() {
+				report.Late += b.Count
+			}
+		}
+	}
+	if elapsed > 0 {
+		report.Throughput = float64(report.Count) / elapsed.Seconds()
+	}
+	if len(r.errors) > 0 {
+		report.Errors = make(map[int]int64, len(r.errors))
+		for code, n := range r.errors {
+			report.Errors[code] = n
+			report.Failed += n
+		}
+	}
+	return report
+}
+
+// recorderSnapshot is the state of a latencyRecorder, sent by agents to
+// the coordinator of a distributed run to be merged.
+type recorderSnapshot struct {
+	Latency    *histogram.Histogram     `json:"latency"`
+	Queueing   *histogram.Histogram     `json:"queueing"`
+	Processing *histogram.Histogram     `json:"processing"`
+	Lag        *histogram.Histogram     `json:"lag"`
+	Errors     map[int]int64            `json:"errors"`
+	Unanswered int64                    `json:"unanswered"`
+	Classes    map[string]classSnapshot `json:"classes"`
+	Timeline   []timelineSnapshot       `json:"timeline"`
+	Elapsed    time.Duration            `json:"elapsed"`
+}
+
+type classSnapshot struct {
+	Latency *histogram.Histogram `json:"latency"`
+	Count   int64                `json:"count"`
+	Failed  int64                `json:"failed"`
+}
+
+type timelineSnapshot struct {
+	Latency *histogram.Histogram `json:"latency"`
+	Errors  int64                `json:"errors"`
+}
+
+func (r *latencyRecorder) snapshot(elapsed time.Duration) recorderSnapshot {
+	s := recorderSnapshot{Latency: r.latency, Queueing: r.queueing, Processing: r.processing, Lag: r.lag,
+		Errors: r.errors, Unanswered: r.unanswered, Classes: map[string]classSnapshot{}, Elapsed: elapsed}
+	for name, c := range r.classes {
+		s.Classes[name] = classSnapshot{Latency: c.latency, Count: c.count, Failed: c.failed}
+	}
+	for _, slot := range r.timeline {
+		s.Timeline = append(s.Timeline, timelineSnapshot{Latency: slot.latency, Errors: slot.errors})
+	}
+	return s
+}
+
+// merge adds a snapshot to what was recorded. The timelines are aligned on
+// their starts.
+func (r *latencyRecorder) merge(s recorderSnapshot) {
+	for _, h := range []struct{ to, from *histogram.Histogram }{{r.latency, s.Latency},
+		{r.queueing, s.Queueing}, {r.processing, s.Processing}, {r.lag, s.Lag}} {
+		if h.from != nil {
+			h.to.Merge(h.from)
+		}
+	}
+	for code, n := range s.Errors {
+		r.errors[code] += n
+	}
+	r.unanswered += s.Unanswered
+	for name, cs := range s.Classes {
+		c := r.class(name)
+		c.count += cs.Count
+		c.failed += cs.Failed
+		if cs.Latency != nil {
+			c.latency.Merge(cs.Latency)
+		}
+	}
+	for second, ts := range s.Timeline {
+		for len(r.timeline) <= second {
+			r.timeline = append(r.timeline, timelineSlot{latency: histogram.New()})
+		}
+		if ts.Latency != nil {
+			r.timeline[second].latency.Merge(ts.Latency)
+		}
+		r.timeline[second].errors += ts.Errors
+	}
+}
+
+func summarize(h *histogram.Histogram) LatencySummary {
+	ms := func(us int64) float64 { return float64(us) / 1000 }
+	return LatencySummary{
+		Min:  ms(h.Min()),
+		Mean: h.Mean() / 1000,
+		P50:  ms(h.ValueAtPercentile(50)),
+		P90:  ms(h.ValueAtPercentile(90)),
+		P99:  ms(h.ValueAtPercentile(99)),
+		P999: ms(h.ValueAtPercentile(99.9)),
+		Max:  ms(h.Max()),
+	}
+}
+
+// Print writes the report as a table.
+func (r LatencyReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "requests    %d (%d failed)\n", r.Count, r.Failed)
+	fmt.Fprintf(w, "elapsed     %.3fs\n", r.Elapsed)
+	fmt.Fprintf(w, "throughput  %.1f req/s\n", r.Throughput)
+	printLatencies(w, []latencyRow{{"latency", r.Latency}, {"queueing", r.Queueing}, {"processing", r.Processing}})
+	if len(r.Classes) > 0 {
+		names := make([]string, 0, len(r.Classes))
+		for name := range r.Classes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "%-10s %9s %9s %9s %9s %9s\n", "class", "count", "failed", "p50", "p99", "max")
+		for _, name := range names {
+			c := r.Classes[name]
+			fmt.Fprintf(w, "%-10s %9d %9d %9.3f %9.3f %9.3f\n", name, c.Count, c.Failed, c.Latency.P50, c.Latency.P99, c.Latency.Max)
+		}
+	}
+	if r.Late > 0 {
+		fmt.Fprintf(w, "WARNING: generator fell behind schedule, %d requests sent late, max lag %.3fms\n",
+			r.Late, r.GeneratorLag.Max)
+	}
+	printErrors(w, r.Errors)
+}
+
+type latencyRow struct {
+	name string
+	s    LatencySummary
+}
+
+// printLatencies writes latency summaries as a table.
+func printLatencies(w io.Writer, rows []latencyRow) {
+	fmt.Fprintf(w, "%-10s %9s %9s %9s %9s %9s %9s %9s\n", "(ms)", "min", "mean", "p50", "p90", "p99", "p99.9", "max")
+	for _, row := range rows {
+		s := row.s
+		fmt.Fprintf(w, "%-10s %9.3f %9.3f %9.3f %9.3f %9.3f %9.3f %9.3f\n",
+			row.name, s.Min, s.Mean, s.P50, s.P90, s.P99, s.P999, s.Max)
+	}
+}
+
+// printErrors writes counts of failures by ErrCode.
+func printErrors(w io.Writer, errors map[int]int64) {
+	if len(errors) == 0 {
+		return
+	}
+	codes := make([]int, 0, len(errors))
+	for code := range errors {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	fmt.Fprintln(w, "errors")
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %d %-28s %d\n", code, errMsgs[code], errors[code])
+	}
+}
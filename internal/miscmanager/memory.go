@@ -0,0 +1,338 @@
+package miscmanager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/colinzuo/tunip/pkg/histogram"
+)
+
+// Memory allocation patterns.
+const (
+	PatternSteady   = "steady"   // Allocate the target at once and hold it.
+	PatternSawtooth = "sawtooth" // Grow to the target over a period, release everything, repeat.
+	PatternLeak     = "leak"     // Grow to the target over the whole duration, never release.
+)
+
+// cgroupRoot is where the cgroup filesystem is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// MemoryTestConfig memory pressure test config
+type MemoryTestConfig struct {
+	Bytes     int64   `json:"bytes"`   // Target, exclusive with percent.
+	Percent   float64 `json:"percent"` // Target as a percentage of the cgroup memory limit.
+	Pattern   string  `json:"pattern"`
+	Duration  int     `json:"duration"`   // In milliseconds.
+	Period    int     `json:"period"`     // Of the sawtooth, in milliseconds.
+	ChunkSize int     `json:"chunk_size"` // Bytes allocated at once.
+	Interval  int     `json:"interval"`   // Between samples of the memory statistics, in milliseconds.
+}
+
+// MemorySample are the memory statistics at one point of a run.
+type MemorySample struct {
+	Second    float64 `json:"second"` // Since the start of the run.
+	Allocated int64   `json:"allocated"`
+	HeapAlloc uint64  `json:"heap_alloc"`
+	HeapInuse uint64  `json:"heap_inuse"`
+	HeapSys   uint64  `json:"heap_sys"`
+	Sys       uint64  `json:"sys"`
+	NumGC     uint32  `json:"num_gc"`
+}
+
+// MemoryReport is the outcome of a memory pressure test, sizes are in bytes.
+type MemoryReport struct {
+	Pattern       string         `json:"pattern"`
+	Target        int64          `json:"target"`
+	PeakAllocated int64          `json:"peak_allocated"`
+	PeakHeapAlloc uint64         `json:"peak_heap_alloc"`
+	PeakHeapSys   uint64         `json:"peak_heap_sys"`
+	PeakSys       uint64         `json:"peak_sys"`
+	Elapsed       float64        `json:"elapsed_s"`
+	NumGC         uint32         `json:"num_gc"`
+	GCPause       LatencySummary `json:"gc_pause"`
+	GCPauseTotal  float64        `json:"gc_pause_total_ms"`
+	GCCPUFraction float64        `json:"gc_cpu_fraction"`
+	Samples       []MemorySample `json:"samples,omitempty"`
+}
+
+// memoryStep is how often the allocation is adjusted to the pattern.
+const memoryStep = 10 * time.Millisecond
+
+type memoryTest struct {
+	config MemoryTestConfig
+}
+
+func init() {
+	Register(func() Test {
+		return &memoryTest{config: MemoryTestConfig{Pattern: PatternSteady, Duration: 10000, Period: 2000,
+			ChunkSize: 1 << 20, Interval: 1000}}
+	})
+}
+
+func (t *memoryTest) Name() string {
+	return "memory_test"
+}
+
+func (t *memoryTest) DefaultConfig() interface{} {
+	return &t.config
+}
+
+func (t *memoryTest) Validate() error {
+	config := t.config
+	if (config.Bytes > 0) == (config.Percent > 0) {
+		return errors.New("exactly one of bytes and percent is required")
+	}
+	if config.Bytes < 0 || config.Percent < 0 || config.Percent > 100 {
+		return errors.New("bytes must not be negative and percent must be between 0 and 100")
+	}
+	switch config.Pattern {
+	case PatternSteady, PatternSawtooth, PatternLeak:
+	default:
+		return errors.Errorf("unsupported pattern '%s'", config.Pattern)
+	}
+	if config.Duration <= 0 || config.Period <= 0 || config.ChunkSize <= 0 || config.Interval <= 0 {
+		return errors.New("duration, period, chunk_size and interval must be positive")
+	}
+	return nil
+}
+
+func (t *memoryTest) Run(ctx context.Context, env *Env) Result {
+	logger := env.Logger
+	config := t.config
+
+	target := config.Bytes
+	if config.Percent > 0 {
+		limit, err := cgroupMemoryLimit()
+		if err != nil {
+			return Result{Error: err.Error()}
+		}
+		target = int64(float64(limit) * config.Percent / 100)
+		logger.Infof("Targeting %d bytes, %.1f%% of the cgroup limit %d", target, config.Percent, limit)
+	}
+	duration := time.Duration(config.Duration) * time.Millisecond
+	period := time.Duration(config.Period) * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	sampler := &memorySampler{pauses: histogram.New(), numGC: stats.NumGC, pauseTotal: stats.PauseTotalNs}
+
+	start := time.Now()
+	env.Progress.SetDeadline(start.Add(duration))
+	report := MemoryReport{Pattern: config.Pattern, Target: target}
+	pageSize := os.Getpagesize()
+	var chunks [][]byte
+	var allocated int64
+	sampleTicker := time.NewTicker(time.Duration(config.Interval) * time.Millisecond)
+	defer sampleTicker.Stop()
+	stepTicker := time.NewTicker(memoryStep)
+	defer stepTicker.Stop()
+	lastCycle := int64(0)
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			done = true
+		case now := <-sampleTicker.C:
+			report.Samples = append(report.Samples, sampler.sample(now.Sub(start), allocated))
+		case now := <-stepTicker.C:
+			elapsed := now.Sub(start)
+			if cycle := int64(elapsed / period); config.Pattern == PatternSawtooth && cycle != lastCycle {
+				lastCycle = cycle
+				chunks, allocated = nil, 0
+			}
+			want := patternBytes(config.Pattern, target, elapsed, duration, period)
+			// A large step takes a while, stop it on cancellation too.
+			for allocated+int64(config.ChunkSize) <= want && ctx.Err() == nil {
+				chunk := make([]byte, config.ChunkSize)
+				// Write every page so the memory is resident, not just reserved.
+				for i := 0; i < len(chunk); i += pageSize {
+					chunk[i] = 1
+				}
+				chunks = append(chunks, chunk)
+				allocated += int64(config.ChunkSize)
+			}
+			if allocated > report.PeakAllocated {
+				report.PeakAllocated = allocated
+			}
+			env.Progress.Add(1)
+		}
+	}
+	report.Samples = append(report.Samples, sampler.sample(time.Since(start), allocated))
+	runtime.KeepAlive(chunks)
+
+	report.Elapsed = time.Since(start).Seconds()
+	for _, s := range report.Samples {
+		if s.HeapAlloc > report.PeakHeapAlloc {
+			report.PeakHeapAlloc = s.HeapAlloc
+		}
+		if s.HeapSys > report.PeakHeapSys {
+			report.PeakHeapSys = s.HeapSys
+		}
+		if s.Sys > report.PeakSys {
+			report.PeakSys = s.Sys
+		}
+	}
+	report.NumGC = sampler.numGC - stats.NumGC
+	report.GCPause = summarize(sampler.pauses)
+	report.GCPauseTotal = float64(sampler.pauseTotal-stats.PauseTotalNs) / 1e6
+	report.GCCPUFraction = sampler.gcCPUFraction
+	report.Print(os.Stdout)
+
+	result := Result{Details: report}
+	if ctx.Err() == context.Canceled {
+		result.Error = fmt.Sprintf("interrupted after %.3fs", report.Elapsed)
+	}
+	return result
+}
+
+// patternBytes returns how many bytes the pattern has allocated after
+// elapsed.
+func patternBytes(pattern string, target int64, elapsed, duration, period time.Duration) int64 {
+	switch pattern {
+	case PatternSawtooth:
+		return int64(float64(target) * float64(elapsed%period) / float64(period))
+	case PatternLeak:
+		if elapsed >= duration {
+			return target
+		}
+		return int64(float64(target) * float64(elapsed) / float64(duration))
+	default:
+		return target
+	}
+}
+
+// memorySampler samples the memory statistics, collecting the pauses of
+// the collections since the previous sample.
+type memorySampler struct {
+	pauses        *histogram.Histogram // Microseconds.
+	numGC         uint32
+	pauseTotal    uint64
+	gcCPUFraction float64
+}
+
+func (s *memorySampler) sample(elapsed time.Duration, allocated int64) MemorySample {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	// PauseNs only keeps the most recent pauses, the pause of collection n
+	// is at (n+len-1)%len.
+	n := uint32(len(stats.PauseNs))
+	first := s.numGC + 1
+	if stats.NumGC >= n && first <= stats.NumGC-n {
+		first = stats.NumGC - n + 1
+	}
+	for gc := first; gc <= stats.NumGC; gc++ {
+		s.pauses.Record(int64(stats.PauseNs[(gc+n-1)%n] / 1000))
+	}
+	s.numGC, s.pauseTotal, s.gcCPUFraction = stats.NumGC, stats.PauseTotalNs, stats.GCCPUFraction
+	return MemorySample{Second: elapsed.Seconds(), Allocated: allocated, HeapAlloc: stats.HeapAlloc,
+		HeapInuse: stats.HeapInuse, HeapSys: stats.HeapSys, Sys: stats.Sys, NumGC: stats.NumGC}
+}
+
+// cgroupMemoryLimit returns the memory limit of the cgroup of the process.
+func cgroupMemoryLimit() (int64, error) {
+	content, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return 0, errors.Wrap(err, "read cgroup of the process")
+	}
+	return cgroupMemoryLimitIn(cgroupRoot, string(content))
+}
+
+// cgroupMemoryLimitIn returns the lowest memory limit of the cgroups in
+// procCgroup, the content of /proc/self/cgroup, and of their ancestors,
+// with the hierarchies mounted under root.
+func cgroupMemoryLimitIn(root, procCgroup string) (int64, error) {
+	limit, found := int64(0), false
+	for _, path := range cgroupMemoryLimitFiles(root, procCgroup) {
+		content, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return 0, errors.Wrap(err, "read cgroup memory limit")
+		}
+		found = true
+		value := strings.TrimSpace(string(content))
+		if value == "max" {
+			continue
+		}
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "parse cgroup memory limit '%s' of %s", value, path)
+		}
+		// cgroup v1 reports no limit as a huge number.
+		if v < 1<<62 && (limit == 0 || v < limit) {
+			limit = v
+		}
+	}
+	switch {
+	case !found:
+		return 0, errors.New("cgroup memory limit not found, use bytes instead of percent")
+	case limit == 0:
+		return 0, errors.New("no cgroup memory limit, use bytes instead of percent")
+	}
+	return limit, nil
+}
+
+// cgroupMemoryLimitFiles lists the memory limit files of the cgroups in
+// procCgroup and of their ancestors. In a container whose cgroup namespace
+// isn't private the cgroup of the process is named after the host's
+// hierarchy, the limit is then at the root of the mount.
+func cgroupMemoryLimitFiles(root, procCgroup string) []string {
+	var files []string
+	for _, line := range strings.Split(procCgroup, "\n") {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		var dir, name string
+		switch {
+		case fields[0] == "0" && fields[1] == "":
+			dir, name = root, "memory.max"
+		case hasController(fields[1], "memory"):
+			dir, name = filepath.Join(root, "memory"), "memory.limit_in_bytes"
+		default:
+			continue
+		}
+		for cgroup := path.Clean(fields[2]); ; cgroup = path.Dir(cgroup) {
+			files = append(files, filepath.Join(dir, filepath.FromSlash(cgroup), name))
+			if cgroup == "/" || cgroup == "." {
+				break
+			}
+		}
+	}
+	return files
+}
+
+func hasController(list, controller string) bool {
+	for _, c := range strings.Split(list, ",") {
+		if c == controller {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes the report as a table.
+func (r MemoryReport) Print(w io.Writer) {
+	mib := func(b uint64) float64 { return float64(b) / (1 << 20) }
+	fmt.Fprintf(w, "pattern     %s, target %.1fMiB\n", r.Pattern, mib(uint64(r.Target)))
+	fmt.Fprintf(w, "elapsed     %.3fs\n", r.Elapsed)
+	fmt.Fprintf(w, "peak        allocated %.1fMiB  heap alloc %.1fMiB  heap sys %.1fMiB  sys %.1fMiB\n",
+		mib(uint64(r.PeakAllocated)), mib(r.PeakHeapAlloc), mib(r.PeakHeapSys), mib(r.PeakSys))
+	fmt.Fprintf(w, "gc          %d collections, %.3fms paused, %.2f%% of cpu\n",
+		r.NumGC, r.GCPauseTotal, r.GCCPUFraction*100)
+	printLatencies(w, []latencyRow{{"gc pause", r.GCPause}})
+}
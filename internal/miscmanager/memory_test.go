@@ -0,0 +1,71 @@
+package miscmanager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatternBytes(t *testing.T) {
+	duration, period := 10*time.Second, 2*time.Second
+
+	assert.Equal(t, int64(1000), patternBytes(PatternSteady, 1000, 0, duration, period))
+	assert.Equal(t, int64(1000), patternBytes(PatternSteady, 1000, 5*time.Second, duration, period))
+
+	assert.Equal(t, int64(500), patternBytes(PatternSawtooth, 1000, time.Second, duration, period))
+	assert.Equal(t, int64(0), patternBytes(PatternSawtooth, 1000, 2*time.Second, duration, period))
+	assert.Equal(t, int64(250), patternBytes(PatternSawtooth, 1000, 4500*time.Millisecond, duration, period))
+
+	assert.Equal(t, int64(0), patternBytes(PatternLeak, 1000, 0, duration, period))
+	assert.Equal(t, int64(500), patternBytes(PatternLeak, 1000, 5*time.Second, duration, period))
+	assert.Equal(t, int64(1000), patternBytes(PatternLeak, 1000, 11*time.Second, duration, period))
+}
+
+func TestCgroupMemoryLimit(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	write := func(path, content string) {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// cgroup v2 outside a container, the root has no limit file.
+	v2 := "0::/user.slice/app.scope\n"
+	_, err = cgroupMemoryLimitIn(root, v2)
+	assert.EqualError(t, err, "cgroup memory limit not found, use bytes instead of percent")
+	write("user.slice/memory.max", "max")
+	write("user.slice/app.scope/memory.max", "max")
+	_, err = cgroupMemoryLimitIn(root, v2)
+	assert.EqualError(t, err, "no cgroup memory limit, use bytes instead of percent")
+	write("user.slice/app.scope/memory.max", "1073741824")
+	limit, err := cgroupMemoryLimitIn(root, v2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<30), limit)
+	// The lowest limit of the ancestors applies.
+	write("user.slice/memory.max", "536870912")
+	limit, _ = cgroupMemoryLimitIn(root, v2)
+	assert.Equal(t, int64(1<<29), limit)
+
+	// cgroup v1 in a container, the cgroup named after the host's hierarchy
+	// isn't mounted.
+	v1 := "5:cpu,cpuacct:/docker/abc\n4:memory:/docker/abc\n"
+	write("memory/memory.limit_in_bytes", "268435456")
+	limit, err = cgroupMemoryLimitIn(root, v1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<28), limit)
+	write("memory/memory.limit_in_bytes", "9223372036854771712")
+	_, err = cgroupMemoryLimitIn(root, v1)
+	assert.Error(t, err)
+}
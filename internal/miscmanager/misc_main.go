@@ -1,26 +1,36 @@
 package miscmanager
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"github.com/colinzuo/tunip/pkg/logp"
 )
 
+// timeLongForm formats the times carried by requests and responses.
+const timeLongForm = "2006-01-02T15:04:05.000000-07:00"
+
 // Manager def
 type Manager struct {
 	logger *logp.Logger
 	config *Config
 
-	dispatchChan   chan WorkerRequest
-	freeWorkerChan chan chan interface{}
-	doneChan       chan bool
-
 	timeLongForm string
 }
 
+// TestInfo describes a registered test and its state in misc.json.
+type TestInfo struct {
+	Name       string
+	Configured bool // misc.json has a section for the test.
+	Enabled    bool
+}
+
 // ParseConfig parse config
 func ParseConfig(configPath string) (*Config, error) {
 	logger := logp.NewLogger(ModuleName)
@@ -30,50 +40,152 @@ func ParseConfig(configPath string) (*Config, error) {
 		return nil, err
 	}
 
-	var config Config
+	config := Config{Progress: ProgressConfig{Interval: 5000}, Distributed: DistributedConfig{StartDelay: 2000}}
 	err = json.Unmarshal(content, &config)
+	if err == nil {
+		err = json.Unmarshal(content, &config.Tests)
+	}
 	if err != nil {
 		logger.Errorf("parse config %s failed, %s", configPath, err)
 		return nil, err
 	}
+	for _, key := range configKeys {
+		delete(config.Tests, key)
+	}
 	return &config, nil
 }
 
-// Run function to start
-func Run(configPath string) {
+// Run runs the named tests, or the tests enabled in the config if names is
+// empty, and returns their results.
+func Run(ctx context.Context, configPath string, names []string) ([]Result, error) {
 	logger := logp.NewLogger(ModuleName)
-	var config *Config
 	config, err := ParseConfig(configPath)
 	if err != nil {
-		logger.Panicf("ParseConfig: failed with %s", err)
+		return nil, err
 	}
 	logger.Infof("config %s, content: %+v", configPath, config)
 
-	manager := Manager{logger: logger, config: config,
-		timeLongForm: "2006-01-02T15:04:05.000-07:00"}
-	manager.Work()
+	manager := Manager{logger: logger, config: config, timeLongForm: timeLongForm}
+	return manager.Work(ctx, names)
 }
 
-// Work work according to config
-func (m *Manager) Work() {
+// List returns the registered tests.
+func List(configPath string) ([]TestInfo, error) {
+	config, err := ParseConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var infos []TestInfo
+	for _, name := range Tests() {
+		raw, configured := config.Tests[name]
+		infos = append(infos, TestInfo{Name: name, Configured: configured,
+			Enabled: configured && sectionEnabled(raw)})
+	}
+	return infos, nil
+}
+
+// Work runs the named tests, or the enabled ones if names is empty
+func (m *Manager) Work(ctx context.Context, names []string) ([]Result, error) {
 	logger := m.logger
-	config := m.config
 
-	jsonRsp, _ := json.MarshalIndent(config, "", "    ")
+	if len(names) == 0 {
+		for name := range m.config.Tests {
+			if _, found := lookup(name); !found {
+				logger.Warnf("Ignore config of unknown test %s", name)
+			}
+		}
+		for _, name := range Tests() {
+			if raw, found := m.config.Tests[name]; found && sectionEnabled(raw) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	tests := make([]Test, 0, len(names))
+	for _, name := range names {
+		test, err := m.newTest(name)
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+	}
 
-	logger.Infof("Enter with config: %s", string(jsonRsp))
+	logger.Infof("Enter Work with tests %v", names)
+	defer logger.Info("Leave Work")
 
 	rand.Seed((int64)(time.Now().Second()))
 
-	if config.PerfTest != nil && config.PerfTest.Enabled {
-		m.perfTest()
+	results := make([]Result, 0, len(tests))
+	for _, test := range tests {
+		if ctx.Err() != nil {
+			break
+		}
+		results = append(results, m.runTest(ctx, test))
 	}
+	return results, nil
+}
 
-	if config.ViperTest != nil && config.ViperTest.Enabled {
-		m.viperTest()
+// newTest creates the named test and configures it from its section.
+func (m *Manager) newTest(name string) (Test, error) {
+	factory, found := lookup(name)
+	if !found {
+		return nil, errors.Errorf("unknown test '%s'", name)
+	}
+	test := factory()
+	if raw, found := m.config.Tests[name]; found {
+		if err := json.Unmarshal(raw, test.DefaultConfig()); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse config of %s", name)
+		}
+	}
+	if err := test.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid config of %s", name)
 	}
+	return test, nil
+}
+
+func (m *Manager) runTest(ctx context.Context, test Test) Result {
+	name := test.Name()
+	logger := m.logger.Named(name)
+
+	jsonConfig, _ := json.Marshal(test.DefaultConfig())
+	logger.Infof("Enter with config: %s", jsonConfig)
+
+	progress := startProgress(m.config.Progress, logger)
+	env := &Env{Logger: logger, ServerAddr: m.config.ServerAddr, TimeLongForm: m.timeLongForm,
+		Progress: progress.Progress()}
+	start := time.Now()
+	result := test.Run(ctx, env)
+	progress.Stop()
+	result.Name = name
+	result.Start = start
+	result.Duration = time.Since(start)
+
+	if m.config.Report.Dir != "" {
+		report := &Report{Result: result, Config: test.DefaultConfig(),
+			Environment: currentEnvironment(m.config.ServerAddr)}
+		paths, err := writeReports(m.config.Report, report)
+		for _, path := range paths {
+			logger.Infof("Report written to %s", path)
+			fmt.Printf("report %s\n", path)
+		}
+		if err != nil {
+			logger.Errorf("Failed to write reports: %s", err)
+		}
+	}
+
+	if result.Failed() {
+		logger.Errorf("Leave after %s with error: %s", result.Duration, result.Error)
+	} else {
+		logger.Infof("Leave after %s", result.Duration)
+	}
+	return result
+}
 
-	if config.CpuBusyTest != nil && config.CpuBusyTest.Enabled {
-		m.cpuBusyTest()
+// sectionEnabled reports whether a test section has "enabled": true.
+func sectionEnabled(raw json.RawMessage) bool {
+	var section struct {
+		Enabled bool `json:"enabled"`
 	}
+	json.Unmarshal(raw, &section)
+	return section.Enabled
 }
@@ -0,0 +1,393 @@
+package miscmanager
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/colinzuo/tunip/pkg/histogram"
+	"github.com/colinzuo/tunip/pkg/logp"
+)
+
+// Network protocols.
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+const (
+	// maxUDPPayload is the largest payload of a UDP datagram over IPv4.
+	maxUDPPayload = 65507
+	// seqSize is the size of the sequence number heading every payload.
+	seqSize = 8
+)
+
+// NetworkTestConfig echo network test config
+type NetworkTestConfig struct {
+	Protocols    []string `json:"protocols"`
+	Local        bool     `json:"local"`         // Start a local echo server instead of using server_addr.
+	PayloadSizes []int    `json:"payload_sizes"` // In bytes, at least 8.
+	Connections  []int    `json:"connections"`   // Concurrent connections, each count measured in turn.
+	Number       int      `json:"number"`        // Round trips per connection.
+	Timeout      int      `json:"timeout"`       // Per round trip, in milliseconds.
+}
+
+// NetworkResult is the outcome of one protocol, payload size and number of
+// connections. Latency is the round trip time, Setup the time to connect of
+// the connections that were established, which for UDP is only setting up the
+// socket.
+type NetworkResult struct {
+	Protocol    string         `json:"protocol"`
+	PayloadSize int            `json:"payload_size"`
+	Connections int            `json:"connections"`
+	Count       int64          `json:"count"`
+	Failed      int64          `json:"failed"`
+	Elapsed     float64        `json:"elapsed_s"`
+	Throughput  float64        `json:"throughput"`       // Round trips per second.
+	Bandwidth   float64        `json:"throughput_mib_s"` // Echoed payload per second.
+	Setup       LatencySummary `json:"setup"`
+	Latency     LatencySummary `json:"latency"`
+	Errors      map[int]int64  `json:"errors,omitempty"` // Count of failures by ErrCode.
+}
+
+// NetworkReport is the outcome of an echo network test, results are keyed
+// by protocol, payload size and connections such as tcp_1024_c10.
+type NetworkReport struct {
+	Addr    string                   `json:"addr"`
+	Results map[string]NetworkResult `json:"results"`
+}
+
+type networkTest struct {
+	config NetworkTestConfig
+	logger *logp.Logger
+}
+
+func init() {
+	Register(func() Test {
+		return &networkTest{config: NetworkTestConfig{Protocols: []string{ProtocolTCP, ProtocolUDP}, Local: true,
+			PayloadSizes: []int{64, 1024, 16384}, Connections: []int{1, 10}, Number: 1000, Timeout: 1000}}
+	})
+}
+
+func (t *networkTest) Name() string {
+	return "network_test"
+}
+
+func (t *networkTest) DefaultConfig() interface{} {
+	return &t.config
+}
+
+func (t *networkTest) Validate() error {
+	config := t.config
+	if len(config.Protocols) == 0 || len(config.PayloadSizes) == 0 {
+		return errors.New("protocols and payload_sizes are required")
+	}
+	for _, protocol := range config.Protocols {
+		if protocol != ProtocolTCP && protocol != ProtocolUDP {
+			return errors.Errorf("unsupported protocol '%s'", protocol)
+		}
+	}
+	for _, size := range config.PayloadSizes {
+		if size < seqSize || size > maxUDPPayload {
+			return errors.Errorf("payload size %d must be between %d and %d", size, seqSize, maxUDPPayload)
+		}
+	}
+	if len(config.Connections) == 0 {
+		return errors.New("connections is required")
+	}
+	for _, conns := range config.Connections {
+		if conns <= 0 {
+			return errors.New("connections must be positive")
+		}
+	}
+	if config.Number <= 0 || config.Timeout <= 0 {
+		return errors.New("number and timeout must be positive")
+	}
+	return nil
+}
+
+func (t *networkTest) Run(ctx context.Context, env *Env) Result {
+	t.logger = env.Logger
+	config := t.config
+
+	addrs := map[string]string{ProtocolTCP: env.ServerAddr, ProtocolUDP: env.ServerAddr}
+	report := NetworkReport{Addr: env.ServerAddr, Results: map[string]NetworkResult{}}
+	if config.Local {
+		server, err := startEchoServer(t.logger)
+		if err != nil {
+			return Result{Error: err.Error()}
+		}
+		defer server.Close()
+		addrs = server.addrs()
+		report.Addr = "local"
+	}
+
+	total := 0
+	for _, conns := range config.Connections {
+		total += conns
+	}
+	env.Progress.SetTotal(int64(len(config.Protocols) * len(config.PayloadSizes) * total * config.Number))
+	for _, protocol := range config.Protocols {
+		for _, size := range config.PayloadSizes {
+			for _, conns := range config.Connections {
+				if ctx.Err() != nil {
+					break
+				}
+				t.logger.Infof("Echoing %d bytes over %d %s connections to %s", size, conns, protocol, addrs[protocol])
+				result := t.measure(ctx, protocol, addrs[protocol], size, conns, env.Progress)
+				report.Results[fmt.Sprintf("%s_%d_c%d", protocol, size, conns)] = result
+			}
+		}
+	}
+	report.Print(os.Stdout)
+
+	res := Result{Details: report}
+	if ctx.Err() != nil {
+		res.Error = fmt.Sprintf("interrupted after %d results", len(report.Results))
+	}
+	return res
+}
+
+// echoConn is the outcome of the round trips of one connection.
+type echoConn struct {
+	setup  time.Duration        // Zero if the dial failed.
+	rtt    *histogram.Histogram // Microseconds.
+	errors map[int]int64
+}
+
+func (t *networkTest) measure(ctx context.Context, protocol, addr string, size, connections int, progress *Progress) NetworkResult {
+	conns := make([]echoConn, connections)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func(c *echoConn) {
+			defer wg.Done()
+			t.echo(ctx, protocol, addr, size, c, progress)
+		}(&conns[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	result := NetworkResult{Protocol: protocol, PayloadSize: size, Connections: connections, Elapsed: elapsed.Seconds(),
+		Errors: map[int]int64{}}
+	setup, rtt := histogram.New(), histogram.New()
+	for _, c := range conns {
+		if c.setup > 0 {
+			setup.Record(c.setup.Microseconds())
+		}
+		rtt.Merge(c.rtt)
+		for code, n := range c.errors {
+			result.Errors[code] += n
+			result.Failed += n
+		}
+	}
+	result.Count = rtt.Count() + result.Failed
+	result.Setup, result.Latency = summarize(setup), summarize(rtt)
+	if elapsed > 0 {
+		result.Throughput = float64(rtt.Count()) / elapsed.Seconds()
+		result.Bandwidth = float64(rtt.Count()) * float64(size) / (1 << 20) / elapsed.Seconds()
+	}
+	if len(result.Errors) == 0 {
+		result.Errors = nil
+	}
+	return result
+}
+
+// echo connects and sends payloads one at a time, each carrying its
+// sequence number, waiting for them to be echoed.
+func (t *networkTest) echo(ctx context.Context, protocol, addr string, size int, c *echoConn, progress *Progress) {
+	c.rtt, c.errors = histogram.New(), map[int]int64{}
+	timeout := time.Duration(t.config.Timeout) * time.Millisecond
+	fail := func(errCode int, n int) {
+		c.errors[errCode] += int64(n)
+		for i := 0; i < n; i++ {
+			progress.Complete(0, true)
+		}
+	}
+
+	dialStart := time.Now()
+	conn, err := net.DialTimeout(protocol, addr, timeout)
+	if err != nil {
+		t.logger.Warnf("Failed to connect to %s over %s: %s", addr, protocol, err)
+		fail(ErrCodeGeneral, t.config.Number)
+		return
+	}
+	defer conn.Close()
+	c.setup = time.Since(dialStart)
+
+	payload, echoed := make([]byte, size), make([]byte, size)
+	for i := 0; i < t.config.Number; i++ {
+		if ctx.Err() != nil {
+			return
+		}
+		binary.BigEndian.PutUint64(payload, uint64(i))
+		sent := time.Now()
+		conn.SetDeadline(sent.Add(timeout))
+		errCode := ErrCodeOk
+		if _, err := conn.Write(payload); err != nil {
+			errCode = netErrCode(err)
+		} else if protocol == ProtocolTCP {
+			if _, err := io.ReadFull(conn, echoed); err != nil {
+				errCode = netErrCode(err)
+			} else if binary.BigEndian.Uint64(echoed) != uint64(i) {
+				errCode = ErrCodeUnexpected
+			}
+		} else {
+			errCode = readDatagram(conn, echoed, uint64(i))
+		}
+		rtt := time.Since(sent)
+		if errCode != ErrCodeOk {
+			fail(errCode, 1)
+			if protocol == ProtocolTCP {
+				// The stream is out of step, give up on the connection.
+				fail(errCode, t.config.Number-i-1)
+				return
+			}
+			continue
+		}
+		c.rtt.Record(rtt.Microseconds())
+		progress.Complete(rtt, false)
+	}
+}
+
+// readDatagram reads datagrams until the echo of seq, skipping the late
+// echoes of earlier datagrams.
+func readDatagram(conn net.Conn, buf []byte, seq uint64) int {
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return netErrCode(err)
+		}
+		if n < seqSize {
+			return ErrCodeUnexpected
+		}
+		if got := binary.BigEndian.Uint64(buf); got == seq {
+			return ErrCodeOk
+		} else if got > seq {
+			return ErrCodeUnexpected
+		}
+	}
+}
+
+func netErrCode(err error) int {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ErrCodeTimeout
+	}
+	return ErrCodeGeneral
+}
+
+// echoServer echoes TCP streams and UDP datagrams on local ports.
+type echoServer struct {
+	logger   *logp.Logger
+	listener net.Listener
+	packet   net.PacketConn
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+func startEchoServer(logger *logp.Logger) (*echoServer, error) {
+	listener, err := net.Listen(ProtocolTCP, "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "start tcp echo server")
+	}
+	packet, err := net.ListenPacket(ProtocolUDP, "127.0.0.1:0")
+	if err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "start udp echo server")
+	}
+	s := &echoServer{logger: logger, listener: listener, packet: packet, conns: map[net.Conn]bool{}}
+	s.wg.Add(2)
+	go s.serveTCP()
+	go s.serveUDP()
+	return s, nil
+}
+
+func (s *echoServer) addrs() map[string]string {
+	return map[string]string{ProtocolTCP: s.listener.Addr().String(), ProtocolUDP: s.packet.LocalAddr().String()}
+}
+
+func (s *echoServer) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			io.Copy(conn, conn)
+			conn.Close()
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *echoServer) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxUDPPayload)
+	for {
+		n, addr, err := s.packet.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if _, err := s.packet.WriteTo(buf[:n], addr); err != nil {
+			s.logger.Debugf("Failed to echo to %s: %s", addr, err)
+		}
+	}
+}
+
+// Close stops the server and closes the connections still open.
+func (s *echoServer) Close() {
+	s.listener.Close()
+	s.packet.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Print writes the report as tables, one per protocol and payload size.
+func (r NetworkReport) Print(w io.Writer) {
+	keys := make([]string, 0, len(r.Results))
+	for key := range r.Results {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := r.Results[keys[i]], r.Results[keys[j]]
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		if a.PayloadSize != b.PayloadSize {
+			return a.PayloadSize < b.PayloadSize
+		}
+		return a.Connections < b.Connections
+	})
+	for _, key := range keys {
+		res := r.Results[key]
+		fmt.Fprintf(w, "%s %d bytes over %d connections to %s\n", res.Protocol, res.PayloadSize, res.Connections, r.Addr)
+		fmt.Fprintf(w, "requests    %d (%d failed)\n", res.Count, res.Failed)
+		fmt.Fprintf(w, "elapsed     %.3fs\n", res.Elapsed)
+		fmt.Fprintf(w, "throughput  %.1f req/s, %.1f MiB/s\n", res.Throughput, res.Bandwidth)
+		printLatencies(w, []latencyRow{{"setup", res.Setup}, {"latency", res.Latency}})
+		printErrors(w, res.Errors)
+	}
+}
@@ -0,0 +1,40 @@
+package miscmanager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/colinzuo/tunip/pkg/logp"
+)
+
+func TestNetworkEcho(t *testing.T) {
+	logger := logp.NewLogger("network")
+	server, err := startEchoServer(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test := &networkTest{logger: logger, config: NetworkTestConfig{Number: 50, Timeout: 1000}}
+	for protocol, addr := range server.addrs() {
+		result := test.measure(context.Background(), protocol, addr, 128, 2, nil)
+		assert.Equal(t, int64(100), result.Count, protocol)
+		assert.Equal(t, 2, result.Connections, protocol)
+		if protocol == ProtocolTCP {
+			assert.Equal(t, int64(0), result.Failed, protocol)
+		} else {
+			// Datagrams may be dropped, even on loopback.
+			assert.LessOrEqual(t, result.Failed, int64(1), protocol)
+		}
+		assert.Greater(t, result.Latency.Max, 0.0, protocol)
+	}
+
+	// Nothing listens on the port once the server is closed.
+	addr := server.addrs()[ProtocolTCP]
+	server.Close()
+	result := test.measure(context.Background(), ProtocolTCP, addr, 128, 2, nil)
+	assert.Equal(t, int64(100), result.Failed)
+	assert.Equal(t, int64(100), result.Errors[ErrCodeGeneral])
+	assert.Equal(t, LatencySummary{}, result.Setup, "failed dials are not setup times")
+}
@@ -1,28 +1,23 @@
 package miscmanager
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/pkg/errors"
+
+	"github.com/colinzuo/tunip/pkg/histogram"
 	"github.com/colinzuo/tunip/pkg/logp"
+	"github.com/colinzuo/tunip/pkg/tracing"
 	"github.com/colinzuo/tunip/pkg/utils"
+	"github.com/colinzuo/tunip/pkg/workerpool"
 )
 
-// WorkerRequest request wrapper
-type WorkerRequest struct {
-	Type     string
-	GUID     string
-	Body     interface{}
-	RspChan  chan interface{}
-	DoneChan chan bool
-}
-
-// WorkerContext def
-type WorkerContext struct {
-	logger *logp.Logger
-	wr     WorkerRequest
-}
-
 // SampleWorkerReq def
 type SampleWorkerReq struct {
 	GUID     string `json:"guid"`
@@ -45,166 +40,370 @@ type SampleWorkerRsp struct {
 	SendTime     string `json:"send_time"`
 }
 
-func (m *Manager) perfTest() {
-	logger := m.logger
-	config := m.config.PerfTest
+// PerfTestConfig performance test config
+type PerfTestConfig struct {
+	MaxWorker int               `json:"maxworker"`
+	Number    int               `json:"number"`   // Stop after this many requests, unlimited if 0.
+	Duration  int               `json:"duration"` // Stop after this many milliseconds, unlimited if 0.
+	Timeout   int               `json:"timeout"`  // Per request, queueing included, in milliseconds. None if 0.
+	Profile   LoadProfileConfig `json:"profile"`
+	Mode      string            `json:"mode"` // local (default) or http.
+	HTTP      HTTPLoadConfig    `json:"http"`
+
+	Classes       []workerpool.ClassConfig `json:"classes"`        // Priority classes of the worker pool.
+	TenantWeights map[string]int           `json:"tenant_weights"` // Share of each tenant within a class.
+	Mix           []RequestMix             `json:"mix"`            // Class and tenant of the requests.
+}
 
-	logger.Info("Enter perfTest")
-	defer logger.Info("Leave perfTest")
+// RequestMix is a kind of request sent by the perf test, picked at random by
+// weight.
+type RequestMix struct {
+	Class  string `json:"class"`
+	Tenant string `json:"tenant"`
+	Weight int    `json:"weight"`
+}
 
-	m.dispatchChan = make(chan WorkerRequest, 1000)
-	m.freeWorkerChan = make(chan chan interface{}, config.MaxWorker)
-	m.doneChan = make(chan bool)
+const perfTestName = "perf_test"
 
-	go m.dispatch()
+// shutdownTimeout is how long running requests are given to complete once
+// all responses were received or the test was cancelled.
+const shutdownTimeout = 5 * time.Second
 
-	for i := 0; i < config.MaxWorker; i++ {
-		workerID := fmt.Sprintf("worker_%d", i)
-		go m.work(workerID)
-	}
+// lateThreshold is how far behind schedule a request is sent before it is
+// reported as late.
+const lateThreshold = time.Millisecond
+
+type perfTest struct {
+	config   PerfTestConfig
+	logger   *logp.Logger
+	ctx      context.Context
+	progress *Progress
 
-	m.sendRequestWaitRsp()
+	client  *http.Client // http mode only.
+	baseURL string
 
-	close(m.doneChan)
+	pool    *workerpool.Pool
+	startAt time.Time // Distributed runs only, when the agents start together.
+	replay  *replayer // Replay test only, supplies the requests instead of the http config.
+
+	timeLongForm string
+}
 
-	time.Sleep(time.Duration(5) * time.Second)
+func init() {
+	Register(func() Test {
+		return &perfTest{config: PerfTestConfig{MaxWorker: 10,
+			Profile: LoadProfileConfig{Type: ProfileClosed}, Mode: PerfModeLocal,
+			HTTP: HTTPLoadConfig{Method: http.MethodGet, Timeout: 5000}}}
+	})
 }
 
-func (m Manager) dispatch() {
-	logger := m.logger.Named("Dispatch")
+func (m *perfTest) Name() string {
+	return perfTestName
+}
 
-	var req WorkerRequest
+func (m *perfTest) DefaultConfig() interface{} {
+	return &m.config
+}
 
-	for {
-		select {
-		case req = <-m.dispatchChan:
-			logger.Debugf("recv req: %+v", req)
-			select {
-			case workerChan := <-m.freeWorkerChan:
-				workerChan <- req
-				logger.Debugf("Send out request %s  %s", req.Type, req.GUID)
-			case <-m.doneChan:
-				logger.Infof("recv done")
-				return
-			}
-		case <-m.doneChan:
-			logger.Infof("recv done")
-			return
+func (m *perfTest) Validate() error {
+	if m.config.MaxWorker <= 0 {
+		return errors.New("maxworker must be positive")
+	}
+	if m.config.Number < 0 || m.config.Duration < 0 || m.config.Timeout < 0 {
+		return errors.New("number, duration and timeout must not be negative")
+	}
+	if m.config.Number == 0 && m.config.Duration == 0 && m.config.Profile.Type != ProfileSteps {
+		return errors.New("number or duration is required")
+	}
+	if err := m.config.Profile.validate(m.duration()); err != nil {
+		return err
+	}
+	if err := m.validateMix(); err != nil {
+		return err
+	}
+	switch m.config.Mode {
+	case PerfModeLocal:
+	case PerfModeHTTP:
+		return m.config.HTTP.validate()
+	default:
+		return errors.Errorf("unsupported mode '%s'", m.config.Mode)
+	}
+	return nil
+}
+
+func (m *perfTest) validateMix() error {
+	classes := map[string]bool{}
+	for _, class := range m.config.Classes {
+		if class.Weight < 0 || class.Limit < 0 {
+			return errors.Errorf("class '%s': weight and limit must not be negative", class.Name)
+		}
+		classes[class.Name] = true
+	}
+	for _, mix := range m.config.Mix {
+		if mix.Weight < 0 {
+			return errors.New("mix weight must not be negative")
+		}
+		if mix.Class != "" && !classes[mix.Class] {
+			return errors.Errorf("mix refers to unknown class '%s'", mix.Class)
 		}
 	}
+	return nil
 }
 
-func (m Manager) work(workID string) {
-	workerChan := make(chan interface{})
-	logger := m.logger.Named(workID)
-	logger.Info("Enter")
-	defer logger.Info("Leave")
+func (m *perfTest) duration() time.Duration {
+	return time.Duration(m.config.Duration) * time.Millisecond
+}
 
-	var inRequest interface{}
+func (m *perfTest) Run(ctx context.Context, env *Env) Result {
+	recorder, elapsed, err := m.run(ctx, env)
+	if err != nil {
+		return Result{Error: err.Error()}
+	}
+	report := recorder.report(elapsed)
+	logReport(m.logger, report)
 
-	workerCtx := &WorkerContext{}
+	report.Print(os.Stdout)
+	if ctx.Err() != nil {
+		return Result{Error: fmt.Sprintf("interrupted after %d responses", report.Count), Details: report}
+	}
+	return Result{Details: report}
+}
+
+// run sends the requests, from startAt if set, and returns what was
+// recorded and how long it took.
+func (m *perfTest) run(ctx context.Context, env *Env) (*latencyRecorder, time.Duration, error) {
+	config := m.config
+	m.logger = env.Logger
+	m.progress = env.Progress
+	m.timeLongForm = env.TimeLongForm
+	m.ctx = ctx
+
+	if config.Mode == PerfModeHTTP {
+		if m.replay == nil && env.ServerAddr == "" && !strings.Contains(config.HTTP.URL, "://") {
+			return nil, 0, errors.New("http mode requires server_addr or an absolute url")
+		}
+		m.baseURL = httpBaseURL(env.ServerAddr)
+		m.client = tracing.NewHTTPClient(time.Duration(config.HTTP.Timeout) * time.Millisecond)
+		if m.replay != nil {
+			// Recorded redirects are compared, not followed.
+			m.client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		} else {
+			m.logger.Infof("Sending %s %s to %s", config.HTTP.Method, config.HTTP.URL, m.baseURL)
+		}
+	}
 
-	for {
-		m.freeWorkerChan <- workerChan
+	m.pool = workerpool.New(workerpool.Config{Workers: config.MaxWorker, QueueSize: 1000,
+		Classes: config.Classes, TenantWeights: config.TenantWeights})
+	m.pool.HandleFunc(RequestSampleWorkerReq, m.workerOnSampleWorkerReq)
+	m.pool.HandleFunc(RequestHTTPWorkerReq, m.workerOnHTTPWorkerReq)
 
+	if wait := time.Until(m.startAt); wait > 0 {
+		m.logger.Infof("Starting at %s", m.startAt.Format(m.timeLongForm))
 		select {
-		case <-m.doneChan:
-			return
-		case inRequest = <-workerChan:
-			break
+		case <-time.After(wait):
+		case <-ctx.Done():
 		}
+	}
+	recorder, elapsed := m.sendRequestWaitRsp()
 
-		switch v := inRequest.(type) {
-		case WorkerRequest:
-			workerCtx.logger = logger.With("guid", v.GUID)
-			workerCtx.wr = v
-			switch v.Type {
-			case RequestSampleWorkerReq:
-				m.workerOnSampleWorkerReq(workerCtx)
-			default:
-				logger.Errorf("Unexpected WorkerRequest type %s", v.Type)
-			}
-		default:
-			logger.Errorf("Unexpected inRequest type %T", inRequest)
-		}
+	// Don't wait for requests the test no longer wants when cancelled.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	if ctx.Err() != nil {
+		cancel()
 	}
+	if err := m.pool.Shutdown(shutdownCtx); err != nil {
+		m.logger.Warnf("Cancelled running requests on shutdown: %s", err)
+	}
+	cancel()
+	m.logger.Infof("Pool metrics %+v", m.pool.Metrics())
+	return recorder, elapsed, nil
 }
 
-func (m Manager) workerSendRsp(workerCtx *WorkerContext, rsp interface{}) {
-	workerCtx.logger.Infof("to send rsp %+v", rsp)
-	select {
-	case <-m.doneChan:
-		return
-	case <-workerCtx.wr.DoneChan:
-		workerCtx.logger.Errorf("requester doesn't want rsp for %s  %s", workerCtx.wr.Type, workerCtx.wr.GUID)
-		break
-	case workerCtx.wr.RspChan <- rsp:
-		break
-	}
+// workerLogger returns the logger of the worker running a request.
+func (m *perfTest) workerLogger(ctx context.Context, req *workerpool.Request) *logp.Logger {
+	workerID, _ := workerpool.WorkerID(ctx)
+	return m.logger.Named(fmt.Sprintf("worker_%d", workerID)).With("guid", req.ID)
 }
 
-func (m Manager) workerOnSampleWorkerReq(workerCtx *WorkerContext) {
-	logger := workerCtx.logger
+func (m *perfTest) workerOnSampleWorkerReq(ctx context.Context, req *workerpool.Request) (interface{}, error) {
+	logger := m.workerLogger(ctx, req)
 
 	realRecvTime := time.Now().Format(m.timeLongForm)
 
-	logger.Infof("recv req: %+v", workerCtx.wr)
+	logger.Infof("recv req: %+v", req)
 
-	sampleWorkerReq := workerCtx.wr.Body.(SampleWorkerReq)
+	sampleWorkerReq := req.Body.(SampleWorkerReq)
 
 	logger.Infof("process req: %+v", sampleWorkerReq)
 
+	baseRsp := BaseResponse{
+		ErrCode:   ErrCodeOk,
+		ErrMsg:    ErrMsgOk,
+		ErrDetail: "",
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		baseRsp = BaseResponse{ErrCode: ErrCodeTimeout, ErrMsg: ErrMsgTimeout, ErrDetail: ctx.Err().Error()}
+	}
+
 	rsp := SampleWorkerRsp{
-		BaseResponse: BaseResponse{
-			ErrCode:   ErrCodeOk,
-			ErrMsg:    ErrMsgOk,
-			ErrDetail: "",
-		},
+		BaseResponse: baseRsp,
 		GUID:         sampleWorkerReq.GUID,
 		RecvTime:     sampleWorkerReq.RecvTime,
 		RealRecvTime: realRecvTime,
 		SendTime:     time.Now().Format(m.timeLongForm),
 	}
 
-	m.workerSendRsp(workerCtx, rsp)
+	logger.Infof("to send rsp %+v", rsp)
+	return rsp, nil
 }
 
-func (m Manager) sendRequestWaitRsp() {
-	logger := m.logger.Named("sendRequestWaitRsp")
-	config := m.config.PerfTest
+// newWorkerRequest returns the i-th request to submit according to the
+// mode. Its latency is measured from the intended send time.
+func (m *perfTest) newWorkerRequest(i int, guid string, intended time.Time) *workerpool.Request {
+	recvTime := intended.Format(m.timeLongForm)
+	req := &workerpool.Request{Type: RequestSampleWorkerReq, ID: guid,
+		Body:    SampleWorkerReq{GUID: guid, RecvTime: recvTime},
+		Timeout: time.Duration(m.config.Timeout) * time.Millisecond}
+	if mix := m.pickMix(); mix != nil {
+		req.Class, req.Tenant = mix.Class, mix.Tenant
+	}
+	if m.config.Mode == PerfModeHTTP {
+		req.Type = RequestHTTPWorkerReq
+		req.Body = HTTPWorkerReq{GUID: guid, RecvTime: recvTime, Index: i}
+	}
+	return req
+}
 
-	rspChan := make(chan interface{}, config.Number)
-	doneChan := m.doneChan
+// pickMix picks the kind of the next request, nil if no mix is configured.
+func (m *perfTest) pickMix() *RequestMix {
+	total := 0
+	for _, mix := range m.config.Mix {
+		total += mix.Weight
+	}
+	if total <= 0 {
+		return nil
+	}
+	n := rand.Intn(total)
+	for i := range m.config.Mix {
+		if n -= m.config.Mix[i].Weight; n < 0 {
+			return &m.config.Mix[i]
+		}
+	}
+	return nil
+}
 
-	start := time.Now()
+// sendRequests dispatches requests according to the profile and returns how
+// many were sent. How far behind schedule each scheduled request was sent,
+// zero if on time, is recorded in lag.
+func (m *perfTest) sendRequests(start time.Time, results chan workerpool.Result, lag *histogram.Histogram) int {
+	logger := m.logger.Named("sendRequests")
+	config := m.config
+	sched := config.Profile.newSchedule(m.duration())
+	if m.replay != nil {
+		sched = m.replay.schedule()
+	}
 
 	var i int
-	for i = 0; i < config.Number; i++ {
-		guid := utils.NewUUID()
+	for i = 0; config.Number == 0 || i < config.Number; i++ {
+		intended := time.Now()
+		if sched != nil {
+			off, ok := sched.offset(i)
+			if !ok {
+				break
+			}
+			intended = start.Add(off)
+			if wait := time.Until(intended); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-m.ctx.Done():
+					return i
+				}
+				lag.Record(0)
+			} else {
+				lag.Record(-wait.Microseconds())
+			}
+		} else if config.Duration > 0 && intended.Sub(start) >= m.duration() {
+			break
+		}
+
+		workerReq := m.newWorkerRequest(i, utils.NewUUID(), intended)
+
+		logger.Debugf("Send out req %d: %+v", i+1, workerReq)
+		logger.EveryN("sendRequests", 1000).Infof("Sent %d requests", i+1)
+		if err := m.pool.Submit(m.ctx, workerReq, results); errors.Is(err, workerpool.ErrClassFull) {
+			// Rejected, the receiver counts it as failed. It stops reading
+			// once the run is cancelled, so don't block on a full channel.
+			m.progress.Start()
+			select {
+			case results <- workerpool.Result{Request: workerReq, Err: err}:
+			case <-m.ctx.Done():
+				return i
+			}
+			continue
+		} else if err != nil {
+			logger.Warnf("Stop sending after %d requests: %s", i, err)
+			break
+		}
+		m.progress.Start()
+	}
+	return i
+}
 
-		workerReq := WorkerRequest{Type: RequestSampleWorkerReq,
-			GUID: guid,
-			Body: SampleWorkerReq{
-				GUID:     guid,
-				RecvTime: time.Now().Format(m.timeLongForm),
-			},
-			RspChan:  rspChan,
-			DoneChan: doneChan}
+func (m *perfTest) sendRequestWaitRsp() (*latencyRecorder, time.Duration) {
+	logger := m.logger.Named("sendRequestWaitRsp")
 
-		logger.Infof("Send out req %d: %+v", i+1, workerReq)
-		m.dispatchChan <- workerReq
+	results := make(chan workerpool.Result, 1000)
+	sentChan := make(chan int, 1)
+	start := time.Now()
+	recorder := newLatencyRecorder(start)
+	if m.config.Number > 0 {
+		m.progress.SetTotal(int64(m.config.Number))
+	}
+	if m.config.Duration > 0 {
+		m.progress.SetDeadline(start.Add(m.duration()))
 	}
+	go func() {
+		sentChan <- m.sendRequests(start, results, recorder.lag)
+	}()
 
-	var genericRsp interface{}
+	var result workerpool.Result
 	rspNum := 0
+	sent := -1
 
-	for rspNum < config.Number {
-		genericRsp = <-rspChan
+	for sent < 0 || rspNum < sent {
+		select {
+		case sent = <-sentChan:
+			logger.Infof("Sent all %d requests", sent)
+			continue
+		case result = <-results:
+		case <-m.ctx.Done():
+			logger.Warnf("Cancelled with %d responses outstanding", m.pool.Metrics().Submitted-int64(rspNum))
+		}
+		if m.ctx.Err() != nil {
+			break
+		}
 		rspNum++
+		recvTime := time.Now()
 
-		lrsp := genericRsp.(SampleWorkerRsp)
-
-		logger.Infof("Recv rsp %d: %+v", rspNum, lrsp)
+		if result.Err != nil {
+			logger.Debugf("Req %s failed: %s", result.Request.ID, result.Err)
+			errCode := ErrCodeGeneral
+			if result.Err == context.DeadlineExceeded {
+				errCode = ErrCodeTimeout
+			}
+			recorder.fail(result.Request.Class, errCode)
+			m.progress.Complete(result.Queued+result.Processing, true)
+			continue
+		}
+		switch lrsp := result.Value.(type) {
+		case SampleWorkerRsp:
+			logger.Debugf("Recv rsp %d: %+v", rspNum, lrsp)
+			m.recordRsp(recorder, recvTime, result.Request.Class, lrsp.ErrCode, lrsp.RecvTime, lrsp.RealRecvTime, lrsp.SendTime)
+		case HTTPWorkerRsp:
+			logger.Debugf("Recv rsp %d: %+v", rspNum, lrsp)
+			m.recordRsp(recorder, recvTime, result.Request.Class, lrsp.ErrCode, lrsp.RecvTime, lrsp.RealRecvTime, lrsp.SendTime)
+		}
+		logger.Every("sendRequestWaitRsp.recv", time.Second).Infof("Received %d responses", rspNum)
 	}
 
 	end := time.Now()
@@ -212,4 +411,36 @@ func (m Manager) sendRequestWaitRsp() {
 
 	logger.Infof("costTime %d", costTime)
 	fmt.Printf("costTime %d\n", costTime)
+
+	return recorder, end.Sub(start)
+}
+
+// logReport logs the outcome of a run and whatever went wrong.
+func logReport(logger *logp.Logger, report LatencyReport) {
+	if report.Late > 0 {
+		logger.Warnf("Generator fell behind schedule: %d requests sent over %s late, max lag %.3fms",
+			report.Late, lateThreshold, report.GeneratorLag.Max)
+	}
+	if report.Failed > 0 {
+		logger.Warnf("%d of %d requests failed: %v", report.Failed, report.Count, report.Errors)
+	}
+	logger.Infof("Latency %+v, queueing %+v, processing %+v", report.Latency, report.Queueing, report.Processing)
+}
+
+// recordRsp records the timestamps carried by a response, which are
+// formatted with timeLongForm. A response with unparsable times is recorded
+// as failed without a response.
+func (m *perfTest) recordRsp(recorder *latencyRecorder, recvTime time.Time, class string, errCode int,
+	created, pickedUp, sent string) {
+	createdTime, err1 := time.Parse(m.timeLongForm, created)
+	pickedUpTime, err2 := time.Parse(m.timeLongForm, pickedUp)
+	sentTime, err3 := time.Parse(m.timeLongForm, sent)
+	if err1 != nil || err2 != nil || err3 != nil {
+		m.logger.Warnf("Rsp with bad times %s %s %s", created, pickedUp, sent)
+		recorder.fail(class, ErrCodeBadFormat)
+		m.progress.Complete(0, true)
+		return
+	}
+	m.progress.Complete(recvTime.Sub(createdTime), errCode != ErrCodeOk)
+	recorder.record(recvTime, class, recvTime.Sub(createdTime), pickedUpTime.Sub(createdTime), sentTime.Sub(pickedUpTime), errCode)
 }
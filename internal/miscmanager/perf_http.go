@@ -0,0 +1,183 @@
+package miscmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/colinzuo/tunip/pkg/tracing"
+	"github.com/colinzuo/tunip/pkg/workerpool"
+)
+
+// Perf test modes
+const (
+	PerfModeLocal = "local" // Requests are processed by in-process workers.
+	PerfModeHTTP  = "http"  // Workers send HTTP requests to server_addr.
+)
+
+// HTTPLoadConfig describes the HTTP requests sent in http mode. URL, header
+// values and Body are templates where {{guid}} is replaced by the GUID of the
+// request and {{now}} by the time it is sent.
+type HTTPLoadConfig struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"` // Relative to server_addr unless absolute.
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	Timeout int               `json:"timeout"` // Milliseconds.
+}
+
+// HTTPWorkerReq def
+type HTTPWorkerReq struct {
+	GUID     string
+	RecvTime string
+	Index    int // Of the request in the run.
+}
+
+// HTTPWorkerRsp def
+type HTTPWorkerRsp struct {
+	BaseResponse
+	GUID         string `json:"guid"`
+	StatusCode   int    `json:"status_code"`
+	RecvTime     string `json:"recv_time"`
+	RealRecvTime string `json:"real_recv_time"`
+	SendTime     string `json:"send_time"`
+}
+
+func (c *HTTPLoadConfig) validate() error {
+	if c.URL == "" {
+		return errors.New("http.url is required in http mode")
+	}
+	if c.Timeout < 0 {
+		return errors.New("http.timeout must not be negative")
+	}
+	return nil
+}
+
+// httpBaseURL turns server_addr into a URL prefix, defaulting the scheme to
+// http.
+func httpBaseURL(serverAddr string) string {
+	base := strings.TrimSuffix(serverAddr, "/")
+	if base != "" && !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	return base
+}
+
+// newHTTPRequest expands the templates of the config for one request.
+func (m *perfTest) newHTTPRequest(ctx context.Context, guid string) (*http.Request, error) {
+	config := m.config.HTTP
+	replacer := strings.NewReplacer("{{guid}}", guid, "{{now}}", time.Now().Format(m.timeLongForm))
+
+	url := replacer.Replace(config.URL)
+	if !strings.Contains(url, "://") {
+		url = m.baseURL + "/" + strings.TrimPrefix(url, "/")
+	}
+	var body *bytes.Reader
+	if config.Body != "" {
+		body = bytes.NewReader([]byte(replacer.Replace(config.Body)))
+	} else {
+		body = bytes.NewReader(nil)
+	}
+
+	method := config.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if config.Body != "" {
+		req.Header.Set("Content-Type", ContentTypeJSON)
+	}
+	for name, value := range config.Headers {
+		req.Header.Set(name, replacer.Replace(value))
+	}
+	return req, nil
+}
+
+func (m *perfTest) workerOnHTTPWorkerReq(ctx context.Context, req *workerpool.Request) (interface{}, error) {
+	logger := m.workerLogger(ctx, req)
+	httpWorkerReq := req.Body.(HTTPWorkerReq)
+
+	rsp := HTTPWorkerRsp{
+		GUID:         httpWorkerReq.GUID,
+		RecvTime:     httpWorkerReq.RecvTime,
+		RealRecvTime: time.Now().Format(m.timeLongForm),
+	}
+	rsp.BaseResponse = m.doHTTP(ctx, httpWorkerReq, &rsp.StatusCode)
+	rsp.SendTime = time.Now().Format(m.timeLongForm)
+
+	if rsp.ErrCode != ErrCodeOk {
+		logger.Debugf("request failed: %+v", rsp)
+	}
+	return rsp, nil
+}
+
+// doHTTP sends one request and classifies the outcome. Replayed responses
+// are compared with the recorded ones instead.
+func (m *perfTest) doHTTP(ctx context.Context, workerReq HTTPWorkerReq, statusCode *int) BaseResponse {
+	ctx = tracing.ContextWith(ctx, tracing.NewTrace())
+	var req *http.Request
+	var err error
+	if m.replay != nil {
+		req, err = m.replay.newRequest(ctx, workerReq.Index)
+	} else {
+		req, err = m.newHTTPRequest(ctx, workerReq.GUID)
+	}
+	if err != nil {
+		return BaseResponse{ErrCode: ErrCodeBadFormat, ErrMsg: ErrMsgBadFormat, ErrDetail: err.Error()}
+	}
+
+	httpRsp, err := m.client.Do(req)
+	if err != nil {
+		if isTimeout(err) {
+			return BaseResponse{ErrCode: ErrCodeTimeout, ErrMsg: ErrMsgTimeout, ErrDetail: err.Error()}
+		}
+		return BaseResponse{ErrCode: ErrCodeHTTPErr, ErrMsg: ErrMsgHTTPErr, ErrDetail: err.Error()}
+	}
+	defer httpRsp.Body.Close()
+	*statusCode = httpRsp.StatusCode
+
+	content, err := ioutil.ReadAll(httpRsp.Body)
+	if err != nil {
+		if isTimeout(err) {
+			return BaseResponse{ErrCode: ErrCodeTimeout, ErrMsg: ErrMsgTimeout, ErrDetail: err.Error()}
+		}
+		return BaseResponse{ErrCode: ErrCodeFailedToReadBody, ErrMsg: ErrMsgFailedToReadBody, ErrDetail: err.Error()}
+	}
+	// Replayed responses are checked against the recorded ones, or else
+	// only their status.
+	if m.replay != nil && m.replay.compare(workerReq.Index, httpRsp.StatusCode, content) {
+		return BaseResponse{ErrCode: ErrCodeOk, ErrMsg: ErrMsgOk}
+	}
+	if httpRsp.StatusCode < 200 || httpRsp.StatusCode > 299 {
+		return BaseResponse{ErrCode: ErrCodeHTTPErr, ErrMsg: ErrMsgHTTPErr,
+			ErrDetail: fmt.Sprintf("status %d", httpRsp.StatusCode)}
+	}
+	if m.replay != nil {
+		return BaseResponse{ErrCode: ErrCodeOk, ErrMsg: ErrMsgOk}
+	}
+
+	var baseRsp BaseResponse
+	if err := json.Unmarshal(content, &baseRsp); err != nil {
+		return BaseResponse{ErrCode: ErrCodeFailedToParseRspBody, ErrMsg: ErrMsgFailedToParseRspBody, ErrDetail: err.Error()}
+	}
+	return baseRsp
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,96 @@
+package miscmanager
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/colinzuo/tunip/pkg/logp"
+	"github.com/colinzuo/tunip/pkg/tracing"
+)
+
+func TestNewHTTPRequest(t *testing.T) {
+	m := &perfTest{baseURL: httpBaseURL("localhost:8080/"), timeLongForm: timeLongForm,
+		config: PerfTestConfig{HTTP: HTTPLoadConfig{Method: http.MethodPost, URL: "/orders/{{guid}}",
+			Headers: map[string]string{"X-Request-Id": "{{guid}}"}, Body: `{"id": "{{guid}}", "at": "{{now}}"}`}}}
+	req, err := m.newHTTPRequest(context.Background(), "g1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "http://localhost:8080/orders/g1", req.URL.String())
+	assert.Equal(t, "g1", req.Header.Get("X-Request-Id"))
+	assert.Equal(t, ContentTypeJSON, req.Header.Get("Content-Type"))
+	body, _ := ioutil.ReadAll(req.Body)
+	assert.Regexp(t, `^\{"id": "g1", "at": "\d{4}-\d\d-\d\dT`, string(body))
+
+	m.config.HTTP = HTTPLoadConfig{URL: "https://other.example/ping"}
+	req, err = m.newHTTPRequest(context.Background(), "g2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.MethodGet, req.Method, "get by default")
+	assert.Equal(t, "https://other.example/ping", req.URL.String(), "absolute urls are kept")
+	assert.Empty(t, req.Header.Get("Content-Type"))
+}
+
+func TestDoHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ok":
+			fmt.Fprint(w, `{"err_code": 0}`)
+		case "/failed":
+			fmt.Fprintf(w, `{"err_code": %d, "err_msg": "failed"}`, ErrCodeGeneral)
+		case "/status":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/bad_body":
+			fmt.Fprint(w, "<html>")
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		url     string
+		errCode int
+		status  int
+	}{
+		{"/ok", ErrCodeOk, 200},
+		{"/failed", ErrCodeGeneral, 200},
+		{"/status", ErrCodeHTTPErr, 503},
+		{"/bad_body", ErrCodeFailedToParseRspBody, 200},
+		{"/slow", ErrCodeTimeout, 0},
+		{"http://127.0.0.1:1/refused", ErrCodeHTTPErr, 0},
+		{"http://%zz", ErrCodeBadFormat, 0},
+	}
+	for _, c := range cases {
+		m := &perfTest{baseURL: server.URL, timeLongForm: timeLongForm,
+			client: tracing.NewHTTPClient(50 * time.Millisecond),
+			config: PerfTestConfig{HTTP: HTTPLoadConfig{URL: c.url}}}
+		var status int
+		rsp := m.doHTTP(context.Background(), HTTPWorkerReq{GUID: "g"}, &status)
+		assert.Equal(t, c.errCode, rsp.ErrCode, c.url)
+		assert.Equal(t, c.status, status, c.url)
+	}
+}
+
+func TestRecordRspBadTimes(t *testing.T) {
+	m := &perfTest{timeLongForm: timeLongForm, logger: logp.NewLogger("test")}
+	start := time.Now()
+	recorder := newLatencyRecorder(start)
+	now := start.Format(timeLongForm)
+	m.recordRsp(recorder, start, "", ErrCodeOk, now, now, now)
+	m.recordRsp(recorder, start, "", ErrCodeOk, "bad", now, now)
+
+	report := recorder.report(time.Second)
+	assert.Equal(t, int64(2), report.Count)
+	assert.Equal(t, int64(1), report.Failed)
+	assert.Equal(t, map[int]int64{ErrCodeBadFormat: 1}, report.Errors)
+}
@@ -0,0 +1,84 @@
+package miscmanager
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const procStatPath = "/proc/stat"
+
+// cpuTimes are the jiffies a CPU spent, as found in /proc/stat.
+type cpuTimes struct {
+	busy  uint64
+	total uint64
+}
+
+// cpuStats are the times of all CPUs together and of each CPU.
+type cpuStats struct {
+	all   cpuTimes
+	cores []cpuTimes
+}
+
+func readCPUStats() (cpuStats, error) {
+	f, err := os.Open(procStatPath)
+	if err != nil {
+		return cpuStats{}, errors.Wrap(err, "read cpu stats")
+	}
+	defer f.Close()
+	return parseCPUStats(f)
+}
+
+// parseCPUStats parses the cpu lines of /proc/stat, idle and iowait count as
+// idle time.
+func parseCPUStats(r io.Reader) (cpuStats, error) {
+	var stats cpuStats
+	found := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		var times cpuTimes
+		for i, field := range fields[1:] {
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return cpuStats{}, errors.Wrapf(err, "parse %s", fields[0])
+			}
+			// guest and guest_nice are already part of user and nice.
+			if i >= 8 {
+				break
+			}
+			times.total += v
+			if i != 3 && i != 4 {
+				times.busy += v
+			}
+		}
+		if fields[0] == "cpu" {
+			stats.all = times
+			found = true
+		} else {
+			stats.cores = append(stats.cores, times)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return cpuStats{}, errors.Wrap(err, "read cpu stats")
+	}
+	if !found {
+		return cpuStats{}, errors.New("no cpu line in cpu stats")
+	}
+	return stats, nil
+}
+
+// utilization returns the percentage of time busy between prev and t.
+func (t cpuTimes) utilization(prev cpuTimes) float64 {
+	if t.total <= prev.total || t.busy < prev.busy {
+		return 0
+	}
+	return 100 * float64(t.busy-prev.busy) / float64(t.total-prev.total)
+}
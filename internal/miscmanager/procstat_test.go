@@ -0,0 +1,27 @@
+package miscmanager
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCPUStats(t *testing.T) {
+	stats, err := parseCPUStats(strings.NewReader(`cpu  300 0 100 500 100 0 0 0 50 0
+cpu0 200 0 50 200 50 0 0 0 50 0
+cpu1 100 0 50 300 50 0 0 0 0 0
+intr 12345 0 0
+ctxt 6789
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, cpuTimes{busy: 400, total: 1000}, stats.all)
+	assert.Equal(t, []cpuTimes{{busy: 250, total: 500}, {busy: 150, total: 500}}, stats.cores)
+
+	later := cpuTimes{busy: 500, total: 1200}
+	assert.InDelta(t, 50, later.utilization(stats.all), 0.001)
+	assert.Equal(t, 0.0, stats.all.utilization(stats.all))
+
+	_, err = parseCPUStats(strings.NewReader("intr 1\n"))
+	assert.Error(t, err)
+}
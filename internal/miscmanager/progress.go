@@ -0,0 +1,214 @@
+package miscmanager
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/colinzuo/tunip/pkg/histogram"
+	"github.com/colinzuo/tunip/pkg/logp"
+)
+
+// ProgressConfig describes the live progress reporting of running tests.
+type ProgressConfig struct {
+	Interval int `json:"interval"` // Milliseconds between reports, disabled if 0.
+}
+
+// Progress collects the live statistics of a running test, reported every
+// interval as a terminal status line and a structured log entry. Its methods
+// are safe for concurrent use and do nothing on a nil Progress.
+type Progress struct {
+	started   int64
+	completed int64
+	errors    int64
+	total     int64
+	deadline  int64 // UnixNano, 0 if none.
+
+	mu     sync.Mutex
+	recent *histogram.Histogram // Microseconds, reset every interval.
+}
+
+// SetTotal sets the number of units the test is expected to complete, used
+// to estimate the remaining time.
+func (p *Progress) SetTotal(total int64) {
+	if p != nil {
+		atomic.StoreInt64(&p.total, total)
+	}
+}
+
+// SetDeadline sets when a duration based test ends, used as the estimate of
+// the remaining time if there is no total.
+func (p *Progress) SetDeadline(deadline time.Time) {
+	if p != nil {
+		atomic.StoreInt64(&p.deadline, deadline.UnixNano())
+	}
+}
+
+// Start counts a unit of work as in flight.
+func (p *Progress) Start() {
+	if p != nil {
+		atomic.AddInt64(&p.started, 1)
+	}
+}
+
+// Complete counts a unit started with Start as done after the given latency.
+func (p *Progress) Complete(latency time.Duration, failed bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.recent.Record(latency.Microseconds())
+	p.mu.Unlock()
+	if failed {
+		atomic.AddInt64(&p.errors, 1)
+	}
+	atomic.AddInt64(&p.completed, 1)
+}
+
+// Add counts n units as done, for tests without per unit latency.
+func (p *Progress) Add(n int64) {
+	if p != nil {
+		atomic.AddInt64(&p.started, n)
+		atomic.AddInt64(&p.completed, n)
+	}
+}
+
+// progressReporter reports a Progress every interval until stopped.
+type progressReporter struct {
+	progress *Progress
+	interval time.Duration
+	logger   *logp.Logger
+	out      io.Writer
+	terminal bool // Rewrite a single status line instead of printing lines.
+
+	doneChan chan bool
+	wg       sync.WaitGroup
+
+	start         time.Time
+	lastCompleted int64
+	lastErrors    int64
+}
+
+// startProgress starts reporting a new Progress, nil if disabled.
+func startProgress(config ProgressConfig, logger *logp.Logger) *progressReporter {
+	if config.Interval <= 0 {
+		return nil
+	}
+	r := &progressReporter{
+		progress: &Progress{recent: histogram.New()},
+		interval: time.Duration(config.Interval) * time.Millisecond,
+		logger:   logger.Named("Progress"),
+		out:      os.Stderr,
+		terminal: isTerminal(os.Stderr),
+		doneChan: make(chan bool),
+		start:    time.Now(),
+	}
+	r.wg.Add(1)
+	go r.run()
+	return r
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Progress returns the Progress to update, nil if reporting is disabled.
+func (r *progressReporter) Progress() *Progress {
+	if r == nil {
+		return nil
+	}
+	return r.progress
+}
+
+// Stop stops reporting and clears the status line.
+func (r *progressReporter) Stop() {
+	if r == nil {
+		return
+	}
+	close(r.doneChan)
+	r.wg.Wait()
+	if r.terminal {
+		fmt.Fprint(r.out, "\r\033[K")
+	}
+}
+
+func (r *progressReporter) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	last := r.start
+	for {
+		select {
+		case <-r.doneChan:
+			return
+		case now := <-ticker.C:
+			r.report(now.Sub(last), now)
+			last = now
+		}
+	}
+}
+
+func (r *progressReporter) report(elapsed time.Duration, now time.Time) {
+	p := r.progress
+	completed := atomic.LoadInt64(&p.completed)
+	errors := atomic.LoadInt64(&p.errors)
+	inFlight := atomic.LoadInt64(&p.started) - completed
+	total := atomic.LoadInt64(&p.total)
+	deadline := atomic.LoadInt64(&p.deadline)
+
+	p.mu.Lock()
+	recent := summarize(p.recent)
+	recentCount := p.recent.Count()
+	p.recent.Reset()
+	p.mu.Unlock()
+
+	done := completed - r.lastCompleted
+	rate := float64(done) / elapsed.Seconds()
+	errorRate := 0.0
+	if done > 0 {
+		errorRate = float64(errors-r.lastErrors) / float64(done) * 100
+	}
+	r.lastCompleted, r.lastErrors = completed, errors
+
+	eta := time.Duration(-1)
+	switch {
+	case total > 0 && rate > 0:
+		eta = time.Duration(float64(total-completed) / rate * float64(time.Second))
+	case deadline > 0:
+		eta = time.Unix(0, deadline).Sub(now)
+	}
+	if eta < -1 {
+		eta = 0
+	}
+
+	fields := []interface{}{"elapsed", now.Sub(r.start).Round(time.Second).String(), "completed", completed,
+		"rate", rate, "in_flight", inFlight, "error_rate", errorRate}
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s  done %d", now.Sub(r.start).Round(time.Second), completed)
+	if total > 0 {
+		fmt.Fprintf(&line, "/%d", total)
+		fields = append(fields, "total", total)
+	}
+	fmt.Fprintf(&line, "  %.1f/s  in flight %d  errors %.2f%%", rate, inFlight, errorRate)
+	if recentCount > 0 {
+		fmt.Fprintf(&line, "  p50 %.3fms p99 %.3fms", recent.P50, recent.P99)
+		fields = append(fields, "p50_ms", recent.P50, "p99_ms", recent.P99)
+	}
+	if eta >= 0 {
+		fmt.Fprintf(&line, "  eta %s", eta.Round(time.Second))
+		fields = append(fields, "eta", eta.Round(time.Second).String())
+	}
+
+	r.logger.Infow("Progress", fields...)
+	if r.terminal {
+		fmt.Fprintf(r.out, "\r\033[K%s", line.String())
+	} else {
+		fmt.Fprintln(r.out, line.String())
+	}
+}
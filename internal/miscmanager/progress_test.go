@@ -0,0 +1,76 @@
+package miscmanager
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/colinzuo/tunip/pkg/histogram"
+	"github.com/colinzuo/tunip/pkg/logp"
+)
+
+func TestProgressReport(t *testing.T) {
+	start := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name     string
+		setup    func(p *Progress)
+		now      time.Duration // After start.
+		expected string
+	}{
+		{"total", func(p *Progress) {
+			p.SetTotal(1000)
+			for i := 0; i < 200; i++ {
+				p.Start()
+				p.Complete(2*time.Millisecond, i%10 == 0)
+			}
+			p.Start()
+		}, 10 * time.Second, "10s  done 200/1000  20.0/s  in flight 1  errors 10.00%  p50 2.000ms p99 2.000ms  eta 40s"},
+		{"deadline", func(p *Progress) {
+			p.SetDeadline(start.Add(time.Minute))
+			p.Add(50)
+		}, 10 * time.Second, "10s  done 50  5.0/s  in flight 0  errors 0.00%  eta 50s"},
+		{"past deadline", func(p *Progress) {
+			p.SetDeadline(start.Add(time.Second))
+		}, 10 * time.Second, "10s  done 0  0.0/s  in flight 0  errors 0.00%  eta 0s"},
+		{"no estimate", func(p *Progress) {
+			p.SetTotal(100)
+		}, 10 * time.Second, "10s  done 0/100  0.0/s  in flight 0  errors 0.00%"},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		r := &progressReporter{progress: &Progress{recent: histogram.New()}, logger: logp.NewLogger("progress"),
+			out: &out, start: start}
+		c.setup(r.progress)
+		r.report(c.now, start.Add(c.now))
+		assert.Equal(t, c.expected, strings.TrimSpace(out.String()), c.name)
+	}
+}
+
+func TestProgressRatesAreRecent(t *testing.T) {
+	var out bytes.Buffer
+	start := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	r := &progressReporter{progress: &Progress{recent: histogram.New()}, logger: logp.NewLogger("progress"),
+		out: &out, start: start}
+	p := r.progress
+	for i := 0; i < 10; i++ {
+		p.Start()
+		p.Complete(time.Millisecond, true)
+	}
+	r.report(time.Second, start.Add(time.Second))
+	for i := 0; i < 30; i++ {
+		p.Start()
+		p.Complete(time.Millisecond, false)
+	}
+	out.Reset()
+	r.report(2*time.Second, start.Add(3*time.Second))
+	assert.Equal(t, "3s  done 40  15.0/s  in flight 0  errors 0.00%  p50 1.000ms p99 1.000ms", strings.TrimSpace(out.String()))
+
+	// Nil progress is a no-op.
+	var none *Progress
+	none.Start()
+	none.Complete(time.Second, true)
+	none.Add(1)
+}
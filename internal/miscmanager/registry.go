@@ -0,0 +1,89 @@
+package miscmanager
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/colinzuo/tunip/pkg/logp"
+)
+
+// Test is a misc test. Each test registers a factory with Register, usually
+// from an init function, and is configured by the section of misc.json named
+// after it.
+type Test interface {
+	// Name returns the name of the test, also the key of its section in
+	// misc.json.
+	Name() string
+	// DefaultConfig returns a pointer to the configuration of the test,
+	// initialized with defaults. The section of misc.json is unmarshaled into
+	// it before Validate is called.
+	DefaultConfig() interface{}
+	// Validate checks the configuration.
+	Validate() error
+	// Run runs the test until it is done or ctx is cancelled.
+	Run(ctx context.Context, env *Env) Result
+}
+
+// Env is what the manager provides to a running test.
+type Env struct {
+	Logger       *logp.Logger
+	ServerAddr   string
+	TimeLongForm string
+	Progress     *Progress // nil if progress reporting is disabled.
+}
+
+// Result is the outcome of a test run. Details is specific to each test.
+type Result struct {
+	Name     string        `json:"name"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	Details  interface{}   `json:"details,omitempty"`
+}
+
+// Failed reports whether the test failed.
+func (r Result) Failed() bool {
+	return r.Error != ""
+}
+
+// Factory creates a test.
+type Factory func() Test
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a test available under the name it reports. It panics if
+// the name is already registered.
+func Register(factory Factory) {
+	name := factory().Name()
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, found := registry[name]; found {
+		panic("miscmanager: test registered twice: " + name)
+	}
+	registry[name] = factory
+}
+
+// Tests returns the sorted names of the registered tests.
+func Tests() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookup(name string) (Factory, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	factory, found := registry[name]
+	return factory, found
+}
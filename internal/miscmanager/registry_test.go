@@ -0,0 +1,101 @@
+package miscmanager
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTestConfig struct {
+	Number  int    `json:"number"`
+	Message string `json:"message"`
+}
+
+type fakeTest struct {
+	name   string
+	config fakeTestConfig
+}
+
+func (t *fakeTest) Name() string {
+	return t.name
+}
+
+func (t *fakeTest) DefaultConfig() interface{} {
+	return &t.config
+}
+
+func (t *fakeTest) Validate() error {
+	if t.config.Number <= 0 {
+		return errors.New("number must be positive")
+	}
+	return nil
+}
+
+func (t *fakeTest) Run(ctx context.Context, env *Env) Result {
+	return Result{}
+}
+
+// registerFake registers a fake test, removed when the test ends.
+func registerFake(t *testing.T, name string) {
+	Register(func() Test { return &fakeTest{name: name, config: fakeTestConfig{Number: 10, Message: "default"}} })
+	t.Cleanup(func() {
+		registryMu.Lock()
+		delete(registry, name)
+		registryMu.Unlock()
+	})
+}
+
+func TestRegister(t *testing.T) {
+	registerFake(t, "b_fake_test")
+	registerFake(t, "a_fake_test")
+
+	names := Tests()
+	assert.Contains(t, names, "a_fake_test")
+	assert.Contains(t, names, "b_fake_test")
+	assert.IsIncreasing(t, names)
+	_, found := lookup("a_fake_test")
+	assert.True(t, found)
+
+	assert.Panics(t, func() {
+		Register(func() Test { return &fakeTest{name: "a_fake_test"} })
+	})
+}
+
+func TestNewTest(t *testing.T) {
+	registerFake(t, "fake_test")
+
+	cases := []struct {
+		name     string
+		section  string
+		expected fakeTestConfig
+		err      string
+	}{
+		{"defaults", "", fakeTestConfig{Number: 10, Message: "default"}, ""},
+		{"override", `{"enabled": true, "number": 3}`, fakeTestConfig{Number: 3, Message: "default"}, ""},
+		{"bad json", `{"number": "3"}`, fakeTestConfig{}, "failed to parse config of fake_test"},
+		{"invalid", `{"number": 0}`, fakeTestConfig{}, "invalid config of fake_test"},
+	}
+	for _, c := range cases {
+		config := &Config{Tests: map[string]json.RawMessage{}}
+		if c.section != "" {
+			config.Tests["fake_test"] = json.RawMessage(c.section)
+		}
+		m := &Manager{config: config}
+		test, err := m.newTest("fake_test")
+		if c.err != "" {
+			if assert.Error(t, err, c.name) {
+				assert.Contains(t, err.Error(), c.err, c.name)
+			}
+			continue
+		}
+		if assert.NoError(t, err, c.name) {
+			assert.Equal(t, c.expected, test.(*fakeTest).config, c.name)
+		}
+	}
+
+	_, err := (&Manager{config: &Config{}}).newTest("missing_test")
+	assert.EqualError(t, err, "unknown test 'missing_test'")
+}
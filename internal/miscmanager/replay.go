@@ -0,0 +1,534 @@
+package miscmanager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Capture formats
+const (
+	CaptureJSONL = "jsonl" // One CapturedRequest per line.
+	CaptureHAR   = "har"   // HTTP Archive, as exported by browsers and proxies.
+)
+
+// maxReplayExamples is the number of mismatches kept in the report.
+const maxReplayExamples = 20
+
+// skippedHeaders are recorded headers not replayed, as the transport sets
+// them for the connection it uses.
+var skippedHeaders = map[string]bool{"host": true, "content-length": true, "connection": true,
+	"accept-encoding": true, "transfer-encoding": true}
+
+// ReplayTestConfig traffic replay test config
+type ReplayTestConfig struct {
+	File           string        `json:"file"`
+	Format         string        `json:"format"` // jsonl or har, from the extension of file if empty.
+	Speed          float64       `json:"speed"`  // Of the recorded timing, 2 is twice as fast, 0 as fast as the workers can.
+	MaxWorker      int           `json:"maxworker"`
+	Timeout        int           `json:"timeout"` // Per request, in milliseconds.
+	Rules          []RewriteRule `json:"rules"`
+	FailOnMismatch bool          `json:"fail_on_mismatch"`
+}
+
+// RewriteRule changes the requests whose URL matches before they are
+// replayed. Rules apply in order, after the host is replaced by server_addr
+// if it is set, over http unless it has a scheme.
+type RewriteRule struct {
+	Match   string            `json:"match"`   // Regexp of the URL, every request if empty.
+	Host    string            `json:"host"`    // Replaces the host, with the scheme if it has one.
+	Headers map[string]string `json:"headers"` // Set, or removed if empty.
+
+	match *regexp.Regexp
+}
+
+// CapturedRequest is a recorded request and, if known, its response. In
+// JSONL captures the values of headers are strings or lists of strings.
+type CapturedRequest struct {
+	Time     time.Time         `json:"time"`
+	Method   string            `json:"method"`
+	URL      string            `json:"url"`
+	Headers  http.Header       `json:"headers"`
+	Body     string            `json:"body"`
+	Response *CapturedResponse `json:"response"`
+}
+
+// CapturedResponse is a recorded response. The shape of its body is only
+// compared if the body was recorded.
+type CapturedResponse struct {
+	Status  int    `json:"status"`
+	Body    string `json:"body"`
+	HasBody bool   `json:"-"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *CapturedRequest) UnmarshalJSON(data []byte) error {
+	type capturedRequest CapturedRequest
+	aux := struct {
+		*capturedRequest
+		Headers map[string]json.RawMessage `json:"headers"`
+	}{capturedRequest: (*capturedRequest)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	c.Headers = make(http.Header, len(aux.Headers))
+	for name, raw := range aux.Headers {
+		var value string
+		if err := json.Unmarshal(raw, &value); err == nil {
+			c.Headers.Add(name, value)
+			continue
+		}
+		var values []string
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return errors.Wrapf(err, "header %s", name)
+		}
+		for _, value := range values {
+			c.Headers.Add(name, value)
+		}
+	}
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *CapturedResponse) UnmarshalJSON(data []byte) error {
+	var aux struct {
+		Status int     `json:"status"`
+		Body   *string `json:"body"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*c = CapturedResponse{Status: aux.Status}
+	if aux.Body != nil {
+		c.Body, c.HasBody = *aux.Body, true
+	}
+	return nil
+}
+
+// ReplayMismatch is a response that differs from the recorded one.
+type ReplayMismatch struct {
+	Index          int      `json:"index"` // Of the request in the capture.
+	Method         string   `json:"method"`
+	URL            string   `json:"url"`
+	RecordedStatus int      `json:"recorded_status"`
+	Status         int      `json:"status"`
+	Differences    []string `json:"differences,omitempty"` // Of the shape of the bodies.
+}
+
+// ReplayReport is the outcome of a replay, responses are compared with the
+// recorded ones when there are some.
+type ReplayReport struct {
+	LatencyReport
+	Compared       int64            `json:"compared"`
+	StatusMismatch int64            `json:"status_mismatch"`
+	ShapeMismatch  int64            `json:"shape_mismatch"`
+	Mismatches     []ReplayMismatch `json:"mismatches,omitempty"` // The first ones.
+}
+
+type replayTest struct {
+	config ReplayTestConfig
+}
+
+func init() {
+	Register(func() Test {
+		return &replayTest{config: ReplayTestConfig{Speed: 1, MaxWorker: 10, Timeout: 5000}}
+	})
+}
+
+func (t *replayTest) Name() string {
+	return "replay_test"
+}
+
+func (t *replayTest) DefaultConfig() interface{} {
+	return &t.config
+}
+
+func (t *replayTest) Validate() error {
+	config := &t.config
+	if config.File == "" {
+		return errors.New("file is required")
+	}
+	if config.Format == "" {
+		config.Format = strings.TrimPrefix(strings.ToLower(filepath.Ext(config.File)), ".")
+	}
+	if config.Format != CaptureJSONL && config.Format != CaptureHAR {
+		return errors.Errorf("unsupported format '%s'", config.Format)
+	}
+	if config.Speed < 0 || config.MaxWorker <= 0 || config.Timeout <= 0 {
+		return errors.New("speed must not be negative, maxworker and timeout must be positive")
+	}
+	for i := range config.Rules {
+		match, err := regexp.Compile(config.Rules[i].Match)
+		if err != nil {
+			return errors.Wrapf(err, "rule %d", i)
+		}
+		config.Rules[i].match = match
+	}
+	return nil
+}
+
+func (t *replayTest) Run(ctx context.Context, env *Env) Result {
+	config := t.config
+	captured, err := loadCapture(config.File, config.Format)
+	if err != nil {
+		return Result{Error: err.Error()}
+	}
+	if len(captured) == 0 {
+		return Result{Error: fmt.Sprintf("no requests in %s", config.File)}
+	}
+	env.Logger.Infof("Replaying %d requests of %s at speed %g", len(captured), config.File, config.Speed)
+
+	r := &replayer{captured: captured, speed: config.Speed, serverAddr: env.ServerAddr, rules: config.Rules}
+	perf := &perfTest{replay: r, config: PerfTestConfig{MaxWorker: config.MaxWorker, Number: len(captured),
+		Mode: PerfModeHTTP, HTTP: HTTPLoadConfig{Timeout: config.Timeout}}}
+	recorder, elapsed, err := perf.run(ctx, env)
+	if err != nil {
+		return Result{Error: err.Error()}
+	}
+
+	report := ReplayReport{LatencyReport: recorder.report(elapsed), Compared: r.compared,
+		StatusMismatch: r.statusMismatch, ShapeMismatch: r.shapeMismatch, Mismatches: r.mismatches}
+	logReport(env.Logger, report.LatencyReport)
+	report.Print(os.Stdout)
+
+	result := Result{Details: report}
+	mismatched := report.StatusMismatch + report.ShapeMismatch
+	switch {
+	case ctx.Err() != nil:
+		result.Error = fmt.Sprintf("interrupted after %d responses", report.Count)
+	case config.FailOnMismatch && mismatched > 0:
+		result.Error = fmt.Sprintf("%d of %d responses differ from the recorded ones", mismatched, report.Compared)
+	}
+	return result
+}
+
+// replayer supplies the captured requests to the perf test and compares
+// the responses with the recorded ones.
+type replayer struct {
+	captured   []CapturedRequest // Ordered by time.
+	speed      float64
+	serverAddr string
+	rules      []RewriteRule
+
+	mu             sync.Mutex
+	compared       int64
+	statusMismatch int64
+	shapeMismatch  int64
+	mismatches     []ReplayMismatch
+}
+
+// schedule returns the recorded timing scaled by the speed, nil to send as
+// fast as possible.
+func (r *replayer) schedule() schedule {
+	if r.speed == 0 {
+		return nil
+	}
+	return &replaySchedule{captured: r.captured, speed: r.speed}
+}
+
+type replaySchedule struct {
+	captured []CapturedRequest
+	speed    float64
+}
+
+func (s *replaySchedule) offset(i int) (time.Duration, bool) {
+	if i >= len(s.captured) {
+		return 0, false
+	}
+	return time.Duration(float64(s.captured[i].Time.Sub(s.captured[0].Time)) / s.speed), true
+}
+
+// newRequest returns the i-th captured request, rewritten.
+func (r *replayer) newRequest(ctx context.Context, i int) (*http.Request, error) {
+	c := r.captured[i]
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if r.serverAddr != "" {
+		replaceHost(u, httpBaseURL(r.serverAddr))
+	}
+	headers := c.Headers.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	for _, rule := range r.rules {
+		if rule.match != nil && !rule.match.MatchString(u.String()) {
+			continue
+		}
+		if rule.Host != "" {
+			replaceHost(u, rule.Host)
+		}
+		for name, value := range rule.Headers {
+			headers.Del(name)
+			if value != "" {
+				headers.Set(name, value)
+			}
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, c.Method, u.String(), strings.NewReader(c.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		if !skippedHeaders[strings.ToLower(name)] && !strings.HasPrefix(name, ":") {
+			req.Header[name] = values
+		}
+	}
+	return req, nil
+}
+
+// replaceHost replaces the host of u, and its scheme if host has one.
+func replaceHost(u *url.URL, host string) {
+	if i := strings.Index(host, "://"); i >= 0 {
+		u.Scheme, host = host[:i], host[i+3:]
+	}
+	u.Host = strings.TrimSuffix(host, "/")
+}
+
+// compare compares the response to the i-th request with the recorded one,
+// and reports whether there was one.
+func (r *replayer) compare(i int, status int, body []byte) bool {
+	recorded := r.captured[i].Response
+	if recorded == nil {
+		return false
+	}
+	mismatch := ReplayMismatch{Index: i, Method: r.captured[i].Method, URL: r.captured[i].URL,
+		RecordedStatus: recorded.Status, Status: status}
+	if recorded.HasBody {
+		mismatch.Differences = diffShapes(bodyShape([]byte(recorded.Body)), bodyShape(body))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.compared++
+	if status != recorded.Status {
+		r.statusMismatch++
+	} else if len(mismatch.Differences) > 0 {
+		r.shapeMismatch++
+	} else {
+		return true
+	}
+	if len(r.mismatches) < maxReplayExamples {
+		r.mismatches = append(r.mismatches, mismatch)
+	}
+	return true
+}
+
+// bodyShape returns the paths of the values of a JSON body with their
+// types, elements of arrays sharing the path of the array with []. Bodies
+// that aren't JSON have the single path $ of type text, or empty.
+func bodyShape(body []byte) map[string]string {
+	shape := map[string]string{}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		shape["$"] = "empty"
+		return shape
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		shape["$"] = "text"
+		return shape
+	}
+	addShape("$", v, shape)
+	return shape
+}
+
+func addShape(path string, v interface{}, shape map[string]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		shape[path] = "object"
+		for k, child := range v {
+			addShape(path+"."+k, child, shape)
+		}
+	case []interface{}:
+		shape[path] = "array"
+		for _, child := range v {
+			addShape(path+"[]", child, shape)
+		}
+	case string:
+		shape[path] = "string"
+	case float64:
+		shape[path] = "number"
+	case bool:
+		shape[path] = "bool"
+	default:
+		// null matches any type.
+		if _, found := shape[path]; !found {
+			shape[path] = "null"
+		}
+	}
+}
+
+// diffShapes lists the paths missing, added or of another type in actual.
+// Elements of arrays empty on either side aren't compared.
+func diffShapes(recorded, actual map[string]string) []string {
+	var diffs []string
+	for path, typ := range recorded {
+		if got, found := actual[path]; !found {
+			if !inEmptyArray(path, actual) {
+				diffs = append(diffs, fmt.Sprintf("%s: missing %s", path, typ))
+			}
+		} else if got != typ && got != "null" && typ != "null" {
+			diffs = append(diffs, fmt.Sprintf("%s: %s instead of %s", path, got, typ))
+		}
+	}
+	for path, typ := range actual {
+		if _, found := recorded[path]; !found && !inEmptyArray(path, recorded) {
+			diffs = append(diffs, fmt.Sprintf("%s: unexpected %s", path, typ))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// inEmptyArray reports whether path is below an array without elements in
+// shape.
+func inEmptyArray(path string, shape map[string]string) bool {
+	for i := strings.Index(path, "[]"); i >= 0; {
+		array := path[:i]
+		if _, found := shape[array+"[]"]; shape[array] == "array" && !found {
+			return true
+		}
+		next := strings.Index(path[i+2:], "[]")
+		if next < 0 {
+			break
+		}
+		i += 2 + next
+	}
+	return false
+}
+
+// loadCapture reads the requests of a capture ordered by time.
+func loadCapture(path, format string) ([]CapturedRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open capture")
+	}
+	defer f.Close()
+
+	var captured []CapturedRequest
+	if format == CaptureHAR {
+		captured, err = parseHAR(f)
+	} else {
+		captured, err = parseJSONL(f)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", path)
+	}
+	sort.SliceStable(captured, func(i, j int) bool { return captured[i].Time.Before(captured[j].Time) })
+	return captured, nil
+}
+
+func parseJSONL(r io.Reader) ([]CapturedRequest, error) {
+	var captured []CapturedRequest
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var c CapturedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		if c.Method == "" {
+			c.Method = http.MethodGet
+		}
+		captured = append(captured, c)
+	}
+	return captured, scanner.Err()
+}
+
+// harLog is the part of a HAR file replayed.
+type harLog struct {
+	Log struct {
+		Entries []struct {
+			StartedDateTime time.Time `json:"startedDateTime"`
+			Request         struct {
+				Method   string      `json:"method"`
+				URL      string      `json:"url"`
+				Headers  []harHeader `json:"headers"`
+				PostData *struct {
+					Text string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+			Response struct {
+				Status  int `json:"status"`
+				Content struct {
+					Text     *string `json:"text"`
+					Encoding string  `json:"encoding"`
+				} `json:"content"`
+			} `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func parseHAR(r io.Reader) ([]CapturedRequest, error) {
+	var har harLog
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, err
+	}
+	captured := make([]CapturedRequest, 0, len(har.Log.Entries))
+	for _, entry := range har.Log.Entries {
+		c := CapturedRequest{Time: entry.StartedDateTime, Method: entry.Request.Method, URL: entry.Request.URL,
+			Headers: http.Header{}}
+		for _, h := range entry.Request.Headers {
+			c.Headers.Add(h.Name, h.Value)
+		}
+		if entry.Request.PostData != nil {
+			c.Body = entry.Request.PostData.Text
+		}
+		// Status 0 is a request that got no response.
+		if rsp := entry.Response; rsp.Status > 0 {
+			c.Response = &CapturedResponse{Status: rsp.Status}
+			if text := rsp.Content.Text; text != nil {
+				body := *text
+				if rsp.Content.Encoding == "base64" {
+					decoded, err := base64.StdEncoding.DecodeString(body)
+					if err != nil {
+						return nil, errors.Wrapf(err, "response of %s", c.URL)
+					}
+					body = string(decoded)
+				}
+				c.Response.Body, c.Response.HasBody = body, true
+			}
+		}
+		captured = append(captured, c)
+	}
+	return captured, nil
+}
+
+// Print writes the report as a table.
+func (r ReplayReport) Print(w io.Writer) {
+	r.LatencyReport.Print(w)
+	fmt.Fprintf(w, "compared    %d (%d status mismatch, %d shape mismatch)\n",
+		r.Compared, r.StatusMismatch, r.ShapeMismatch)
+	for _, m := range r.Mismatches {
+		fmt.Fprintf(w, "  #%d %s %s: status %d, recorded %d\n", m.Index, m.Method, m.URL, m.Status, m.RecordedStatus)
+		for _, diff := range m.Differences {
+			fmt.Fprintf(w, "    %s\n", diff)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package miscmanager
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/colinzuo/tunip/pkg/tracing"
+)
+
+func TestParseCaptures(t *testing.T) {
+	jsonl := `{"time": "2021-06-01T10:00:01Z", "url": "http://a.example/b", "response": {"status": 200, "body": "{}"}}
+
+{"time": "2021-06-01T10:00:00Z", "method": "POST", "url": "http://a.example/a", "body": "x", "headers": {"x-id": "1", "Cookie": ["a=1", "b=2"]}, "response": {"status": 204}}
+`
+	captured, err := parseJSONL(strings.NewReader(jsonl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, captured, 2) {
+		assert.Equal(t, http.MethodGet, captured[0].Method)
+		assert.Equal(t, 200, captured[0].Response.Status)
+		assert.True(t, captured[0].Response.HasBody)
+		assert.Equal(t, http.Header{"X-Id": {"1"}, "Cookie": {"a=1", "b=2"}}, captured[1].Headers)
+		assert.False(t, captured[1].Response.HasBody)
+	}
+	_, err = parseJSONL(strings.NewReader(`{"url": "http://a.example", "headers": {"X-Id": 1}}`))
+	assert.Error(t, err)
+
+	har := `{"log": {"entries": [{
+		"startedDateTime": "2021-06-01T10:00:00.000Z",
+		"request": {"method": "PUT", "url": "https://a.example/c",
+			"headers": [{"name": "X-Id", "value": "1"}, {"name": "cookie", "value": "a=1"}, {"name": "cookie", "value": "b=2"}],
+			"postData": {"text": "{\"a\":1}"}},
+		"response": {"status": 201, "content": {"text": "eyJpZCI6MX0=", "encoding": "base64"}}}, {
+		"startedDateTime": "2021-06-01T10:00:01.000Z",
+		"request": {"method": "GET", "url": "https://a.example/d"},
+		"response": {"status": 200, "content": {"size": 0}}}]}}`
+	captured, err = parseHAR(strings.NewReader(har))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, captured, 2) {
+		assert.Equal(t, "PUT", captured[0].Method)
+		assert.Equal(t, http.Header{"X-Id": {"1"}, "Cookie": {"a=1", "b=2"}}, captured[0].Headers)
+		assert.Equal(t, `{"a":1}`, captured[0].Body)
+		assert.Equal(t, `{"id":1}`, captured[0].Response.Body)
+		assert.True(t, captured[0].Response.HasBody)
+		assert.False(t, captured[1].Response.HasBody)
+	}
+}
+
+func TestDiffShapes(t *testing.T) {
+	recorded := bodyShape([]byte(`{"id": 1, "name": "a", "tags": [], "items": [{"n": 1}], "note": null}`))
+	actual := bodyShape([]byte(`{"id": "1", "tags": ["x"], "items": [{"n": 2, "m": true}], "note": "b"}`))
+	assert.Equal(t, []string{
+		"$.id: string instead of number",
+		"$.items[].m: unexpected bool",
+		"$.name: missing string",
+	}, diffShapes(recorded, actual))
+
+	assert.Empty(t, diffShapes(bodyShape([]byte("ok")), bodyShape([]byte("fine"))))
+	assert.Equal(t, []string{"$: empty instead of text"}, diffShapes(bodyShape([]byte("ok")), bodyShape(nil)))
+}
+
+func TestReplayerNewRequest(t *testing.T) {
+	r := &replayer{serverAddr: "localhost:8080", captured: []CapturedRequest{{Method: "POST",
+		URL: "https://prod.example/api/users?id=1", Body: "{}",
+		Headers: http.Header{"Authorization": {"Bearer prod"}, "Host": {"prod.example"}, "X-Id": {"1"},
+			"Cookie": {"a=1", "b=2"}}}},
+		rules: []RewriteRule{
+			{match: regexp.MustCompile("/api/"), Headers: map[string]string{"authorization": "Bearer test", "X-Id": ""}},
+			{match: regexp.MustCompile("/other/"), Host: "unused"},
+		}}
+	req, err := r.newRequest(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "http://localhost:8080/api/users?id=1", req.URL.String())
+	assert.Equal(t, "Bearer test", req.Header.Get("Authorization"))
+	assert.Empty(t, req.Header.Get("X-Id"))
+	assert.Empty(t, req.Header.Get("Host"))
+	assert.Equal(t, []string{"a=1", "b=2"}, req.Header.Values("Cookie"))
+	assert.Equal(t, []string{"Bearer prod"}, r.captured[0].Headers.Values("Authorization"))
+
+	r.rules = []RewriteRule{{Host: "http://staging.example:81"}}
+	req, err = r.newRequest(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "http://staging.example:81/api/users?id=1", req.URL.String())
+}
+
+func TestReplayCompare(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fmt.Fprintf(w, `{"path": %q}`, req.URL.Path)
+	}))
+	defer server.Close()
+
+	r := &replayer{captured: []CapturedRequest{
+		{Method: "GET", URL: server.URL + "/same", Response: &CapturedResponse{Status: 200, Body: `{"path": "x"}`, HasBody: true}},
+		{Method: "GET", URL: server.URL + "/missing", Response: &CapturedResponse{Status: 200, Body: `{"path": "x"}`, HasBody: true}},
+		{Method: "GET", URL: server.URL + "/shape", Response: &CapturedResponse{Status: 200, Body: `{"id": 1}`, HasBody: true}},
+		{Method: "GET", URL: server.URL + "/no_body", Response: &CapturedResponse{Status: 200}},
+		{Method: "GET", URL: server.URL + "/unrecorded"},
+	}}
+	for i := range r.captured {
+		req, err := r.newRequest(context.Background(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, r.captured[i].Response != nil, r.compare(i, rsp.StatusCode, body))
+	}
+	assert.Equal(t, int64(4), r.compared)
+	assert.Equal(t, int64(1), r.statusMismatch)
+	assert.Equal(t, int64(1), r.shapeMismatch)
+	if assert.Len(t, r.mismatches, 2) {
+		assert.Equal(t, 404, r.mismatches[0].Status)
+		assert.Equal(t, []string{"$.id: missing number", "$.path: unexpected string"}, r.mismatches[1].Differences)
+	}
+}
+
+func TestReplayDoHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	r := &replayer{captured: []CapturedRequest{
+		{Method: "GET", URL: server.URL + "/error"},
+		{Method: "GET", URL: server.URL + "/ok"},
+		{Method: "GET", URL: server.URL + "/error", Response: &CapturedResponse{Status: 500}},
+	}}
+	m := &perfTest{replay: r, client: tracing.NewHTTPClient(time.Second)}
+	for i, errCode := range []int{ErrCodeHTTPErr, ErrCodeOk, ErrCodeOk} {
+		var status int
+		rsp := m.doHTTP(context.Background(), HTTPWorkerReq{Index: i}, &status)
+		assert.Equal(t, errCode, rsp.ErrCode, i)
+	}
+	assert.Equal(t, int64(1), r.compared)
+	assert.Zero(t, r.statusMismatch)
+}
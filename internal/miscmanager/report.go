@@ -0,0 +1,356 @@
+package miscmanager
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Report formats
+const (
+	ReportJSON = "json"
+	ReportCSV  = "csv"
+	ReportHTML = "html"
+)
+
+// Report is the record of a test run written to the report files.
+type Report struct {
+	Result
+	Config      interface{} `json:"config"`
+	Environment Environment `json:"environment"`
+}
+
+// Environment describes where a test ran.
+type Environment struct {
+	Hostname   string `json:"hostname"`
+	GOOS       string `json:"goos"`
+	GOARCH     string `json:"goarch"`
+	NumCPU     int    `json:"num_cpu"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	GoVersion  string `json:"go_version"`
+	ServerAddr string `json:"server_addr,omitempty"`
+}
+
+func currentEnvironment(serverAddr string) Environment {
+	hostname, _ := os.Hostname()
+	return Environment{
+		Hostname:   hostname,
+		GOOS:       runtime.GOOS,
+		GOARCH:     runtime.GOARCH,
+		NumCPU:     runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		GoVersion:  runtime.Version(),
+		ServerAddr: serverAddr,
+	}
+}
+
+// LoadReport reads a report written in the json format.
+func LoadReport(path string) (*Report, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var report Report
+	if err := json.Unmarshal(content, &report); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse report %s", path)
+	}
+	return &report, nil
+}
+
+// Metrics returns the numbers in the details of the report keyed by their
+// dotted path, e.g. latency.p99_ms. The timeline and histogram are left out.
+func (r *Report) Metrics() map[string]float64 {
+	metrics := map[string]float64{}
+	content, err := json.Marshal(r.Details)
+	if err != nil {
+		return metrics
+	}
+	var generic interface{}
+	if err := json.Unmarshal(content, &generic); err != nil {
+		return metrics
+	}
+	flatten("", generic, metrics)
+	return metrics
+}
+
+// unflattened are the detail keys that aren't metrics.
+var unflattened = map[string]bool{"timeline": true, "latency_histogram": true}
+
+func flatten(prefix string, v interface{}, metrics map[string]float64) {
+	switch v := v.(type) {
+	case float64:
+		metrics[prefix] = v
+	case map[string]interface{}:
+		for k, child := range v {
+			if prefix == "" && unflattened[k] {
+				continue
+			}
+			if prefix != "" {
+				k = prefix + "." + k
+			}
+			flatten(k, child, metrics)
+		}
+	}
+}
+
+// timeline returns the timeline of a LatencyReport, whether the report was
+// just produced or loaded from a file.
+func (r *Report) timeline() []TimelinePoint {
+	switch details := r.Details.(type) {
+	case LatencyReport:
+		return details.Timeline
+	case *LatencyReport:
+		return details.Timeline
+	}
+	content, err := json.Marshal(r.Details)
+	if err != nil {
+		return nil
+	}
+	var decoded struct {
+		Timeline []TimelinePoint `json:"timeline"`
+	}
+	json.Unmarshal(content, &decoded)
+	return decoded.Timeline
+}
+
+// writeReports writes the report in the configured formats and returns the
+// paths of the files written.
+func writeReports(config ReportConfig, report *Report) ([]string, error) {
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create report dir")
+	}
+	formats := config.Formats
+	if len(formats) == 0 {
+		formats = []string{ReportJSON, ReportCSV, ReportHTML}
+	}
+	base := uniqueReportBase(filepath.Join(config.Dir, report.Name+"-"+report.Start.Format("20060102-150405.000")), formats)
+
+	var paths []string
+	for _, format := range formats {
+		var err error
+		switch format {
+		case ReportJSON:
+			err = writeFile(base+".json", &paths, func(f *os.File) error {
+				enc := json.NewEncoder(f)
+				enc.SetIndent("", "    ")
+				return enc.Encode(report)
+			})
+		case ReportCSV:
+			err = writeFile(base+".csv", &paths, func(f *os.File) error { return writeMetricsCSV(f, report) })
+			if timeline := report.timeline(); err == nil && len(timeline) > 0 {
+				err = writeFile(base+"-timeline.csv", &paths, func(f *os.File) error { return writeTimelineCSV(f, timeline) })
+			}
+		case ReportHTML:
+			err = writeFile(base+".html", &paths, func(f *os.File) error { return writeHTML(f, report) })
+		default:
+			err = errors.Errorf("unsupported report format '%s'", format)
+		}
+		if err != nil {
+			return paths, err
+		}
+	}
+	return paths, nil
+}
+
+// uniqueReportBase returns base, or base with the first numeric suffix, such
+// that no report of the formats exists yet, so runs started within the same
+// millisecond don't overwrite each other's reports.
+func uniqueReportBase(base string, formats []string) string {
+	candidate := base
+	for i := 2; ; i++ {
+		exists := false
+		for _, format := range formats {
+			if _, err := os.Stat(candidate + "." + format); err == nil {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+func writeFile(path string, paths *[]string, write func(f *os.File) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to create report")
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to write report %s", path)
+	}
+	*paths = append(*paths, path)
+	return nil
+}
+
+func sortedMetrics(metrics map[string]float64) []string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func writeMetricsCSV(f *os.File, report *Report) error {
+	w := csv.NewWriter(f)
+	w.Write([]string{"metric", "value"})
+	w.Write([]string{"duration_s", formatMetric(report.Duration.Seconds())})
+	metrics := report.Metrics()
+	for _, name := range sortedMetrics(metrics) {
+		w.Write([]string{name, formatMetric(metrics[name])})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func writeTimelineCSV(f *os.File, timeline []TimelinePoint) error {
+	w := csv.NewWriter(f)
+	w.Write([]string{"second", "count", "errors", "p50_ms", "p90_ms", "p99_ms", "max_ms"})
+	for _, p := range timeline {
+		w.Write([]string{strconv.Itoa(p.Second), strconv.FormatInt(p.Count, 10), strconv.FormatInt(p.Errors, 10),
+			formatMetric(p.P50), formatMetric(p.P90), formatMetric(p.P99), formatMetric(p.Max)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// chart is a line chart rendered as inline SVG.
+type chart struct {
+	Title  string
+	Unit   string
+	Max    float64
+	Width  int
+	Height int
+	Series []chartSeries
+}
+
+type chartSeries struct {
+	Name   string
+	Color  string
+	Points string // SVG polyline points.
+}
+
+const (
+	chartWidth  = 800
+	chartHeight = 240
+)
+
+func newChart(title, unit string, timeline []TimelinePoint, names, colors []string, values func(p TimelinePoint) []float64) chart {
+	c := chart{Title: title, Unit: unit, Width: chartWidth, Height: chartHeight}
+	for _, p := range timeline {
+		for _, v := range values(p) {
+			if v > c.Max {
+				c.Max = v
+			}
+		}
+	}
+	if c.Max == 0 {
+		c.Max = 1
+	}
+	xScale := float64(chartWidth)
+	if len(timeline) > 1 {
+		xScale = float64(chartWidth) / float64(len(timeline)-1)
+	}
+	for i, name := range names {
+		points := make([]string, 0, len(timeline))
+		for j, p := range timeline {
+			y := float64(chartHeight) - values(p)[i]/c.Max*float64(chartHeight)
+			points = append(points, fmt.Sprintf("%.1f,%.1f", float64(j)*xScale, y))
+		}
+		c.Series = append(c.Series, chartSeries{Name: name, Color: colors[i], Points: strings.Join(points, " ")})
+	}
+	return c
+}
+
+type htmlData struct {
+	Report  *Report
+	Metrics [][2]string
+	Config  string
+	Charts  []chart
+}
+
+func writeHTML(f *os.File, report *Report) error {
+	data := htmlData{Report: report}
+	metrics := report.Metrics()
+	for _, name := range sortedMetrics(metrics) {
+		data.Metrics = append(data.Metrics, [2]string{name, formatMetric(metrics[name])})
+	}
+	config, _ := json.MarshalIndent(report.Config, "", "    ")
+	data.Config = string(config)
+
+	if timeline := report.timeline(); len(timeline) > 0 {
+		data.Charts = append(data.Charts,
+			newChart("Latency over time", "ms", timeline,
+				[]string{"p50", "p90", "p99", "max"}, []string{"#2b8a3e", "#1971c2", "#e8590c", "#c92a2a"},
+				func(p TimelinePoint) []float64 { return []float64{p.P50, p.P90, p.P99, p.Max} }),
+			newChart("Throughput and errors", "per second", timeline,
+				[]string{"responses", "errors"}, []string{"#1971c2", "#c92a2a"},
+				func(p TimelinePoint) []float64 { return []float64{float64(p.Count), float64(p.Errors)} }))
+	}
+	return htmlTemplate.Execute(f, data)
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Report.Name}} {{.Report.Start.Format "2006-01-02 15:04:05"}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #212529; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td, th { border: 1px solid #dee2e6; padding: 4px 10px; text-align: left; }
+td.num { text-align: right; font-family: monospace; }
+svg { border: 1px solid #dee2e6; background: #f8f9fa; }
+.error { color: #c92a2a; font-weight: bold; }
+pre { background: #f8f9fa; padding: 1em; }
+</style>
+</head>
+<body>
+<h1>{{.Report.Name}}</h1>
+<p>Started {{.Report.Start.Format "2006-01-02 15:04:05 -07:00"}}, ran for {{.Report.Duration}}.</p>
+{{if .Report.Error}}<p class="error">Failed: {{.Report.Error}}</p>{{end}}
+{{range .Charts}}
+<h2>{{.Title}}</h2>
+<svg width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}">
+{{range .Series}}<polyline fill="none" stroke="{{.Color}}" stroke-width="1.5" points="{{.Points}}"/>
+{{end}}</svg>
+<p>{{range .Series}}<span style="color: {{.Color}}">&#9632; {{.Name}}</span> {{end}}&mdash; y axis 0 to {{printf "%.3f" .Max}} {{.Unit}}, x axis seconds since start</p>
+{{end}}
+<h2>Metrics</h2>
+<table>
+<tr><th>metric</th><th>value</th></tr>
+{{range .Metrics}}<tr><td>{{index . 0}}</td><td class="num">{{index . 1}}</td></tr>
+{{end}}</table>
+<h2>Environment</h2>
+<table>
+<tr><td>hostname</td><td>{{.Report.Environment.Hostname}}</td></tr>
+<tr><td>platform</td><td>{{.Report.Environment.GOOS}}/{{.Report.Environment.GOARCH}}</td></tr>
+<tr><td>cpus</td><td>{{.Report.Environment.NumCPU}} (GOMAXPROCS {{.Report.Environment.GOMAXPROCS}})</td></tr>
+<tr><td>go</td><td>{{.Report.Environment.GoVersion}}</td></tr>
+{{if .Report.Environment.ServerAddr}}<tr><td>server</td><td>{{.Report.Environment.ServerAddr}}</td></tr>{{end}}
+</table>
+<h2>Configuration</h2>
+<pre>{{.Config}}</pre>
+</body>
+</html>
+`))
@@ -0,0 +1,109 @@
+package miscmanager
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/colinzuo/tunip/pkg/histogram"
+)
+
+func TestReportMetrics(t *testing.T) {
+	report := &Report{Result: Result{Details: map[string]interface{}{
+		"count":    10,
+		"latency":  LatencySummary{P50: 1.5, P99: 3},
+		"results":  map[string]interface{}{"tcp_64": map[string]interface{}{"failed": 2}},
+		"name":     "not a number",
+		"timeline": []TimelinePoint{{Second: 1, Count: 5}},
+		// Skipped at the top level only.
+		"latency_histogram": map[string]interface{}{"count": 3},
+		"nested":            map[string]interface{}{"timeline": 1},
+	}}}
+	metrics := report.Metrics()
+	assert.Equal(t, 10.0, metrics["count"])
+	assert.Equal(t, 1.5, metrics["latency.p50_ms"])
+	assert.Equal(t, 3.0, metrics["latency.p99_ms"])
+	assert.Equal(t, 2.0, metrics["results.tcp_64.failed"])
+	assert.Equal(t, 1.0, metrics["nested.timeline"])
+	for name := range metrics {
+		assert.False(t, strings.HasPrefix(name, "timeline") || strings.HasPrefix(name, "latency_histogram"), name)
+		assert.NotEqual(t, "name", name)
+	}
+}
+
+func TestWriteReports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := histogram.New()
+	h.Record(1500)
+	start := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	report := &Report{
+		Result: Result{Name: perfTestName, Start: start, Duration: 2 * time.Second, Error: "interrupted <early>",
+			Details: LatencyReport{Count: 10, Failed: 1, Throughput: 5, Latency: LatencySummary{P99: 2.5},
+				Timeline:  []TimelinePoint{{Second: 0, Count: 4, P50: 1}, {Second: 1, Count: 6, Errors: 1, P50: 2}},
+				Histogram: h}},
+		Config:      map[string]int{"maxworker": 4},
+		Environment: currentEnvironment("localhost:8080"),
+	}
+	paths, err := writeReports(ReportConfig{Dir: dir}, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, "perf_test-20210601-100000.000")
+	assert.Equal(t, []string{base + ".json", base + ".csv", base + "-timeline.csv", base + ".html"}, paths)
+
+	// Another run started at the same time doesn't overwrite the reports.
+	paths, err = writeReports(ReportConfig{Dir: dir, Formats: []string{ReportJSON}}, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{base + "-2.json"}, paths)
+
+	loaded, err := LoadReport(base + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, report.Name, loaded.Name)
+	assert.Equal(t, report.Metrics(), loaded.Metrics())
+	assert.Len(t, loaded.timeline(), 2)
+
+	rows := readCSV(t, base+".csv")
+	assert.Equal(t, []string{"metric", "value"}, rows[0])
+	assert.Equal(t, []string{"duration_s", "2"}, rows[1])
+	assert.Contains(t, rows, []string{"latency.p99_ms", "2.5"})
+	assert.Contains(t, rows, []string{"failed", "1"})
+
+	rows = readCSV(t, base+"-timeline.csv")
+	assert.Equal(t, []string{"1", "6", "1", "2", "0", "0", "0"}, rows[2])
+
+	html, _ := ioutil.ReadFile(base + ".html")
+	assert.Contains(t, string(html), "<polyline")
+	assert.Contains(t, string(html), "interrupted &lt;early&gt;", "escaped")
+	assert.Contains(t, string(html), "latency.p99_ms")
+
+	_, err = writeReports(ReportConfig{Dir: dir, Formats: []string{"pdf"}}, report)
+	assert.Error(t, err)
+}
+
+func readCSV(t *testing.T, path string) [][]string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
@@ -0,0 +1,136 @@
+package miscmanager
+
+import (
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Load profile types
+const (
+	ProfileClosed   = "closed"   // Send as fast as the workers accept requests.
+	ProfileConstant = "constant" // Send at a fixed rate.
+	ProfileRamp     = "ramp"     // Change the rate linearly over the duration.
+	ProfileSteps    = "steps"    // Send at the rate of each step in turn.
+)
+
+// LoadProfileConfig describes when requests are sent. Open-loop profiles
+// (all but closed) schedule every request, and its latency is measured from
+// its scheduled time, so a slow server isn't hidden by a generator that
+// waits for it.
+type LoadProfileConfig struct {
+	Type  string           `json:"type"`
+	Rate  float64          `json:"rate"` // Requests per second, constant only.
+	From  float64          `json:"from"` // Initial rate, ramp only.
+	To    float64          `json:"to"`   // Final rate, ramp only.
+	Steps []LoadStepConfig `json:"steps"`
+}
+
+// LoadStepConfig is one stage of the steps profile.
+type LoadStepConfig struct {
+	Rate     float64 `json:"rate"`
+	Duration int     `json:"duration"` // Milliseconds.
+}
+
+// schedule gives the intended send time of each request.
+type schedule interface {
+	// offset returns when request i is to be sent relative to the start,
+	// and false once the schedule has no more requests.
+	offset(i int) (time.Duration, bool)
+}
+
+func (c *LoadProfileConfig) validate(duration time.Duration) error {
+	switch c.Type {
+	case ProfileClosed:
+	case ProfileConstant:
+		if c.Rate <= 0 {
+			return errors.New("profile.rate must be positive")
+		}
+	case ProfileRamp:
+		if c.From < 0 || c.To < 0 || c.From+c.To == 0 {
+			return errors.New("profile.from and profile.to must not be negative nor both zero")
+		}
+		if duration <= 0 {
+			return errors.New("ramp profile requires a duration")
+		}
+	case ProfileSteps:
+		if len(c.Steps) == 0 {
+			return errors.New("steps profile requires steps")
+		}
+		for i, step := range c.Steps {
+			if step.Rate < 0 || step.Duration <= 0 {
+				return errors.Errorf("step %d needs a positive duration and a rate not negative", i)
+			}
+		}
+	default:
+		return errors.Errorf("unsupported profile type '%s'", c.Type)
+	}
+	return nil
+}
+
+// newSchedule returns the schedule of an open-loop profile, nil for closed.
+func (c *LoadProfileConfig) newSchedule(duration time.Duration) schedule {
+	switch c.Type {
+	case ProfileConstant:
+		return &constantSchedule{rate: c.Rate, duration: duration}
+	case ProfileRamp:
+		return &rampSchedule{from: c.From, to: c.To, duration: duration}
+	case ProfileSteps:
+		return &stepSchedule{steps: c.Steps}
+	}
+	return nil
+}
+
+type constantSchedule struct {
+	rate     float64
+	duration time.Duration // Unlimited if 0.
+}
+
+func (s *constantSchedule) offset(i int) (time.Duration, bool) {
+	off := seconds(float64(i) / s.rate)
+	return off, s.duration == 0 || off < s.duration
+}
+
+// rampSchedule sends at a rate going linearly from from to to. The number of
+// requests sent by t is from*t + (to-from)*t²/(2*duration), solved for t.
+type rampSchedule struct {
+	from, to float64
+	duration time.Duration
+}
+
+func (s *rampSchedule) offset(i int) (time.Duration, bool) {
+	d := s.duration.Seconds()
+	n := float64(i)
+	if n >= (s.from+s.to)*d/2 {
+		return s.duration, false
+	}
+	k := (s.to - s.from) / d
+	if k == 0 {
+		return seconds(n / s.from), true
+	}
+	return seconds((math.Sqrt(s.from*s.from+2*k*n) - s.from) / k), true
+}
+
+type stepSchedule struct {
+	steps []LoadStepConfig
+}
+
+func (s *stepSchedule) offset(i int) (time.Duration, bool) {
+	var start time.Duration
+	n := float64(i)
+	for _, step := range s.steps {
+		duration := time.Duration(step.Duration) * time.Millisecond
+		count := step.Rate * duration.Seconds()
+		if n < count {
+			return start + seconds(n/step.Rate), true
+		}
+		n -= count
+		start += duration
+	}
+	return start, false
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
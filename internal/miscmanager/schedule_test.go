@@ -0,0 +1,70 @@
+package miscmanager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// count returns the number of requests a schedule sends and the offset of
+// the last one.
+func count(s schedule) (int, time.Duration) {
+	var last time.Duration
+	for i := 0; ; i++ {
+		off, ok := s.offset(i)
+		if !ok {
+			return i, last
+		}
+		last = off
+	}
+}
+
+func TestConstantSchedule(t *testing.T) {
+	s := &constantSchedule{rate: 100, duration: 2 * time.Second}
+	off, ok := s.offset(50)
+	assert.True(t, ok)
+	assert.Equal(t, 500*time.Millisecond, off)
+
+	n, last := count(s)
+	assert.Equal(t, 200, n)
+	assert.Equal(t, 1990*time.Millisecond, last)
+
+	_, ok = (&constantSchedule{rate: 100}).offset(1000000)
+	assert.True(t, ok, "no duration is unlimited")
+}
+
+func TestRampSchedule(t *testing.T) {
+	s := &rampSchedule{from: 0, to: 200, duration: 10 * time.Second}
+	n, last := count(s)
+	assert.Equal(t, 1000, n)
+	assert.True(t, last < 10*time.Second)
+
+	// Half the requests of a ramp from 0 are sent after 1/sqrt(2) of it.
+	off, _ := s.offset(500)
+	assert.InDelta(t, 7.071, off.Seconds(), 0.001)
+
+	down := &rampSchedule{from: 200, to: 0, duration: 10 * time.Second}
+	n, _ = count(down)
+	assert.Equal(t, 1000, n)
+	off, _ = down.offset(500)
+	assert.InDelta(t, 10-7.071, off.Seconds(), 0.001)
+
+	flat := &rampSchedule{from: 10, to: 10, duration: time.Second}
+	n, _ = count(flat)
+	assert.Equal(t, 10, n)
+}
+
+func TestStepSchedule(t *testing.T) {
+	s := &stepSchedule{steps: []LoadStepConfig{
+		{Rate: 10, Duration: 1000},
+		{Rate: 0, Duration: 500},
+		{Rate: 100, Duration: 100},
+	}}
+	n, last := count(s)
+	assert.Equal(t, 20, n)
+	assert.Equal(t, 1590*time.Millisecond, last)
+
+	off, _ := s.offset(10)
+	assert.Equal(t, 1500*time.Millisecond, off)
+}
@@ -1,17 +1,46 @@
 package miscmanager
 
 import (
+	"context"
+
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 )
 
-func (m *Manager) viperTest() {
-	logger := m.logger
-	config := m.config.ViperTest
+// ViperTestConfig viper test config
+type ViperTestConfig struct {
+	Key string `json:"key"`
+}
+
+type viperTest struct {
+	config ViperTestConfig
+}
+
+func init() {
+	Register(func() Test { return &viperTest{} })
+}
+
+func (t *viperTest) Name() string {
+	return "viper_test"
+}
+
+func (t *viperTest) DefaultConfig() interface{} {
+	return &t.config
+}
+
+func (t *viperTest) Validate() error {
+	if t.config.Key == "" {
+		return errors.New("key is required")
+	}
+	return nil
+}
 
-	logger.Infof("Enter viperTest with config: %+v", config)
-	defer logger.Info("Leave viperTest")
+func (t *viperTest) Run(ctx context.Context, env *Env) Result {
+	logger := env.Logger
+	config := t.config
 
 	value := viper.GetString(config.Key)
 
 	logger.Infof("Key %s has value %s", config.Key, value)
+	return Result{Details: map[string]string{config.Key: value}}
 }
@@ -0,0 +1,220 @@
+// Package histogram implements an HDR-style histogram of non-negative int64
+// values. Buckets are log-linear: values below 256 are counted exactly and
+// larger ones in buckets whose width is under 1% of their value, so memory
+// stays small for any range while percentiles keep two significant digits.
+//
+// A Histogram is not safe for concurrent use.
+package histogram
+
+import (
+	"encoding/json"
+	"math"
+	"math/bits"
+)
+
+const (
+	subBucketBits  = 8
+	subBucketCount = 1 << subBucketBits // Exact values and sub-buckets per bucket.
+	subBucketHalf  = subBucketCount / 2
+)
+
+// Histogram counts recorded values.
+type Histogram struct {
+	counts []int64
+	total  int64
+	min    int64
+	max    int64
+	sum    float64
+}
+
+// New returns an empty Histogram.
+func New() *Histogram {
+	return &Histogram{}
+}
+
+func index(v int64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - subBucketBits
+	sub := int(v >> uint(shift))
+	return subBucketCount + (shift-1)*subBucketHalf + sub - subBucketHalf
+}
+
+// lowest returns the smallest value counted at index i.
+func lowest(i int) int64 {
+	if i < subBucketCount {
+		return int64(i)
+	}
+	i -= subBucketCount
+	shift := i/subBucketHalf + 1
+	sub := int64(i%subBucketHalf + subBucketHalf)
+	return sub << uint(shift)
+}
+
+// highest returns the largest value counted at index i.
+func highest(i int) int64 {
+	if i < subBucketCount {
+		return int64(i)
+	}
+	shift := (i-subBucketCount)/subBucketHalf + 1
+	return lowest(i) + 1<<uint(shift) - 1
+}
+
+// Record counts one value. Negative values are counted as 0.
+func (h *Histogram) Record(v int64) {
+	h.RecordN(v, 1)
+}
+
+// RecordN counts n occurrences of a value.
+func (h *Histogram) RecordN(v int64, n int64) {
+	if n <= 0 {
+		return
+	}
+	if v < 0 {
+		v = 0
+	}
+	i := index(v)
+	if i >= len(h.counts) {
+		counts := make([]int64, i+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[i] += n
+	if h.total == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.total += n
+	h.sum += float64(v) * float64(n)
+}
+
+// Merge adds the counts of other.
+func (h *Histogram) Merge(other *Histogram) {
+	if other.total == 0 {
+		return
+	}
+	if len(other.counts) > len(h.counts) {
+		counts := make([]int64, len(other.counts))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+	if h.total == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+	h.total += other.total
+	h.sum += other.sum
+}
+
+// Reset removes all values.
+func (h *Histogram) Reset() {
+	*h = Histogram{}
+}
+
+// Count returns the number of recorded values.
+func (h *Histogram) Count() int64 {
+	return h.total
+}
+
+// Min returns the smallest recorded value, 0 if empty.
+func (h *Histogram) Min() int64 {
+	return h.min
+}
+
+// Max returns the largest recorded value, 0 if empty.
+func (h *Histogram) Max() int64 {
+	return h.max
+}
+
+// Mean returns the mean of the recorded values, 0 if empty.
+func (h *Histogram) Mean() float64 {
+	if h.total == 0 {
+		return 0
+	}
+	return h.sum / float64(h.total)
+}
+
+// ValueAtPercentile returns the value below or equal to which the given
+// percentage of the values fall, with the precision of its bucket.
+func (h *Histogram) ValueAtPercentile(percentile float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+	if percentile > 100 {
+		percentile = 100
+	}
+	target := int64(math.Ceil(percentile / 100 * float64(h.total)))
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= target {
+			v := highest(i)
+			if v > h.max {
+				v = h.max
+			}
+			if v < h.min {
+				v = h.min
+			}
+			return v
+		}
+	}
+	return h.max
+}
+
+// Bucket is a non-empty bucket of a Histogram, identified by the smallest
+// value it counts.
+type Bucket struct {
+	Value int64 `json:"v"`
+	Count int64 `json:"n"`
+}
+
+// Buckets returns the non-empty buckets in increasing order.
+func (h *Histogram) Buckets() []Bucket {
+	var buckets []Bucket
+	for i, n := range h.counts {
+		if n > 0 {
+			buckets = append(buckets, Bucket{Value: lowest(i), Count: n})
+		}
+	}
+	return buckets
+}
+
+type histogramJSON struct {
+	Min     int64    `json:"min"`
+	Max     int64    `json:"max"`
+	Sum     float64  `json:"sum"`
+	Buckets []Bucket `json:"buckets"`
+}
+
+// MarshalJSON encodes the histogram losslessly, so that histograms recorded
+// in different processes can be merged.
+func (h *Histogram) MarshalJSON() ([]byte, error) {
+	return json.Marshal(histogramJSON{Min: h.min, Max: h.max, Sum: h.sum, Buckets: h.Buckets()})
+}
+
+// UnmarshalJSON decodes a histogram encoded by MarshalJSON.
+func (h *Histogram) UnmarshalJSON(data []byte) error {
+	var decoded histogramJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	h.Reset()
+	for _, b := range decoded.Buckets {
+		h.RecordN(b.Value, b.Count)
+	}
+	if h.total > 0 {
+		h.min, h.max, h.sum = decoded.Min, decoded.Max, decoded.Sum
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package histogram
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexRoundTrip(t *testing.T) {
+	for _, v := range []int64{0, 1, 255, 256, 257, 511, 512, 1000, 123456, 1 << 40, 1<<62 + 12345} {
+		i := index(v)
+		assert.True(t, lowest(i) <= v && v <= highest(i), "value %d index %d [%d, %d]", v, i, lowest(i), highest(i))
+		if v >= subBucketCount {
+			assert.True(t, float64(highest(i)-lowest(i)) < 0.01*float64(v), "value %d bucket too wide", v)
+		}
+	}
+	for i := 1; i < 2000; i++ {
+		assert.Equal(t, highest(i-1)+1, lowest(i), "gap at index %d", i)
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	h := New()
+	for v := int64(1); v <= 10000; v++ {
+		h.Record(v)
+	}
+	assert.Equal(t, int64(10000), h.Count())
+	assert.Equal(t, int64(1), h.Min())
+	assert.Equal(t, int64(10000), h.Max())
+	assert.InDelta(t, 5000.5, h.Mean(), 0.001)
+	assert.InEpsilon(t, 5000, h.ValueAtPercentile(50), 0.01)
+	assert.InEpsilon(t, 9900, h.ValueAtPercentile(99), 0.01)
+	assert.InEpsilon(t, 9990, h.ValueAtPercentile(99.9), 0.01)
+	assert.Equal(t, int64(10000), h.ValueAtPercentile(100))
+	assert.Equal(t, int64(1), h.ValueAtPercentile(0))
+
+	assert.Equal(t, int64(0), New().ValueAtPercentile(50))
+}
+
+func TestMergeAndJSON(t *testing.T) {
+	a, b := New(), New()
+	for v := int64(0); v < 1000; v++ {
+		a.Record(v * 7)
+		b.RecordN(v*13, 2)
+	}
+	merged := New()
+	merged.Merge(a)
+	merged.Merge(b)
+	assert.Equal(t, int64(3000), merged.Count())
+	assert.Equal(t, int64(0), merged.Min())
+	assert.Equal(t, int64(999*13), merged.Max())
+
+	data, err := json.Marshal(merged)
+	assert.NoError(t, err)
+	decoded := New()
+	assert.NoError(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, merged.Count(), decoded.Count())
+	assert.Equal(t, merged.Min(), decoded.Min())
+	assert.Equal(t, merged.Max(), decoded.Max())
+	assert.Equal(t, merged.Mean(), decoded.Mean())
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		assert.Equal(t, merged.ValueAtPercentile(p), decoded.ValueAtPercentile(p))
+	}
+}
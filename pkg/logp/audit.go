@@ -0,0 +1,376 @@
+package logp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AuditConfig contains the configuration options for the audit log.
+type AuditConfig struct {
+	Enabled bool   `json:"enabled"`
+	Path    string `json:"path"` // Audit log file, defaults to <files.path>/<name>.audit.
+	Key     string `json:"key"`  // HMAC key used to chain records.
+}
+
+// placeholderAuditKeys are example keys that must be replaced before the
+// audit log is enabled.
+var placeholderAuditKeys = map[string]bool{"change-me": true, "changeme": true}
+
+// Validate checks that an enabled audit log has a real key.
+func (c AuditConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Key == "" {
+		return errors.New("audit log requires a key")
+	}
+	if placeholderAuditKeys[strings.ToLower(c.Key)] {
+		return errors.Errorf("audit key '%s' is a placeholder, set a secret key", c.Key)
+	}
+	return nil
+}
+
+// AuditRecord is one line of the audit log. Hash is the hex encoded
+// HMAC-SHA256 of the record encoded with an empty Hash, so every record is
+// chained to the previous one through Prev.
+type AuditRecord struct {
+	Seq       uint64          `json:"seq"`
+	Timestamp string          `json:"timestamp"`
+	Type      string          `json:"type"`
+	Event     json.RawMessage `json:"event,omitempty"`
+	Prev      string          `json:"prev"`
+	Hash      string          `json:"hash,omitempty"`
+}
+
+// ErrAuditDisabled is returned when logging to an audit logger that is not
+// configured.
+var ErrAuditDisabled = errors.New("audit log is not enabled")
+
+// AuditLogger writes tamper-evident audit records to an append-only file.
+type AuditLogger struct {
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	key       []byte
+	seq       uint64
+	prev      string
+	truncated int64 // Bytes of a torn last line removed on open.
+}
+
+// AuditTruncated is the type of the record appended when a torn last line,
+// e.g. from a crash while writing, was removed on open. Its event holds the
+// number of bytes removed.
+const AuditTruncated = "AUDIT_TRUNCATED"
+
+// NewAuditLogger opens the audit log at path, resuming the chain from its
+// last record. A last line that isn't a complete record is removed and
+// recorded with an AuditTruncated record.
+func NewAuditLogger(path string, key []byte) (*AuditLogger, error) {
+	if len(key) == 0 {
+		return nil, errors.New("audit log requires a key")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, errors.Wrap(err, "failed to create audit log dir")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open audit log")
+	}
+
+	a := &AuditLogger{path: path, file: f, key: key}
+	tail, err := lastAuditRecord(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to resume audit log %s", path)
+	}
+	if tail.record != nil {
+		a.seq = tail.record.Seq
+		a.prev = tail.record.Hash
+	}
+	switch {
+	case tail.torn > 0:
+		err = a.truncate(tail.torn)
+	case tail.unterminated:
+		_, err = f.Write([]byte("\n"))
+	}
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to repair audit log %s", path)
+	}
+	return a, nil
+}
+
+// truncate removes the last n bytes of the file and records it.
+func (a *AuditLogger) truncate(n int64) error {
+	info, err := a.file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := a.file.Truncate(info.Size() - n); err != nil {
+		return err
+	}
+	a.truncated = n
+	return a.Log(AuditTruncated, map[string]int64{"bytes": n})
+}
+
+// Log appends a record of the given type. The event is encoded as JSON.
+func (a *AuditLogger) Log(eventType string, event interface{}) error {
+	if a == nil {
+		return ErrAuditDisabled
+	}
+
+	var raw json.RawMessage
+	if event != nil {
+		var err error
+		if raw, err = json.Marshal(event); err != nil {
+			return errors.Wrap(err, "failed to encode audit event")
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rec := AuditRecord{
+		Seq:       a.seq + 1,
+		Timestamp: time.Now().Format("2006-01-02T15:04:05.000-07:00"),
+		Type:      eventType,
+		Event:     raw,
+		Prev:      a.prev,
+	}
+	hash, err := auditHash(a.key, rec)
+	if err != nil {
+		return err
+	}
+	rec.Hash = hash
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode audit record")
+	}
+	if _, err = a.file.Write(append(line, '\n')); err != nil {
+		return errors.Wrap(err, "failed to write audit record")
+	}
+	a.seq, a.prev = rec.Seq, rec.Hash
+	return nil
+}
+
+// Sync commits the audit log to stable storage.
+func (a *AuditLogger) Sync() error {
+	if a == nil {
+		return nil
+	}
+	return a.file.Sync()
+}
+
+// Close closes the audit log.
+func (a *AuditLogger) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// Verify verifies an audit log with the key of a, see VerifyAudit.
+func (a *AuditLogger) Verify(r io.Reader) (int, []AuditProblem, error) {
+	if a == nil {
+		return 0, nil, ErrAuditDisabled
+	}
+	return VerifyAudit(r, a.key)
+}
+
+// Audit returns the audit logger configured by Configure. It is nil, and
+// logging to it returns ErrAuditDisabled, if the audit log is not enabled.
+func Audit() *AuditLogger {
+	return loadLogger().audit
+}
+
+// GetAuditConfig returns the configuration of the audit log without its key.
+func GetAuditConfig() AuditConfig {
+	cfg := loadLogger().auditConfig
+	cfg.Key = ""
+	return cfg
+}
+
+// AuditProblem describes a record that failed verification.
+type AuditProblem struct {
+	Line   int
+	Seq    uint64
+	Reason string
+}
+
+func (p AuditProblem) String() string {
+	return fmt.Sprintf("line %d (seq %d): %s", p.Line, p.Seq, p.Reason)
+}
+
+// VerifyAudit reads an audit log and checks every record for modifications
+// and the sequence for gaps and reordering. It returns the number of records
+// read and the problems found.
+func VerifyAudit(r io.Reader, key []byte) (int, []AuditProblem, error) {
+	var (
+		problems []AuditProblem
+		count    int
+		seq      uint64
+		prev     string
+	)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		count++
+
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			problems = append(problems, AuditProblem{Line: line, Reason: "malformed record: " + err.Error()})
+			continue
+		}
+		report := func(format string, args ...interface{}) {
+			problems = append(problems, AuditProblem{Line: line, Seq: rec.Seq, Reason: fmt.Sprintf(format, args...)})
+		}
+
+		hash := rec.Hash
+		expected, err := auditHash(key, rec)
+		if err != nil {
+			return count, problems, err
+		}
+		if !hmac.Equal([]byte(hash), []byte(expected)) {
+			report("hash mismatch, record was modified")
+		}
+
+		switch {
+		case rec.Seq <= seq:
+			report("out of order, previous seq %d", seq)
+		case rec.Seq != seq+1:
+			report("gap, missing seq %d to %d", seq+1, rec.Seq-1)
+		}
+		if rec.Prev != prev {
+			report("chain broken, prev doesn't match the preceding record")
+		}
+		seq, prev = rec.Seq, hash
+	}
+	return count, problems, scanner.Err()
+}
+
+func auditHash(key []byte, rec AuditRecord) (string, error) {
+	rec.Hash = ""
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode audit record")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// auditTail is the end of an audit log.
+type auditTail struct {
+	record       *AuditRecord // Last record, nil if there is none.
+	torn         int64        // Length of a last line that isn't a record.
+	unterminated bool         // The last record misses its newline.
+}
+
+// lastAuditRecord returns the last record of the audit log. If the last line
+// isn't a record, as left by a torn write, it returns the record before it.
+func lastAuditRecord(f *os.File) (auditTail, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return auditTail{}, err
+	}
+	var (
+		last, previous []byte
+		lastLen        int64 // Of last, including the blank lines after it.
+	)
+	reader := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			previous, last = last, append([]byte(nil), line...)
+			lastLen = 0
+		}
+		lastLen += int64(len(line))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return auditTail{}, err
+		}
+	}
+	if last == nil {
+		return auditTail{}, nil
+	}
+	var rec AuditRecord
+	if json.Unmarshal(last, &rec) == nil {
+		return auditTail{record: &rec, unterminated: !bytes.HasSuffix(last, []byte("\n"))}, nil
+	}
+	// Only the last line may be torn.
+	tail := auditTail{torn: lastLen}
+	if previous != nil {
+		if err := json.Unmarshal(previous, &rec); err != nil {
+			return auditTail{}, err
+		}
+		tail.record = &rec
+	}
+	return tail, nil
+}
+
+// makeAuditLogger returns the audit logger for cfg. The current logger is
+// reused if it writes to the same file with the same key. If it writes to the
+// same file with another key it is blocked while the new logger opens, since
+// entries it appended after the new logger read the last record would fork
+// the chain, and closed once the new logger opened.
+func makeAuditLogger(cfg Config, current *AuditLogger) (*AuditLogger, error) {
+	if !cfg.Audit.Enabled {
+		return nil, nil
+	}
+	if err := cfg.Audit.Validate(); err != nil {
+		return nil, err
+	}
+	path := cfg.Audit.Path
+	if path == "" {
+		name := cfg.AppName
+		if cfg.Files.Name != "" {
+			name = strings.TrimSuffix(cfg.Files.Name, filepath.Ext(cfg.Files.Name))
+		}
+		path = filepath.Join(cfg.Files.Path, name+".audit")
+	}
+	key := []byte(cfg.Audit.Key)
+	if current != nil && sameFile(current.path, path) {
+		if bytes.Equal(current.key, key) {
+			return current, nil
+		}
+		current.mu.Lock()
+		defer current.mu.Unlock()
+		a, err := NewAuditLogger(path, key)
+		if err != nil {
+			return nil, err
+		}
+		current.file.Close()
+		return a, nil
+	}
+	return NewAuditLogger(path, key)
+}
+
+func sameFile(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
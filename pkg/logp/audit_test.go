@@ -0,0 +1,198 @@
+package logp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeAuditLog(t *testing.T, key []byte, n int) []string {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.audit")
+
+	// Reopen half way to check that the chain is resumed.
+	for _, count := range []int{n / 2, n - n/2} {
+		a, err := NewAuditLogger(path, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < count; i++ {
+			assert.NoError(t, a.Log("TUNIP_TEST", map[string]int{"i": i}))
+		}
+		a.Close()
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func verifyLines(t *testing.T, key []byte, lines []string) []AuditProblem {
+	_, problems, err := VerifyAudit(bytes.NewBufferString(strings.Join(lines, "\n")), key)
+	assert.NoError(t, err)
+	return problems
+}
+
+func TestAuditVerify(t *testing.T) {
+	key := []byte("secret")
+	lines := writeAuditLog(t, key, 4)
+	assert.Len(t, lines, 4)
+	assert.Empty(t, verifyLines(t, key, lines))
+
+	// Wrong key.
+	assert.Len(t, verifyLines(t, []byte("other"), lines), 4)
+
+	// Modification.
+	modified := append([]string(nil), lines...)
+	modified[1] = strings.Replace(modified[1], `"i":1`, `"i":7`, 1)
+	if problems := verifyLines(t, key, modified); assert.Len(t, problems, 1) {
+		assert.Equal(t, 2, problems[0].Line)
+		assert.Contains(t, problems[0].Reason, "modified")
+	}
+
+	// Gap.
+	gap := []string{lines[0], lines[2], lines[3]}
+	if problems := verifyLines(t, key, gap); assert.Len(t, problems, 2) {
+		assert.Contains(t, problems[0].Reason, "gap")
+		assert.Contains(t, problems[1].Reason, "chain broken")
+	}
+
+	// Reordering.
+	reordered := []string{lines[0], lines[2], lines[1], lines[3]}
+	var reasons []string
+	for _, p := range verifyLines(t, key, reordered) {
+		if p.Line == 3 {
+			reasons = append(reasons, p.Reason)
+		}
+	}
+	assert.Contains(t, strings.Join(reasons, ";"), "out of order")
+}
+
+func TestAuditConfigValidate(t *testing.T) {
+	assert.NoError(t, AuditConfig{}.Validate())
+	assert.NoError(t, AuditConfig{Enabled: true, Key: "0c5e1d"}.Validate())
+	assert.Error(t, AuditConfig{Enabled: true}.Validate())
+	assert.Error(t, AuditConfig{Enabled: true, Key: "change-me"}.Validate())
+}
+
+func TestAuditReconfigure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.audit")
+
+	setup := func(key string) {
+		err := DevelopmentSetup(ToObserverOutput(), func(cfg *Config) {
+			cfg.Audit = AuditConfig{Enabled: true, Path: path, Key: key}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	setup("first")
+	audit := Audit()
+	assert.NoError(t, audit.Log("TUNIP_TEST", nil))
+
+	// The same config keeps the logger, so entries logged meanwhile can't
+	// fork the chain.
+	setup("first")
+	assert.True(t, audit == Audit())
+	assert.NoError(t, audit.Log("TUNIP_TEST", nil))
+	assert.NoError(t, Audit().Log("TUNIP_TEST", nil))
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(t, lines, 3)
+	assert.Empty(t, verifyLines(t, []byte("first"), lines))
+
+	// A failed reopen keeps the logger.
+	assert.NoError(t, ioutil.WriteFile(path, append(content, "torn\ntorn"...), 0600))
+	err = DevelopmentSetup(ToObserverOutput(), func(cfg *Config) {
+		cfg.Audit = AuditConfig{Enabled: true, Path: path, Key: "second"}
+	})
+	assert.Error(t, err)
+	assert.True(t, audit == Audit())
+	assert.NoError(t, audit.Log("TUNIP_TEST", nil))
+	assert.NoError(t, ioutil.WriteFile(path, content, 0600))
+
+	// Another key closes the logger once the file is reopened.
+	setup("second")
+	assert.Error(t, audit.Log("TUNIP_TEST", nil))
+	assert.NoError(t, Audit().Log("TUNIP_TEST", nil))
+	assert.Empty(t, GetAuditConfig().Key)
+
+	err = DevelopmentSetup(ToObserverOutput(), func(cfg *Config) {
+		cfg.Audit = AuditConfig{Enabled: true, Path: path, Key: "change-me"}
+	})
+	assert.Error(t, err)
+	assert.NoError(t, DevelopmentSetup(ToObserverOutput()))
+}
+
+func TestAuditTornWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.audit")
+	key := []byte("secret")
+
+	a, err := NewAuditLogger(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, a.Log("TUNIP_TEST", nil))
+	assert.NoError(t, a.Log("TUNIP_TEST", nil))
+	a.Close()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopen := func(content []byte) []string {
+		assert.NoError(t, ioutil.WriteFile(path, content, 0600))
+		a, err := NewAuditLogger(path, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, a.Log("TUNIP_TEST", nil))
+		a.Close()
+		reopened, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(reopened)), "\n")
+		assert.Empty(t, verifyLines(t, key, lines))
+		return lines
+	}
+
+	// A torn last record is removed and the removal recorded.
+	lines := reopen(append(append([]byte(nil), content...), `{"seq":3,"timest`...))
+	if assert.Len(t, lines, 4) {
+		assert.Contains(t, lines[2], `"type":"`+AuditTruncated+`","event":{"bytes":16}`)
+	}
+
+	// A complete record missing its newline is kept.
+	lines = reopen(bytes.TrimSuffix(content, []byte("\n")))
+	assert.Len(t, lines, 3)
+
+	// A torn first record leaves an empty log.
+	lines = reopen([]byte(`{"seq":1,"ti`))
+	assert.Len(t, lines, 2)
+}
@@ -0,0 +1,72 @@
+package logp
+
+import (
+	"io"
+	golog "log"
+
+	"go.uber.org/zap"
+)
+
+// Bridge names recognized in Config.Bridges.
+const (
+	StdLogBridge   = "stdlog"
+	GinBridge      = "gin"
+	GinErrorBridge = "gin_error"
+)
+
+// BridgeConfig contains the configuration options for redirecting a third
+// party writer (e.g. the standard library log package) into logp.
+type BridgeConfig struct {
+	Enabled bool   `json:"enabled"`
+	Name    string `json:"name"`  // Name of the logger receiving the output.
+	Level   Level  `json:"level"` // Level used when no level prefix is detected.
+}
+
+// NewBridge returns a LineWriter for the given bridge configuration. The
+// logger name defaults to name if the configuration doesn't specify one.
+func NewBridge(name string, cfg BridgeConfig) *LineWriter {
+	if cfg.Name != "" {
+		name = cfg.Name
+	}
+	return NewLineWriter(NewLogger(name, zap.WithCaller(false)), cfg.Level, DefaultMaxLineLength)
+}
+
+// GetBridgeConfig returns the configuration of the named bridge, if present.
+func GetBridgeConfig(name string) (BridgeConfig, bool) {
+	cfg, found := loadLogger().bridges[name]
+	return cfg, found
+}
+
+// stdLogState is the setup of the standard library log package replaced by
+// the stdlog bridge, nil if it isn't redirected.
+var stdLogState *struct {
+	output io.Writer
+	flags  int
+	prefix string
+}
+
+// redirectStdLog routes the output of the standard library log package into
+// logp.
+func redirectStdLog(cfg BridgeConfig) {
+	if stdLogState == nil {
+		stdLogState = &struct {
+			output io.Writer
+			flags  int
+			prefix string
+		}{golog.Writer(), golog.Flags(), golog.Prefix()}
+	}
+	golog.SetFlags(0)
+	golog.SetPrefix("")
+	golog.SetOutput(NewBridge(StdLogBridge, cfg))
+}
+
+// restoreStdLog undoes redirectStdLog.
+func restoreStdLog() {
+	if stdLogState == nil {
+		return
+	}
+	golog.SetOutput(stdLogState.output)
+	golog.SetFlags(stdLogState.flags)
+	golog.SetPrefix(stdLogState.prefix)
+	stdLogState = nil
+}
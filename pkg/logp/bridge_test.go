@@ -0,0 +1,39 @@
+package logp
+
+import (
+	golog "log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestStdLogBridge(t *testing.T) {
+	err := DevelopmentSetup(ToObserverOutput(), func(cfg *Config) {
+		cfg.Bridges = map[string]BridgeConfig{
+			StdLogBridge: {Enabled: true, Level: InfoLevel},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golog.Printf("[WARN] retrying in %d seconds", 5)
+	golog.Print("error count is 0")
+	logs := ObserverLogs().TakeAll()
+	if assert.Len(t, logs, 2) {
+		assert.Equal(t, zap.WarnLevel, logs[0].Level)
+		assert.Equal(t, StdLogBridge, logs[0].LoggerName)
+		assert.Equal(t, "[WARN] retrying in 5 seconds", logs[0].Message)
+		assert.Equal(t, zap.InfoLevel, logs[1].Level)
+		assert.Equal(t, "error count is 0", logs[1].Message)
+	}
+
+	// Disabling the bridge restores the standard output.
+	if err := DevelopmentSetup(ToObserverOutput()); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.Stderr, golog.Writer())
+	assert.Equal(t, golog.LstdFlags, golog.Flags())
+}
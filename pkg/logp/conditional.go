@@ -0,0 +1,132 @@
+package logp
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var nopLogger = &Logger{sugar: zap.NewNop().Sugar()}
+
+// maxConditionKeys caps the number of explicit keys of each conditional
+// logger. Keys are never forgotten, so past the cap new keys share a single
+// entry instead of growing the maps without bound.
+const maxConditionKeys = 4096
+
+// conditionKeys is the bookkeeping of a conditional logger, keyed by the
+// logger name and the program counter of the call site or an explicit key.
+// Call sites have their own map so their keys aren't boxed on every call.
+type conditionKeys struct {
+	mu       sync.RWMutex
+	sites    map[siteKey]interface{}
+	keys     sync.Map // explicitKey to value.
+	explicit int64
+}
+
+type siteKey struct {
+	logger string
+	pc     uintptr
+}
+
+type explicitKey struct {
+	logger string
+	key    string
+}
+
+// overflowKey is the key shared by explicit keys past maxConditionKeys.
+type overflowKey struct{}
+
+var (
+	onceKeys   conditionKeys // *uint32
+	everyNKeys conditionKeys // *uint64, number of calls
+	everyKeys  conditionKeys // *int64, unix nanos of the last time it fired
+)
+
+// Once returns l the first time it is called with key and a no-op logger
+// afterwards. An empty key stands for the call site. Keys are scoped to the
+// logger name, so loggers of different names don't silence each other.
+// Explicit keys are kept for the life of the process, so they should come
+// from a small set.
+//
+//	for {
+//		log.Once("").Warn("queue is full, dropping requests")
+//	}
+func (l *Logger) Once(key string) *Logger {
+	v := onceKeys.load(l.name, key, func() interface{} { return new(uint32) })
+	if atomic.CompareAndSwapUint32(v.(*uint32), 0, 1) {
+		return l
+	}
+	return nopLogger
+}
+
+// EveryN returns l on the first call with key and every n-th call after,
+// and a no-op logger otherwise. An empty key stands for the call site.
+func (l *Logger) EveryN(key string, n int) *Logger {
+	v := everyNKeys.load(l.name, key, func() interface{} { return new(uint64) })
+	count := atomic.AddUint64(v.(*uint64), 1)
+	if n <= 1 || (count-1)%uint64(n) == 0 {
+		return l
+	}
+	return nopLogger
+}
+
+// Every returns l if it was not returned for key within the last interval,
+// and a no-op logger otherwise. An empty key stands for the call site.
+func (l *Logger) Every(key string, interval time.Duration) *Logger {
+	v := everyKeys.load(l.name, key, func() interface{} { return new(int64) })
+	last := v.(*int64)
+	now := time.Now().UnixNano()
+	prev := atomic.LoadInt64(last)
+	if prev != 0 && now-prev < int64(interval) {
+		return nopLogger
+	}
+	if atomic.CompareAndSwapInt64(last, prev, now) {
+		return l
+	}
+	// Another goroutine fired concurrently.
+	return nopLogger
+}
+
+// load returns the bookkeeping of key of the named logger, or of the caller
+// of the conditional method if key is empty, creating it with newValue on the
+// first call. The call site is its program counter, which is cheap enough for
+// hot loops.
+func (c *conditionKeys) load(logger, key string, newValue func() interface{}) interface{} {
+	if key == "" {
+		var pc [1]uintptr
+		runtime.Callers(3, pc[:])
+		return c.loadSite(siteKey{logger, pc[0]}, newValue)
+	}
+	if v, found := c.keys.Load(explicitKey{logger, key}); found {
+		return v
+	}
+	var k interface{} = explicitKey{logger, key}
+	if atomic.AddInt64(&c.explicit, 1) > maxConditionKeys {
+		k = overflowKey{}
+	}
+	v, _ := c.keys.LoadOrStore(k, newValue())
+	return v
+}
+
+func (c *conditionKeys) loadSite(site siteKey, newValue func() interface{}) interface{} {
+	c.mu.RLock()
+	v, found := c.sites[site]
+	c.mu.RUnlock()
+	if found {
+		return v
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, found = c.sites[site]; !found {
+		if c.sites == nil {
+			c.sites = map[siteKey]interface{}{}
+		}
+		v = newValue()
+		c.sites[site] = v
+	}
+	return v
+}
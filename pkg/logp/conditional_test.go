@@ -0,0 +1,78 @@
+package logp
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConditional(t *testing.T) {
+	if err := DevelopmentSetup(ToObserverOutput()); err != nil {
+		t.Fatal(err)
+	}
+	log := NewLogger("tester")
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				log.Once("once").Info("once")
+				log.EveryN("every_n", 10).Info("every n")
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 3; i++ {
+		// Keyed by call site.
+		log.Once("").Info("call site")
+	}
+	log.Once("").Info("other call site")
+
+	log.Every("every", time.Hour).Info("every")
+	log.Every("every", time.Hour).Info("every")
+	log.Every("often", time.Nanosecond).Info("often")
+	time.Sleep(time.Millisecond)
+	log.Every("often", time.Nanosecond).Info("often")
+
+	// Loggers of other names have their own keys, children included.
+	for _, other := range []*Logger{NewLogger("other"), log.Named("child"), NewLogger("other")} {
+		other.Once("once").Info("once")
+		other.Once("").Info("shared call site")
+	}
+
+	counts := map[string]int{}
+	for _, entry := range ObserverLogs().TakeAll() {
+		counts[entry.Message]++
+	}
+	assert.Equal(t, map[string]int{
+		"once":             3,
+		"every n":          10,
+		"call site":        1,
+		"other call site":  1,
+		"shared call site": 2,
+		"every":            1,
+		"often":            2,
+	}, counts)
+}
+
+func TestConditionKeysOverflow(t *testing.T) {
+	var keys conditionKeys
+	newValue := func() interface{} { return new(int) }
+	first := keys.load("", "first", newValue)
+	for i := 0; i < maxConditionKeys; i++ {
+		keys.load("", fmt.Sprintf("key %d", i), newValue)
+	}
+	assert.True(t, first == keys.load("", "first", newValue))
+	overflow := keys.load("", "one more", newValue)
+	assert.True(t, overflow == keys.load("", "and another", newValue))
+
+	// Call sites are not capped.
+	site := func() interface{} { return keys.load("", "", newValue) }
+	assert.True(t, site() != overflow)
+}
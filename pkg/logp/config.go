@@ -7,12 +7,24 @@ type Config struct {
 	Level     Level    `json:"level"`     // Logging level (error, warning, info, debug).
 	Selectors []string `json:"selectors"` // Selectors for debug level logging.
 
+	Fields map[string]interface{} `json:"fields"` // Static fields added to every entry.
+
 	toObserver bool `json:"to_observer"`
 	ToStderr   bool `json:"to_stderr"`
 	ToFiles    bool `json:"to_files"`
 
 	Files FileConfig `json:"files"`
 
+	Bridges map[string]BridgeConfig `json:"bridges"` // Writers redirected into logp, keyed by bridge name.
+
+	Dedup DedupConfig `json:"dedup"`
+
+	Audit AuditConfig `json:"audit"`
+
+	OTLP OTLPConfig `json:"otlp"`
+
+	GELF GELFConfig `json:"gelf"`
+
 	addCaller   bool `json:"add_caller"`  // Adds package and line number info to messages.
 	development bool `json:"development"` // Controls how DPanic behaves.
 }
@@ -2,10 +2,12 @@ package logp
 
 import (
 	"flag"
+	"io"
 	"io/ioutil"
 	golog "log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"unsafe"
@@ -38,11 +40,17 @@ func init() {
 }
 
 type coreLogger struct {
-	selectors    map[string]struct{}    // Set of enabled debug selectors.
-	rootLogger   *zap.Logger            // Root logger without any options configured.
-	globalLogger *zap.Logger            // Logger used by legacy global functions (e.g. logp.Info).
-	logger       *Logger                // Logger that is the basis for all logp.Loggers.
-	observedLogs *observer.ObservedLogs // Contains events generated while in observation mode (a testing mode).
+	selectors    map[string]struct{}     // Set of enabled debug selectors.
+	bridges      map[string]BridgeConfig // Configured bridges.
+	rootLogger   *zap.Logger             // Root logger without any options configured.
+	globalLogger *zap.Logger             // Logger used by legacy global functions (e.g. logp.Info).
+	logger       *Logger                 // Logger that is the basis for all logp.Loggers.
+	observedLogs *observer.ObservedLogs  // Contains events generated while in observation mode (a testing mode).
+	audit        *AuditLogger            // Audit logger, nil if disabled.
+	auditConfig  AuditConfig             // Configuration of the audit logger.
+	exporter     *otlpExporter           // OTLP exporter, nil if disabled.
+	gelf         *gelfWriter             // GELF connection, nil if disabled.
+	files        FileConfig              // Configuration of the file output.
 }
 
 // Configure configures the logp package.
@@ -70,7 +78,39 @@ func Configure(cfg Config) error {
 		return errors.Wrap(err, "failed to build log output")
 	}
 
+	var gelf *gelfWriter
+	if cfg.GELF.Enabled {
+		var gelfOutput zapcore.Core
+		gelfOutput, gelf, err = makeGELFOutput(cfg)
+		if err != nil {
+			return errors.Wrap(err, "failed to build gelf output")
+		}
+		sink = zapcore.NewTee(sink, gelfOutput)
+	}
+
+	if len(cfg.Fields) > 0 {
+		sink = sink.With(staticFields(cfg.Fields))
+	}
+
+	var exporter *otlpExporter
+	if cfg.OTLP.Enabled {
+		exporter, err = newOTLPExporter(cfg.OTLP, otlpResourceFields(cfg))
+		if err != nil {
+			gelf.Close()
+			return errors.Wrap(err, "failed to build otlp output")
+		}
+		sink = zapcore.NewTee(sink, newOTLPCore(exporter, atom))
+	}
+
+	sink, err = dedupWrapper(sink, cfg.Dedup)
+	if err != nil {
+		exporter.Close()
+		gelf.Close()
+		return err
+	}
+
 	// Enabled selectors when debug is enabled.
+	discardStdLog := false
 	selectors := make(map[string]struct{}, len(cfg.Selectors))
 	if cfg.Level.Enabled(DebugLevel) && len(cfg.Selectors) > 0 {
 		for _, sel := range cfg.Selectors {
@@ -82,23 +122,58 @@ func Configure(cfg Config) error {
 			selectors["*"] = struct{}{}
 		}
 
-		if _, enabled := selectors["stdlog"]; !enabled {
+		if _, enabled := selectors["stdlog"]; !enabled && !cfg.Bridges[StdLogBridge].Enabled {
 			// Disable standard logging by default (this is sometimes used by
-			// libraries and we don't want their spam).
-			golog.SetOutput(ioutil.Discard)
+			// libraries and we don't want their spam). When the stdlog bridge is
+			// enabled its output is redirected into logp instead.
+			discardStdLog = true
 		}
 
 		sink = selectiveWrapper(sink, selectors)
 	}
 
+	old := loadLogger()
+	audit, err := makeAuditLogger(cfg, old.audit)
+	if err != nil {
+		exporter.Close()
+		gelf.Close()
+		return errors.Wrap(err, "failed to build audit log")
+	}
+
+	files := cfg.Files
+	files.Name = fileName(cfg)
+
 	root := zap.New(sink, makeOptions(cfg)...)
 	storeLogger(&coreLogger{
 		selectors:    selectors,
+		bridges:      cfg.Bridges,
 		rootLogger:   root,
 		globalLogger: root.WithOptions(zap.AddCallerSkip(1)),
 		logger:       newLogger(root, ""),
 		observedLogs: observedLogs,
+		audit:        audit,
+		auditConfig:  cfg.Audit,
+		exporter:     exporter,
+		gelf:         gelf,
+		files:        files,
 	})
+	if old.audit != audit {
+		old.audit.Close()
+		if audit != nil && audit.truncated > 0 {
+			root.Sugar().Warnf("Removed a torn last line of %d bytes from audit log %s", audit.truncated, audit.path)
+		}
+	}
+	old.exporter.Close()
+	old.gelf.Close()
+
+	if bridge := cfg.Bridges[StdLogBridge]; bridge.Enabled {
+		redirectStdLog(bridge)
+	} else {
+		restoreStdLog()
+		if discardStdLog {
+			golog.SetOutput(ioutil.Discard)
+		}
+	}
 	return nil
 }
 
@@ -137,7 +212,11 @@ func ObserverLogs() *observer.ObservedLogs {
 // Sync flushes any buffered log entries. Applications should take care to call
 // Sync before exiting.
 func Sync() error {
-	return loadLogger().rootLogger.Sync()
+	l := loadLogger()
+	if err := l.audit.Sync(); err != nil {
+		return err
+	}
+	return l.rootLogger.Sync()
 }
 
 func makeOptions(cfg Config) []zap.Option {
@@ -157,6 +236,31 @@ func makeStderrOutput(cfg Config) (zapcore.Core, error) {
 }
 
 func makeFileOutput(cfg Config) (zapcore.Core, error) {
+	w := zapcore.AddSync(makeFileWriter(cfg))
+	return zapcore.NewCore(buildEncoder(cfg), w, atom), nil
+}
+
+func makeFileWriter(cfg Config) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:   filepath.Join(cfg.Files.Path, fileName(cfg)),
+		MaxSize:    cfg.Files.MaxSize, // megabytes
+		MaxBackups: cfg.Files.MaxBackups,
+		MaxAge:     cfg.Files.MaxAge,
+		Compress:   cfg.Files.Compress,
+	}
+}
+
+// NewFileLogger returns a Logger writing to a file output built from cfg at
+// cfg.Level, independent of the configuration of the logp package. The
+// returned Closer closes the file.
+func NewFileLogger(cfg Config) (*Logger, io.Closer) {
+	w := makeFileWriter(cfg)
+	core := zapcore.NewCore(buildEncoder(cfg), zapcore.AddSync(w), cfg.Level.zapLevel())
+	return newLogger(zap.New(core, makeOptions(cfg)...), ""), w
+}
+
+// fileName returns the name of the log file, defaulting to the app name.
+func fileName(cfg Config) string {
 	name := cfg.AppName
 	if cfg.Files.Name != "" {
 		name = cfg.Files.Name
@@ -164,17 +268,40 @@ func makeFileOutput(cfg Config) (zapcore.Core, error) {
 	if !strings.Contains(name, ".") {
 		name = name + ".log"
 	}
-	filename := filepath.Join(cfg.Files.Path, name)
+	return name
+}
 
-	w := zapcore.AddSync(&lumberjack.Logger{
-		Filename:   filename,
-		MaxSize:    cfg.Files.MaxSize, // megabytes
-		MaxBackups: cfg.Files.MaxBackups,
-		MaxAge:     cfg.Files.MaxAge,
-		Compress:   cfg.Files.Compress,
-	})
+// GetFileConfig returns the configuration of the file output with the file
+// name resolved.
+func GetFileConfig() FileConfig {
+	return loadLogger().files
+}
 
-	return zapcore.NewCore(buildEncoder(cfg), w, atom), nil
+func staticFields(fields map[string]interface{}) []zapcore.Field {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	zapFields := make([]zapcore.Field, 0, len(keys))
+	for _, k := range keys {
+		zapFields = append(zapFields, zap.Any(k, fields[k]))
+	}
+	return zapFields
+}
+
+// otlpResourceFields returns the resource attributes of the OTLP output,
+// which are the static fields plus the service name.
+func otlpResourceFields(cfg Config) map[string]interface{} {
+	resource := map[string]interface{}{}
+	if cfg.AppName != "" {
+		resource["service.name"] = cfg.AppName
+	}
+	for k, v := range cfg.Fields {
+		resource[k] = v
+	}
+	return resource
 }
 
 func globalLogger() *zap.Logger {
@@ -1,11 +1,16 @@
 package logp
 
 import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+
+	"github.com/colinzuo/tunip/pkg/tracing"
 )
 
 func TestLogger(t *testing.T) {
@@ -213,3 +218,42 @@ func TestL(t *testing.T) {
 		assert.Equal(t, "warning 1", log.Message)
 	}
 }
+
+func TestWithContext(t *testing.T) {
+	if err := DevelopmentSetup(ToObserverOutput()); err != nil {
+		t.Fatal(err)
+	}
+
+	sc := tracing.NewTrace()
+	ctx := tracing.ContextWith(context.Background(), sc)
+
+	NewLogger("tester").WithContext(ctx).Info("traced")
+	NewLogger("tester").WithContext(context.Background()).Info("untraced")
+	logs := ObserverLogs().TakeAll()
+	if assert.Len(t, logs, 2) {
+		assert.Equal(t, sc.TraceID, logs[0].ContextMap()["trace_id"])
+		assert.Equal(t, sc.SpanID, logs[0].ContextMap()["span_id"])
+		assert.NotContains(t, logs[1].ContextMap(), "trace_id")
+	}
+}
+
+func TestNewFileLogger(t *testing.T) {
+	if err := DevelopmentSetup(ToObserverOutput()); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.JSON = true
+	cfg.Files.Path = t.TempDir()
+	cfg.Files.Name = "replay"
+	log, closer := NewFileLogger(cfg)
+	log.Info("to file")
+	log.Debug("below level")
+	assert.NoError(t, closer.Close())
+
+	content, err := ioutil.ReadFile(filepath.Join(cfg.Files.Path, "replay.log"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), `"message":"to file"`)
+	assert.NotContains(t, string(content), "below level")
+	assert.Empty(t, ObserverLogs().TakeAll())
+}
@@ -0,0 +1,194 @@
+package logp
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// DedupConfig contains the configuration options for duplicate message
+// suppression.
+type DedupConfig struct {
+	Enabled    bool           `json:"enabled"`
+	Windows    map[string]int `json:"windows"`     // Window in milliseconds keyed by level name. Unlisted levels are not deduplicated.
+	MaxEntries int            `json:"max_entries"` // Distinct messages tracked at once, defaults to 1000. Others pass through.
+}
+
+const dedupDefaultMaxEntries = 1000
+
+type dedupEntry struct {
+	core   zapcore.Core
+	ent    zapcore.Entry
+	fields []zapcore.Field
+	count  int
+	timer  *time.Timer
+}
+
+// dedupState is shared by a dedupCore and all the children created by With.
+type dedupState struct {
+	mu         sync.Mutex
+	windows    map[zapcore.Level]time.Duration
+	maxEntries int
+	entries    map[string]*dedupEntry
+}
+
+type dedupCore struct {
+	state   *dedupState
+	context []zapcore.Field
+	core    zapcore.Core
+}
+
+func dedupWrapper(core zapcore.Core, cfg DedupConfig) (zapcore.Core, error) {
+	if !cfg.Enabled || len(cfg.Windows) == 0 {
+		return core, nil
+	}
+	windows := make(map[zapcore.Level]time.Duration, len(cfg.Windows))
+	for name, ms := range cfg.Windows {
+		var level Level
+		if err := level.Unpack(name); err != nil {
+			return nil, errors.Wrap(err, "invalid dedup window")
+		}
+		if ms > 0 {
+			windows[level.zapLevel()] = time.Duration(ms) * time.Millisecond
+		}
+	}
+	maxEntries := cfg.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = dedupDefaultMaxEntries
+	}
+	state := &dedupState{windows: windows, maxEntries: maxEntries, entries: map[string]*dedupEntry{}}
+	return &dedupCore{state: state, core: core}, nil
+}
+
+// Enabled returns whether a given logging level is enabled when logging a
+// message.
+func (c *dedupCore) Enabled(level zapcore.Level) bool {
+	return c.core.Enabled(level)
+}
+
+// With adds structured context to the Core.
+func (c *dedupCore) With(fields []zapcore.Field) zapcore.Core {
+	context := make([]zapcore.Field, 0, len(c.context)+len(fields))
+	context = append(context, c.context...)
+	context = append(context, fields...)
+	return &dedupCore{state: c.state, context: context, core: c.core.With(fields)}
+}
+
+// Check determines whether the supplied Entry should be logged.
+func (c *dedupCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// Write writes the entry unless an identical one was written within the
+// window of its level, in which case it is only counted. Once maxEntries
+// messages are tracked new ones are written without being tracked, so that
+// messages carrying ids don't grow the table without bound.
+func (c *dedupCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	window, found := c.state.windows[ent.Level]
+	if !found {
+		return c.core.Write(ent, fields)
+	}
+	key := c.key(ent, fields)
+
+	var expired *dedupEntry
+	s := c.state
+	s.mu.Lock()
+	if e, found := s.entries[key]; found {
+		if ent.Time.Sub(e.ent.Time) < window {
+			e.count++
+			s.mu.Unlock()
+			return nil
+		}
+		s.remove(key, e)
+		expired = e
+	} else if len(s.entries) >= s.maxEntries {
+		s.mu.Unlock()
+		return c.core.Write(ent, fields)
+	}
+	e := &dedupEntry{core: c.core, ent: ent, fields: append([]zapcore.Field(nil), fields...)}
+	e.timer = time.AfterFunc(window, func() { s.expire(key, e) })
+	s.entries[key] = e
+	s.mu.Unlock()
+
+	if expired != nil {
+		expired.writeSummary()
+	}
+	return c.core.Write(ent, fields)
+}
+
+// Sync writes the summaries of all pending windows and flushes buffered logs.
+func (c *dedupCore) Sync() error {
+	s := c.state
+	s.mu.Lock()
+	pending := make([]*dedupEntry, 0, len(s.entries))
+	for key, e := range s.entries {
+		s.remove(key, e)
+		pending = append(pending, e)
+	}
+	s.mu.Unlock()
+
+	for _, e := range pending {
+		e.writeSummary()
+	}
+	return c.core.Sync()
+}
+
+// key identifies an entry by level, logger name, message and field set.
+func (c *dedupCore) key(ent zapcore.Entry, fields []zapcore.Field) string {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.context {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	encoded, err := json.Marshal(enc.Fields)
+	if err != nil {
+		keys := make([]string, 0, len(enc.Fields))
+		for k, v := range enc.Fields {
+			keys = append(keys, fmt.Sprintf("%s=%v", k, v))
+		}
+		sort.Strings(keys)
+		encoded = []byte(strings.Join(keys, ","))
+	}
+	return fmt.Sprintf("%d\x00%s\x00%s\x00%s", ent.Level, ent.LoggerName, ent.Message, encoded)
+}
+
+func (s *dedupState) remove(key string, e *dedupEntry) {
+	e.timer.Stop()
+	delete(s.entries, key)
+}
+
+func (s *dedupState) expire(key string, e *dedupEntry) {
+	s.mu.Lock()
+	if s.entries[key] != e {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.entries, key)
+	s.mu.Unlock()
+	e.writeSummary()
+}
+
+// writeSummary writes a "repeated N times" entry if any duplicates were
+// suppressed.
+func (e *dedupEntry) writeSummary() {
+	if e.count == 0 {
+		return
+	}
+	ent := e.ent
+	ent.Time = time.Now()
+	ent.Message = fmt.Sprintf("%s (repeated %d times)", e.ent.Message, e.count)
+	ent.Stack = ""
+	e.core.Write(ent, append(e.fields, zap.Int("repeated", e.count)))
+}
@@ -0,0 +1,70 @@
+package logp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDedup(t *testing.T) {
+	err := DevelopmentSetup(ToObserverOutput(), func(cfg *Config) {
+		cfg.Dedup = DedupConfig{
+			Enabled: true,
+			Windows: map[string]int{"error": 60000},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := NewLogger("dispatch")
+	for i := 0; i < 5; i++ {
+		log.Errorw("Unexpected WorkerRequest type", "type", "foo")
+	}
+	log.Errorw("Unexpected WorkerRequest type", "type", "bar")
+	log.Info("not deduplicated")
+	log.Info("not deduplicated")
+
+	logs := ObserverLogs().TakeAll()
+	if assert.Len(t, logs, 4) {
+		assert.Equal(t, "foo", logs[0].ContextMap()["type"])
+		assert.Equal(t, "bar", logs[1].ContextMap()["type"])
+		assert.Equal(t, zap.InfoLevel, logs[2].Level)
+	}
+
+	Sync()
+	logs = ObserverLogs().TakeAll()
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, zap.ErrorLevel, logs[0].Level)
+		assert.Equal(t, "Unexpected WorkerRequest type (repeated 4 times)", logs[0].Message)
+		assert.Equal(t, int64(4), logs[0].ContextMap()["repeated"])
+		assert.Equal(t, "foo", logs[0].ContextMap()["type"])
+	}
+}
+
+func TestDedupMaxEntries(t *testing.T) {
+	err := DevelopmentSetup(ToObserverOutput(), func(cfg *Config) {
+		cfg.Dedup = DedupConfig{
+			Enabled:    true,
+			Windows:    map[string]int{"error": 60000},
+			MaxEntries: 2,
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := NewLogger("dispatch")
+	for i := 0; i < 3; i++ {
+		log.Errorw("Request failed", "id", 1)
+		log.Errorw("Request failed", "id", 2)
+		log.Errorw("Request failed", "id", 3)
+	}
+	logs := ObserverLogs().TakeAll()
+	assert.Len(t, logs, 5)
+	assert.Len(t, loadLogger().rootLogger.Core().(*dedupCore).state.entries, 2)
+
+	Sync()
+	assert.Len(t, ObserverLogs().TakeAll(), 2)
+}
@@ -0,0 +1,447 @@
+package logp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap/zapcore"
+)
+
+// GELFConfig contains the configuration options for the GELF (Graylog)
+// output.
+type GELFConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Address     string `json:"address"`     // host:port of the Graylog input.
+	Protocol    string `json:"protocol"`    // udp or tcp.
+	Compression string `json:"compression"` // gzip, zlib or none, UDP only.
+	ChunkSize   int    `json:"chunk_size"`  // Maximum UDP datagram size.
+	Host        string `json:"host"`        // Defaults to the hostname.
+	QueueSize   int    `json:"queue_size"`  // Messages are dropped when the queue is full.
+}
+
+const gelfDefaultQueueSize = 8192
+
+// GELF chunking constants, see the GELF specification.
+const (
+	gelfDefaultChunkSize = 1420
+	gelfChunkHeaderSize  = 12
+	gelfMaxChunks        = 128
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+var gelfFieldNameRe = regexp.MustCompile(`[^\w.\-]`)
+
+// Syslog severities used as GELF levels.
+var gelfLevels = map[zapcore.Level]int{
+	zapcore.DebugLevel:  7,
+	zapcore.InfoLevel:   6,
+	zapcore.WarnLevel:   4,
+	zapcore.ErrorLevel:  3,
+	zapcore.DPanicLevel: 2,
+	zapcore.PanicLevel:  2,
+	zapcore.FatalLevel:  2,
+}
+
+// gelfWriter sends GELF payloads over UDP or TCP from a background
+// goroutine, so logging never waits for Graylog. Messages are dropped when
+// the queue is full or while the writer is disconnected and waiting to
+// reconnect.
+type gelfWriter struct {
+	protocol    string
+	address     string
+	compression string
+	chunkSize   int
+	queue       chan []byte
+	flush       chan chan struct{}
+	done        chan struct{}
+	ctx         context.Context // Cancelled on Close to abort a connection attempt.
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	dropped     uint64
+
+	// Only used by the background goroutine, besides newGELFWriter.
+	conn    net.Conn
+	retryAt time.Time // No connection attempt before.
+	backoff time.Duration
+}
+
+// Reconnection backoff of the GELF writer.
+const (
+	gelfMinBackoff = 100 * time.Millisecond
+	gelfMaxBackoff = 30 * time.Second
+	gelfTimeout    = 5 * time.Second
+)
+
+func newGELFWriter(cfg GELFConfig) (*gelfWriter, error) {
+	w := &gelfWriter{
+		protocol:    cfg.Protocol,
+		address:     cfg.Address,
+		compression: cfg.Compression,
+		chunkSize:   cfg.ChunkSize,
+		backoff:     gelfMinBackoff,
+	}
+	if w.protocol == "" {
+		w.protocol = "udp"
+	}
+	if w.compression == "" {
+		w.compression = "gzip"
+	}
+	if w.chunkSize <= gelfChunkHeaderSize {
+		w.chunkSize = gelfDefaultChunkSize
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = gelfDefaultQueueSize
+	}
+	switch w.protocol {
+	case "udp", "tcp":
+	default:
+		return nil, errors.Errorf("unsupported gelf protocol '%s'", w.protocol)
+	}
+	switch w.compression {
+	case "gzip", "zlib", "none":
+	default:
+		return nil, errors.Errorf("unsupported gelf compression '%s'", w.compression)
+	}
+	if w.address == "" {
+		return nil, errors.New("gelf output requires an address")
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	if w.protocol == "udp" {
+		// UDP doesn't need the peer to be up, so fail early on bad addresses.
+		if err := w.dial(); err != nil {
+			w.cancel()
+			return nil, err
+		}
+	}
+
+	w.queue = make(chan []byte, cfg.QueueSize)
+	w.flush = make(chan chan struct{})
+	w.done = make(chan struct{})
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+func (w *gelfWriter) dial() error {
+	dialer := net.Dialer{Timeout: gelfTimeout}
+	conn, err := dialer.DialContext(w.ctx, w.protocol, w.address)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to gelf %s %s", w.protocol, w.address)
+	}
+	w.conn = conn
+	return nil
+}
+
+// Send queues one GELF message, dropping it if the queue is full.
+func (w *gelfWriter) Send(msg []byte) {
+	select {
+	case w.queue <- msg:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// Dropped returns the number of messages dropped because the queue was
+// full or they couldn't be sent.
+func (w *gelfWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Sync blocks until the messages queued so far are sent or dropped.
+func (w *gelfWriter) Sync() {
+	ack := make(chan struct{})
+	select {
+	case w.flush <- ack:
+		<-ack
+	case <-w.done:
+	}
+}
+
+// Close sends the queued messages if connected and closes the connection.
+func (w *gelfWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	close(w.done)
+	w.cancel()
+	w.wg.Wait()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+func (w *gelfWriter) run() {
+	defer w.wg.Done()
+
+	drain := func(closing bool) {
+		for {
+			select {
+			case msg := <-w.queue:
+				w.write(msg, closing)
+			default:
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case msg := <-w.queue:
+			w.write(msg, false)
+		case ack := <-w.flush:
+			drain(false)
+			close(ack)
+		case <-w.done:
+			drain(true)
+			return
+		}
+	}
+}
+
+// write sends msg, connecting first if needed. Failed connections are
+// retried with an exponential backoff, messages in between are dropped.
+func (w *gelfWriter) write(msg []byte, closing bool) {
+	if w.conn == nil {
+		if closing || time.Now().Before(w.retryAt) || !w.connect() {
+			atomic.AddUint64(&w.dropped, 1)
+			return
+		}
+	}
+	var err error
+	if w.protocol == "tcp" {
+		err = w.sendTCP(msg)
+	} else {
+		err = w.sendUDP(msg)
+	}
+	if err != nil {
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+func (w *gelfWriter) connect() bool {
+	if err := w.dial(); err != nil {
+		w.retryAt = time.Now().Add(w.backoff)
+		if w.backoff *= 2; w.backoff > gelfMaxBackoff {
+			w.backoff = gelfMaxBackoff
+		}
+		return false
+	}
+	w.backoff = gelfMinBackoff
+	return true
+}
+
+func (w *gelfWriter) sendTCP(msg []byte) error {
+	frame := append(msg[:len(msg):len(msg)], 0)
+	w.conn.SetWriteDeadline(time.Now().Add(gelfTimeout))
+	if _, err := w.conn.Write(frame); err != nil {
+		// Reconnect once, the server may have closed an idle connection.
+		w.conn.Close()
+		w.conn = nil
+		if !w.connect() {
+			return err
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(gelfTimeout))
+		if _, err = w.conn.Write(frame); err != nil {
+			w.conn.Close()
+			w.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *gelfWriter) sendUDP(msg []byte) error {
+	payload, err := w.compress(msg)
+	if err != nil {
+		return err
+	}
+	if len(payload) <= w.chunkSize {
+		_, err = w.conn.Write(payload)
+		return err
+	}
+
+	dataSize := w.chunkSize - gelfChunkHeaderSize
+	count := (len(payload) + dataSize - 1) / dataSize
+	if count > gelfMaxChunks {
+		return errors.Errorf("gelf message too large, %d chunks", count)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	chunk := make([]byte, 0, w.chunkSize)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * dataSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunk = append(chunk[:0], gelfChunkMagic...)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, payload[i*dataSize:end]...)
+		if _, err := w.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *gelfWriter) compress(msg []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch w.compression {
+	case "gzip":
+		zw := gzip.NewWriter(&buf)
+		zw.Write(msg)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	case "zlib":
+		zw := zlib.NewWriter(&buf)
+		zw.Write(msg)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return msg, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// gelfCore is a zapcore.Core encoding entries as GELF 1.1 messages.
+type gelfCore struct {
+	zapcore.LevelEnabler
+	writer  *gelfWriter
+	host    string
+	context []zapcore.Field
+}
+
+func makeGELFOutput(cfg Config) (zapcore.Core, *gelfWriter, error) {
+	w, err := newGELFWriter(cfg.GELF)
+	if err != nil {
+		return nil, nil, err
+	}
+	host := cfg.GELF.Host
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	return &gelfCore{LevelEnabler: atom, writer: w, host: host}, w, nil
+}
+
+// With adds structured context to the Core.
+func (c *gelfCore) With(fields []zapcore.Field) zapcore.Core {
+	context := make([]zapcore.Field, 0, len(c.context)+len(fields))
+	context = append(context, c.context...)
+	context = append(context, fields...)
+	return &gelfCore{LevelEnabler: c.LevelEnabler, writer: c.writer, host: c.host, context: context}
+}
+
+// Check determines whether the supplied Entry should be logged.
+func (c *gelfCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// Write encodes the entry as GELF and queues it for sending.
+func (c *gelfCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	msg, err := c.encode(ent, fields)
+	if err != nil {
+		return err
+	}
+	c.writer.Send(msg)
+	return nil
+}
+
+// Sync blocks until the messages queued so far are sent.
+func (c *gelfCore) Sync() error {
+	c.writer.Sync()
+	return nil
+}
+
+func (c *gelfCore) encode(ent zapcore.Entry, fields []zapcore.Field) ([]byte, error) {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.context {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+
+	msg := map[string]interface{}{
+		"version":       "1.1",
+		"host":          c.host,
+		"short_message": ent.Message,
+		"timestamp":     math.Round(float64(ent.Time.UnixNano())/1e6) / 1e3,
+		"level":         gelfLevels[ent.Level],
+	}
+	if ent.Stack != "" {
+		msg["full_message"] = ent.Message + "\n" + ent.Stack
+	}
+	if ent.LoggerName != "" {
+		msg["_"+baseEncodingConfig.NameKey] = ent.LoggerName
+	}
+	if ent.Caller.Defined {
+		msg["_"+baseEncodingConfig.CallerKey] = ent.Caller.TrimmedPath()
+	}
+	for k, v := range enc.Fields {
+		name := "_" + gelfFieldNameRe.ReplaceAllString(k, "_")
+		if name == "_id" {
+			// _id is reserved by Graylog.
+			name = "_id_"
+		}
+		msg[name] = gelfValue(v)
+	}
+	return json.Marshal(msg)
+}
+
+// gelfValue converts a field value into a string or number, the only types
+// allowed for GELF additional fields.
+func gelfValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr:
+		return v
+	case float32:
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return fmt.Sprint(v)
+		}
+		return v
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Sprint(v)
+		}
+		return v
+	case time.Time:
+		return v.Format("2006-01-02T15:04:05.000-07:00")
+	case time.Duration:
+		return int64(v)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		if data, err := json.Marshal(v); err == nil {
+			return string(data)
+		}
+		return fmt.Sprintf("%+v", v)
+	}
+}
@@ -0,0 +1,210 @@
+package logp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readGELFUDP reads datagrams until a complete message is reassembled.
+func readGELFUDP(t *testing.T, conn net.PacketConn) []byte {
+	chunks := map[byte][]byte{}
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := append([]byte(nil), buf[:n]...)
+		if !bytes.HasPrefix(packet, gelfChunkMagic) {
+			return packet
+		}
+		seq, count := packet[10], packet[11]
+		chunks[seq] = packet[gelfChunkHeaderSize:]
+		if len(chunks) == int(count) {
+			var payload []byte
+			for i := byte(0); i < count; i++ {
+				payload = append(payload, chunks[i]...)
+			}
+			return payload
+		}
+	}
+}
+
+func decodeGELF(t *testing.T, payload []byte) map[string]interface{} {
+	var data []byte
+	var err error
+	switch {
+	case bytes.HasPrefix(payload, []byte{0x1f, 0x8b}):
+		r, _ := gzip.NewReader(bytes.NewReader(payload))
+		data, err = ioutil.ReadAll(r)
+	case payload[0] == 0x78:
+		r, _ := zlib.NewReader(bytes.NewReader(payload))
+		data, err = ioutil.ReadAll(r)
+	default:
+		data = payload
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := map[string]interface{}{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestGELFUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, compression := range []string{"gzip", "zlib", "none"} {
+		err := DevelopmentSetup(ToObserverOutput(), func(cfg *Config) {
+			cfg.Fields = map[string]interface{}{"env": "test"}
+			cfg.GELF = GELFConfig{
+				Enabled:     true,
+				Address:     conn.LocalAddr().String(),
+				Compression: compression,
+				ChunkSize:   100,
+				Host:        "tester",
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Random-ish content that doesn't compress well to force chunking.
+		var long strings.Builder
+		for i := 0; i < 200; i++ {
+			long.WriteString(time.Duration(i * 7919).String())
+		}
+		NewLogger("gelf").Warnw(long.String(), "id", 42, "bad key", "x")
+
+		msg := decodeGELF(t, readGELFUDP(t, conn))
+		assert.Equal(t, "1.1", msg["version"], compression)
+		assert.Equal(t, "tester", msg["host"])
+		assert.Equal(t, long.String(), msg["short_message"])
+		assert.Equal(t, float64(4), msg["level"])
+		assert.Equal(t, "gelf", msg["_logger"])
+		assert.Equal(t, "test", msg["_env"])
+		assert.Equal(t, float64(42), msg["_id_"])
+		assert.Equal(t, "x", msg["_bad_key"])
+	}
+	DevelopmentSetup(ToObserverOutput())
+}
+
+func TestGELFTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan []byte, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			frame, err := r.ReadBytes(0)
+			if err != nil {
+				return
+			}
+			received <- frame[:len(frame)-1]
+		}
+	}()
+
+	err = DevelopmentSetup(ToObserverOutput(), func(cfg *Config) {
+		cfg.GELF = GELFConfig{Enabled: true, Address: ln.Addr().String(), Protocol: "tcp"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := NewLogger("gelf")
+	log.Info("first")
+	log.Errorw("second", "count", 2)
+
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case frame := <-received:
+			msg := decodeGELF(t, frame)
+			assert.Equal(t, expected, msg["short_message"])
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for gelf message")
+		}
+	}
+	DevelopmentSetup(ToObserverOutput())
+}
+
+func TestGELFUnreachable(t *testing.T) {
+	// Find a free port, nothing listens on it once the listener is closed.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	err = DevelopmentSetup(ToObserverOutput(), func(cfg *Config) {
+		cfg.GELF = GELFConfig{Enabled: true, Address: addr, Protocol: "tcp", QueueSize: 100}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DevelopmentSetup(ToObserverOutput())
+
+	log := NewLogger("gelf")
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		log.Infof("message %d", i)
+	}
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "logging waited for graylog")
+	Sync()
+	assert.Equal(t, uint64(1000), loadLogger().gelf.Dropped())
+
+	// Messages are sent again once graylog is back and the backoff expired.
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		frame, _ := bufio.NewReader(conn).ReadBytes(0)
+		received <- frame
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		log.Info("back")
+		select {
+		case frame := <-received:
+			assert.Equal(t, "back", decodeGELF(t, frame[:len(frame)-1])["short_message"])
+			return
+		case <-deadline:
+			t.Fatal("timeout waiting for gelf reconnection")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
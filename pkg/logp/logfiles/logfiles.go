@@ -0,0 +1,110 @@
+// Package logfiles locates and opens the log files written by the logp file
+// output, including the backups rotated (and optionally gzip compressed) by
+// lumberjack.
+package logfiles
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Naming of rotated backups, see lumberjack.
+const (
+	backupTimeFormat = "2006-01-02T15-04-05.000"
+	compressSuffix   = ".gz"
+)
+
+// File is a current or rotated log file.
+type File struct {
+	Path       string
+	Rotated    time.Time // Rotation time, zero for the current file.
+	Compressed bool
+}
+
+// IsCurrent reports whether f is the file currently being written.
+func (f File) IsCurrent() bool {
+	return f.Rotated.IsZero()
+}
+
+// List returns the backups of the log file dir/name ordered from oldest to
+// newest, followed by the current file if it exists.
+func List(dir, name string) ([]File, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read log dir %s", dir)
+	}
+
+	ext := filepath.Ext(name)
+	prefix := strings.TrimSuffix(name, ext) + "-"
+
+	var files []File
+	var current *File
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		fn := entry.Name()
+		if fn == name {
+			current = &File{Path: filepath.Join(dir, fn)}
+			continue
+		}
+		if t, compressed, ok := parseBackupName(fn, prefix, ext); ok {
+			files = append(files, File{Path: filepath.Join(dir, fn), Rotated: t, Compressed: compressed})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Rotated.Before(files[j].Rotated)
+	})
+	if current != nil {
+		files = append(files, *current)
+	}
+	return files, nil
+}
+
+func parseBackupName(fn, prefix, ext string) (time.Time, bool, bool) {
+	compressed := strings.HasSuffix(fn, compressSuffix)
+	fn = strings.TrimSuffix(fn, compressSuffix)
+	if !strings.HasPrefix(fn, prefix) || !strings.HasSuffix(fn, ext) {
+		return time.Time{}, false, false
+	}
+	t, err := time.Parse(backupTimeFormat, fn[len(prefix):len(fn)-len(ext)])
+	if err != nil {
+		return time.Time{}, false, false
+	}
+	return t, compressed, true
+}
+
+// Open opens a log file, transparently decompressing gzip files.
+func Open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, compressSuffix) {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to read gzip file %s", path)
+	}
+	return &gzipFile{Reader: gz, file: f}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
@@ -0,0 +1,58 @@
+package logfiles
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"tunip.log",
+		"tunip-2021-09-02T10-00-00.000.log",
+		"tunip-2021-09-01T10-00-00.000.log",
+		"tunip.audit",
+		"other-2021-09-01T10-00-00.000.log",
+	} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(name+"\n"), 0600)
+	}
+	f, _ := os.Create(filepath.Join(dir, "tunip-2021-08-31T10-00-00.000.log.gz"))
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte("compressed\n"))
+	gz.Close()
+	f.Close()
+
+	files, err := List(dir, "tunip.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f.Path))
+	}
+	assert.Equal(t, []string{
+		"tunip-2021-08-31T10-00-00.000.log.gz",
+		"tunip-2021-09-01T10-00-00.000.log",
+		"tunip-2021-09-02T10-00-00.000.log",
+		"tunip.log",
+	}, names)
+	assert.True(t, files[0].Compressed)
+	assert.True(t, files[3].IsCurrent())
+
+	r, err := Open(files[0].Path)
+	if assert.NoError(t, err) {
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		assert.Equal(t, "compressed\n", string(content))
+	}
+}
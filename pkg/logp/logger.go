@@ -1,7 +1,12 @@
 package logp
 
 import (
+	"context"
+	"sync"
+
 	"go.uber.org/zap"
+
+	"github.com/colinzuo/tunip/pkg/tracing"
 )
 
 // LogOption configures a Logger.
@@ -10,6 +15,10 @@ type LogOption = zap.Option
 // Logger logs messages to the configured output.
 type Logger struct {
 	sugar *zap.SugaredLogger
+	name  string // Of the zap logger, which doesn't expose it.
+
+	linesOnce sync.Once
+	lines     *LineWriter // Of Write, created on first use.
 }
 
 func newLogger(rootLogger *zap.Logger, selector string, options ...LogOption) *Logger {
@@ -17,7 +26,7 @@ func newLogger(rootLogger *zap.Logger, selector string, options ...LogOption) *L
 		WithOptions(zap.AddCallerSkip(1)).
 		WithOptions(options...).
 		Named(selector)
-	return &Logger{log.Sugar()}
+	return &Logger{sugar: log.Sugar(), name: selector}
 }
 
 // NewLogger returns a new Logger labeled with the name of the selector. This
@@ -29,21 +38,56 @@ func NewLogger(selector string, options ...LogOption) *Logger {
 	return newLogger(loadLogger().rootLogger, selector, options...)
 }
 
+// Write logs every non-empty line completed by p as a separate entry,
+// detecting the level from the line prefix and defaulting to info. A partial
+// line is buffered until a later call completes it, as by the LineWriter
+// returned by Writer.
 func (l *Logger) Write(p []byte) (n int, err error) {
-	l.Info(string(p))
-	return len(p), nil
+	l.linesOnce.Do(func() { l.lines = l.Writer(InfoLevel) })
+	return l.lines.Write(p)
 }
 
 // With creates a child logger and adds structured context to it. Fields added
 // to the child don't affect the parent, and vice versa.
 func (l *Logger) With(args ...interface{}) *Logger {
-	return &Logger{l.sugar.With(args...)}
+	return &Logger{sugar: l.sugar.With(args...), name: l.name}
+}
+
+// WithContext creates a child logger carrying the trace_id and span_id of
+// the trace context stored in ctx, if any.
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	sc, ok := tracing.FromContext(ctx)
+	if !ok {
+		return l
+	}
+	return &Logger{sugar: l.sugar.With(zap.String("trace_id", sc.TraceID), zap.String("span_id", sc.SpanID)), name: l.name}
 }
 
 // Named adds a new path segment to the logger's name. Segments are joined by
 // periods.
 func (l *Logger) Named(name string) *Logger {
-	return &Logger{l.sugar.Named(name)}
+	full := name
+	switch {
+	case name == "":
+		full = l.name
+	case l.name != "":
+		full = l.name + "." + name
+	}
+	return &Logger{sugar: l.sugar.Named(name), name: full}
+}
+
+// logAt logs msg at the given level.
+func (l *Logger) logAt(level Level, msg string) {
+	switch level {
+	case DebugLevel:
+		l.sugar.Debug(msg)
+	case WarnLevel:
+		l.sugar.Warn(msg)
+	case ErrorLevel:
+		l.sugar.Error(msg)
+	default:
+		l.sugar.Info(msg)
+	}
 }
 
 // Sprint
@@ -0,0 +1,465 @@
+package logp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap/zapcore"
+)
+
+// OTLP encodings of the export requests.
+const (
+	OTLPEncodingJSON     = "json"
+	OTLPEncodingProtobuf = "protobuf"
+)
+
+// otlpCloseTimeout bounds the time Close spends sending the queued records,
+// retrying failed requests.
+const otlpCloseTimeout = 5 * time.Second
+
+// OTLPConfig contains the configuration options for the OTLP/HTTP output.
+type OTLPConfig struct {
+	Enabled       bool              `json:"enabled"`
+	Endpoint      string            `json:"endpoint"` // e.g. http://localhost:4318/v1/logs
+	Encoding      string            `json:"encoding"` // json (default) or protobuf.
+	Headers       map[string]string `json:"headers"`
+	BatchSize     int               `json:"batch_size"`
+	QueueSize     int               `json:"queue_size"`     // Entries are dropped when the queue is full.
+	FlushInterval int               `json:"flush_interval"` // Milliseconds.
+	Timeout       int               `json:"timeout"`        // Milliseconds per request.
+	MaxRetries    int               `json:"max_retries"`
+}
+
+var defaultOTLPConfig = OTLPConfig{
+	Endpoint:      "http://localhost:4318/v1/logs",
+	Encoding:      OTLPEncodingJSON,
+	BatchSize:     512,
+	QueueSize:     8192,
+	FlushInterval: 1000,
+	Timeout:       5000,
+	MaxRetries:    3,
+}
+
+// OTLP structures, see opentelemetry-proto logs/v1/logs.proto. They are
+// encoded as OTLP/JSON by encoding/json and as OTLP/protobuf by marshalProto.
+type (
+	otlpAnyValue struct {
+		StringValue *string         `json:"stringValue,omitempty"`
+		BoolValue   *bool           `json:"boolValue,omitempty"`
+		IntValue    *string         `json:"intValue,omitempty"`
+		DoubleValue *float64        `json:"doubleValue,omitempty"`
+		ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+		KvlistValue *otlpKvList     `json:"kvlistValue,omitempty"`
+	}
+	otlpArrayValue struct {
+		Values []otlpAnyValue `json:"values"`
+	}
+	otlpKvList struct {
+		Values []otlpKeyValue `json:"values"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpLogRecord struct {
+		TimeUnixNano         string         `json:"timeUnixNano"`
+		ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+		SeverityNumber       int            `json:"severityNumber"`
+		SeverityText         string         `json:"severityText"`
+		Body                 otlpAnyValue   `json:"body"`
+		Attributes           []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpScopeLogs struct {
+		Scope      otlpScope       `json:"scope"`
+		LogRecords []otlpLogRecord `json:"logRecords"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpResourceLogs struct {
+		Resource  otlpResource    `json:"resource"`
+		ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+	}
+	otlpExportRequest struct {
+		ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+	}
+)
+
+var otlpSeverities = map[zapcore.Level]struct {
+	number int
+	text   string
+}{
+	zapcore.DebugLevel:  {5, "DEBUG"},
+	zapcore.InfoLevel:   {9, "INFO"},
+	zapcore.WarnLevel:   {13, "WARN"},
+	zapcore.ErrorLevel:  {17, "ERROR"},
+	zapcore.DPanicLevel: {19, "ERROR3"},
+	zapcore.PanicLevel:  {21, "FATAL"},
+	zapcore.FatalLevel:  {21, "FATAL"},
+}
+
+// otlpExporter batches log records and sends them to an OTLP/HTTP endpoint
+// from a background goroutine.
+type otlpExporter struct {
+	cfg      OTLPConfig
+	client   *http.Client
+	resource otlpResource
+	queue    chan otlpLogRecord
+	flush    chan chan struct{}
+	done     chan struct{}   // Closed by Close, to send the queued records.
+	ctx      context.Context // Of the requests, cancelled once Close times out.
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	dropped  uint64
+}
+
+func newOTLPExporter(cfg OTLPConfig, resource map[string]interface{}) (*otlpExporter, error) {
+	switch cfg.Encoding {
+	case "":
+		cfg.Encoding = defaultOTLPConfig.Encoding
+	case OTLPEncodingJSON, OTLPEncodingProtobuf:
+	default:
+		return nil, errors.Errorf("unsupported otlp encoding '%s'", cfg.Encoding)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultOTLPConfig.BatchSize
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultOTLPConfig.QueueSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultOTLPConfig.FlushInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultOTLPConfig.Timeout
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = defaultOTLPConfig.Endpoint
+	}
+
+	e := &otlpExporter{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Millisecond},
+		resource: otlpResource{Attributes: otlpAttributes(resource)},
+		queue:    make(chan otlpLogRecord, cfg.QueueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	e.wg.Add(1)
+	go e.run()
+	return e, nil
+}
+
+func (e *otlpExporter) enqueue(rec otlpLogRecord) {
+	select {
+	case e.queue <- rec:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+}
+
+// Dropped returns the number of records dropped because the queue was full
+// or the endpoint kept failing.
+func (e *otlpExporter) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+// Sync blocks until the records queued so far are sent.
+func (e *otlpExporter) Sync() error {
+	if e == nil {
+		return nil
+	}
+	ack := make(chan struct{})
+	select {
+	case e.flush <- ack:
+		<-ack
+	case <-e.done:
+	}
+	return nil
+}
+
+// Close sends the queued records, retrying failed requests for up to
+// otlpCloseTimeout, and stops the exporter.
+func (e *otlpExporter) Close() {
+	if e == nil {
+		return
+	}
+	timer := time.AfterFunc(otlpCloseTimeout, e.cancel)
+	defer timer.Stop()
+	defer e.cancel()
+	close(e.done)
+	e.wg.Wait()
+}
+
+func (e *otlpExporter) run() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(e.cfg.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+
+	batch := make([]otlpLogRecord, 0, e.cfg.BatchSize)
+	send := func() {
+		if len(batch) > 0 {
+			e.send(batch)
+			batch = make([]otlpLogRecord, 0, e.cfg.BatchSize)
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case rec := <-e.queue:
+				batch = append(batch, rec)
+				if len(batch) >= e.cfg.BatchSize {
+					send()
+				}
+			default:
+				send()
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case rec := <-e.queue:
+			batch = append(batch, rec)
+			if len(batch) >= e.cfg.BatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case ack := <-e.flush:
+			drain()
+			close(ack)
+		case <-e.done:
+			drain()
+			return
+		}
+	}
+}
+
+// send sends a batch, retrying up to MaxRetries times, or when closing until
+// Close times out.
+func (e *otlpExporter) send(batch []otlpLogRecord) {
+	request := otlpExportRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource: e.resource,
+		ScopeLogs: []otlpScopeLogs{{
+			Scope:      otlpScope{Name: "logp"},
+			LogRecords: batch,
+		}},
+	}}}
+	var body []byte
+	if e.cfg.Encoding == OTLPEncodingProtobuf {
+		body = request.marshalProto()
+	} else {
+		var err error
+		if body, err = json.Marshal(request); err != nil {
+			atomic.AddUint64(&e.dropped, uint64(len(batch)))
+			return
+		}
+	}
+
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		retry, err := e.post(body)
+		if err == nil {
+			return
+		}
+		if !retry || (attempt >= e.cfg.MaxRetries && !e.closing()) {
+			atomic.AddUint64(&e.dropped, uint64(len(batch)))
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-e.ctx.Done():
+			atomic.AddUint64(&e.dropped, uint64(len(batch)))
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func (e *otlpExporter) closing() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// post sends one export request. It reports whether a failed request may be
+// retried.
+func (e *otlpExporter) post(body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(e.ctx, http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if e.cfg.Encoding == OTLPEncodingProtobuf {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	rsp, err := e.client.Do(req)
+	if err != nil {
+		return e.ctx.Err() == nil, err
+	}
+	rsp.Body.Close()
+
+	switch {
+	case rsp.StatusCode >= 200 && rsp.StatusCode < 300:
+		return false, nil
+	case rsp.StatusCode == http.StatusTooManyRequests, rsp.StatusCode >= 500:
+		return true, errors.Errorf("otlp export failed with status %d", rsp.StatusCode)
+	default:
+		return false, errors.Errorf("otlp export failed with status %d", rsp.StatusCode)
+	}
+}
+
+// otlpCore is a zapcore.Core converting entries into OTLP log records.
+type otlpCore struct {
+	zapcore.LevelEnabler
+	exporter *otlpExporter
+	context  []zapcore.Field
+}
+
+func newOTLPCore(exporter *otlpExporter, enab zapcore.LevelEnabler) zapcore.Core {
+	return &otlpCore{LevelEnabler: enab, exporter: exporter}
+}
+
+// With adds structured context to the Core.
+func (c *otlpCore) With(fields []zapcore.Field) zapcore.Core {
+	context := make([]zapcore.Field, 0, len(c.context)+len(fields))
+	context = append(context, c.context...)
+	context = append(context, fields...)
+	return &otlpCore{LevelEnabler: c.LevelEnabler, exporter: c.exporter, context: context}
+}
+
+// Check determines whether the supplied Entry should be logged.
+func (c *otlpCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// Write converts the entry into a log record and queues it for export.
+func (c *otlpCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.context {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	if ent.LoggerName != "" {
+		enc.Fields[baseEncodingConfig.NameKey] = ent.LoggerName
+	}
+	if ent.Caller.Defined {
+		enc.Fields[baseEncodingConfig.CallerKey] = ent.Caller.TrimmedPath()
+	}
+	if ent.Stack != "" {
+		enc.Fields[baseEncodingConfig.StacktraceKey] = ent.Stack
+	}
+
+	severity := otlpSeverities[ent.Level]
+	c.exporter.enqueue(otlpLogRecord{
+		TimeUnixNano:         strconv.FormatInt(ent.Time.UnixNano(), 10),
+		ObservedTimeUnixNano: strconv.FormatInt(time.Now().UnixNano(), 10),
+		SeverityNumber:       severity.number,
+		SeverityText:         severity.text,
+		Body:                 otlpValue(ent.Message),
+		Attributes:           otlpAttributes(enc.Fields),
+	})
+	return nil
+}
+
+// Sync flushes the records queued so far.
+func (c *otlpCore) Sync() error {
+	return c.exporter.Sync()
+}
+
+func otlpAttributes(fields map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, otlpKeyValue{Key: k, Value: otlpValue(fields[k])})
+	}
+	return attrs
+}
+
+func otlpValue(v interface{}) otlpAnyValue {
+	switch v := v.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr:
+		s := fmt.Sprint(v)
+		return otlpAnyValue{IntValue: &s}
+	case float32:
+		f := float64(v)
+		return otlpFloat(f)
+	case float64:
+		return otlpFloat(v)
+	case time.Time:
+		s := v.Format("2006-01-02T15:04:05.000-07:00")
+		return otlpAnyValue{StringValue: &s}
+	case time.Duration:
+		s := strconv.FormatInt(int64(v), 10)
+		return otlpAnyValue{IntValue: &s}
+	case []interface{}:
+		values := make([]otlpAnyValue, 0, len(v))
+		for _, elem := range v {
+			values = append(values, otlpValue(elem))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: values}}
+	case map[string]interface{}:
+		return otlpAnyValue{KvlistValue: &otlpKvList{Values: otlpAttributes(v)}}
+	case error:
+		s := v.Error()
+		return otlpAnyValue{StringValue: &s}
+	case fmt.Stringer:
+		s := v.String()
+		return otlpAnyValue{StringValue: &s}
+	default:
+		var s string
+		if data, err := json.Marshal(v); err == nil {
+			s = string(data)
+		} else {
+			s = fmt.Sprintf("%+v", v)
+		}
+		return otlpAnyValue{StringValue: &s}
+	}
+}
+
+func otlpFloat(f float64) otlpAnyValue {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		s := strconv.FormatFloat(f, 'g', -1, 64)
+		return otlpAnyValue{StringValue: &s}
+	}
+	return otlpAnyValue{DoubleValue: &f}
+}
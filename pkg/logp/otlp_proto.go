@@ -0,0 +1,142 @@
+package logp
+
+import (
+	"math"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of opentelemetry-proto collector/logs/v1/logs_service.proto,
+// logs/v1/logs.proto, common/v1/common.proto and resource/v1/resource.proto.
+const (
+	protoRequestResourceLogs = 1
+
+	protoResourceLogsResource  = 1
+	protoResourceLogsScopeLogs = 2
+
+	protoResourceAttributes = 1
+
+	protoScopeLogsScope      = 1
+	protoScopeLogsLogRecords = 2
+
+	protoScopeName = 1
+
+	protoLogRecordTimeUnixNano         = 1
+	protoLogRecordSeverityNumber       = 2
+	protoLogRecordSeverityText         = 3
+	protoLogRecordBody                 = 5
+	protoLogRecordAttributes           = 6
+	protoLogRecordObservedTimeUnixNano = 11
+
+	protoAnyValueString = 1
+	protoAnyValueBool   = 2
+	protoAnyValueInt    = 3
+	protoAnyValueDouble = 4
+	protoAnyValueArray  = 5
+	protoAnyValueKvList = 6
+
+	protoValuesValues = 1 // Of ArrayValue and KeyValueList.
+
+	protoKeyValueKey   = 1
+	protoKeyValueValue = 2
+)
+
+// marshalProto encodes the request as an OTLP/protobuf
+// ExportLogsServiceRequest.
+func (r otlpExportRequest) marshalProto() []byte {
+	var b []byte
+	for _, rl := range r.ResourceLogs {
+		b = appendProtoMessage(b, protoRequestResourceLogs, rl.appendProto)
+	}
+	return b
+}
+
+func (rl otlpResourceLogs) appendProto(b []byte) []byte {
+	b = appendProtoMessage(b, protoResourceLogsResource, func(b []byte) []byte {
+		return appendProtoKeyValues(b, protoResourceAttributes, rl.Resource.Attributes)
+	})
+	for _, sl := range rl.ScopeLogs {
+		b = appendProtoMessage(b, protoResourceLogsScopeLogs, sl.appendProto)
+	}
+	return b
+}
+
+func (sl otlpScopeLogs) appendProto(b []byte) []byte {
+	b = appendProtoMessage(b, protoScopeLogsScope, func(b []byte) []byte {
+		return appendProtoString(b, protoScopeName, sl.Scope.Name)
+	})
+	for _, rec := range sl.LogRecords {
+		b = appendProtoMessage(b, protoScopeLogsLogRecords, rec.appendProto)
+	}
+	return b
+}
+
+func (rec otlpLogRecord) appendProto(b []byte) []byte {
+	b = appendProtoTime(b, protoLogRecordTimeUnixNano, rec.TimeUnixNano)
+	b = protowire.AppendTag(b, protoLogRecordSeverityNumber, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(rec.SeverityNumber))
+	b = appendProtoString(b, protoLogRecordSeverityText, rec.SeverityText)
+	b = appendProtoMessage(b, protoLogRecordBody, rec.Body.appendProto)
+	b = appendProtoKeyValues(b, protoLogRecordAttributes, rec.Attributes)
+	return appendProtoTime(b, protoLogRecordObservedTimeUnixNano, rec.ObservedTimeUnixNano)
+}
+
+func (v otlpAnyValue) appendProto(b []byte) []byte {
+	switch {
+	case v.StringValue != nil:
+		b = appendProtoString(b, protoAnyValueString, *v.StringValue)
+	case v.BoolValue != nil:
+		b = protowire.AppendTag(b, protoAnyValueBool, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(*v.BoolValue))
+	case v.IntValue != nil:
+		i, _ := strconv.ParseInt(*v.IntValue, 10, 64)
+		b = protowire.AppendTag(b, protoAnyValueInt, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(i))
+	case v.DoubleValue != nil:
+		b = protowire.AppendTag(b, protoAnyValueDouble, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(*v.DoubleValue))
+	case v.ArrayValue != nil:
+		b = appendProtoMessage(b, protoAnyValueArray, func(b []byte) []byte {
+			for _, elem := range v.ArrayValue.Values {
+				b = appendProtoMessage(b, protoValuesValues, elem.appendProto)
+			}
+			return b
+		})
+	case v.KvlistValue != nil:
+		b = appendProtoMessage(b, protoAnyValueKvList, func(b []byte) []byte {
+			return appendProtoKeyValues(b, protoValuesValues, v.KvlistValue.Values)
+		})
+	}
+	return b
+}
+
+func appendProtoKeyValues(b []byte, num protowire.Number, kvs []otlpKeyValue) []byte {
+	for _, kv := range kvs {
+		kv := kv
+		b = appendProtoMessage(b, num, func(b []byte) []byte {
+			b = appendProtoString(b, protoKeyValueKey, kv.Key)
+			return appendProtoMessage(b, protoKeyValueValue, kv.Value.appendProto)
+		})
+	}
+	return b
+}
+
+// appendProtoMessage appends the embedded message written by appendFields.
+func appendProtoMessage(b []byte, num protowire.Number, appendFields func([]byte) []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, appendFields(nil))
+}
+
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendProtoTime appends a time in nanoseconds kept as a decimal string for
+// OTLP/JSON.
+func appendProtoTime(b []byte, num protowire.Number, nanos string) []byte {
+	n, _ := strconv.ParseUint(nanos, 10, 64)
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, n)
+}
@@ -0,0 +1,209 @@
+package logp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type otlpCollector struct {
+	mu       sync.Mutex
+	failures int
+	requests []otlpExportRequest
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var req otlpExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.requests = append(c.requests, req)
+}
+
+func (c *otlpCollector) records() []otlpLogRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var records []otlpLogRecord
+	for _, req := range c.requests {
+		for _, rl := range req.ResourceLogs {
+			for _, sl := range rl.ScopeLogs {
+				records = append(records, sl.LogRecords...)
+			}
+		}
+	}
+	return records
+}
+
+func attrMap(attrs []otlpKeyValue) map[string]otlpAnyValue {
+	m := map[string]otlpAnyValue{}
+	for _, kv := range attrs {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func TestOTLPOutput(t *testing.T) {
+	collector := &otlpCollector{failures: 1}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	err := DevelopmentSetup(ToObserverOutput(), func(cfg *Config) {
+		cfg.AppName = "tunip"
+		cfg.Fields = map[string]interface{}{"env": "test"}
+		cfg.OTLP = OTLPConfig{
+			Enabled:    true,
+			Endpoint:   server.URL,
+			BatchSize:  2,
+			MaxRetries: 2,
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := NewLogger("otlp")
+	log.Infow("first", "count", 3, "ok", true)
+	log.Warn("second")
+	log.Errorw("third", "ratio", 0.5)
+	Sync()
+
+	// The observer output still gets the static fields.
+	logs := ObserverLogs().TakeAll()
+	if assert.Len(t, logs, 3) {
+		assert.Equal(t, "test", logs[0].ContextMap()["env"])
+	}
+
+	records := collector.records()
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, 9, records[0].SeverityNumber)
+		assert.Equal(t, "INFO", records[0].SeverityText)
+		assert.Equal(t, "first", *records[0].Body.StringValue)
+		attrs := attrMap(records[0].Attributes)
+		assert.Equal(t, "3", *attrs["count"].IntValue)
+		assert.True(t, *attrs["ok"].BoolValue)
+		assert.Equal(t, "otlp", *attrs["logger"].StringValue)
+		assert.NotContains(t, attrs, "env")
+
+		assert.Equal(t, 13, records[1].SeverityNumber)
+		assert.Equal(t, 17, records[2].SeverityNumber)
+		assert.Equal(t, 0.5, *attrMap(records[2].Attributes)["ratio"].DoubleValue)
+	}
+
+	resource := attrMap(collector.requests[0].ResourceLogs[0].Resource.Attributes)
+	assert.Equal(t, "tunip", *resource["service.name"].StringValue)
+	assert.Equal(t, "test", *resource["env"].StringValue)
+	assert.Equal(t, uint64(0), loadLogger().exporter.Dropped())
+
+	// Reconfiguring stops the exporter.
+	DevelopmentSetup(ToObserverOutput())
+}
+
+// protoFields decodes the fields of a protobuf message, keeping the raw
+// value of each.
+func protoFields(t *testing.T, b []byte) map[protowire.Number][][]byte {
+	fields := map[protowire.Number][][]byte{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			t.Fatal(protowire.ParseError(m))
+		}
+		value := b[:m]
+		if typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(value)
+		}
+		fields[num] = append(fields[num], value)
+		b = b[m:]
+	}
+	return fields
+}
+
+func TestOTLPProtobuf(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		bodies = append(bodies, body)
+	}))
+	defer server.Close()
+
+	e, err := newOTLPExporter(OTLPConfig{Endpoint: server.URL, Encoding: OTLPEncodingProtobuf},
+		map[string]interface{}{"service.name": "tunip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.enqueue(otlpLogRecord{TimeUnixNano: "1600000000000000001", SeverityNumber: 13, SeverityText: "WARN",
+		Body: otlpValue("hello"), Attributes: otlpAttributes(map[string]interface{}{"count": -3, "ok": true})})
+	e.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !assert.Len(t, bodies, 1) {
+		return
+	}
+	resourceLogs := protoFields(t, protoFields(t, bodies[0])[protoRequestResourceLogs][0])
+	resource := protoFields(t, resourceLogs[protoResourceLogsResource][0])
+	kv := protoFields(t, resource[protoResourceAttributes][0])
+	assert.Equal(t, "service.name", string(kv[protoKeyValueKey][0]))
+
+	scopeLogs := protoFields(t, resourceLogs[protoResourceLogsScopeLogs][0])
+	rec := protoFields(t, scopeLogs[protoScopeLogsLogRecords][0])
+	nanos, _ := protowire.ConsumeFixed64(rec[protoLogRecordTimeUnixNano][0])
+	assert.Equal(t, uint64(1600000000000000001), nanos)
+	severity, _ := protowire.ConsumeVarint(rec[protoLogRecordSeverityNumber][0])
+	assert.Equal(t, uint64(13), severity)
+	assert.Equal(t, "WARN", string(rec[protoLogRecordSeverityText][0]))
+	body := protoFields(t, rec[protoLogRecordBody][0])
+	assert.Equal(t, "hello", string(body[protoAnyValueString][0]))
+
+	attrs := rec[protoLogRecordAttributes]
+	if assert.Len(t, attrs, 2) {
+		count := protoFields(t, attrs[0])
+		assert.Equal(t, "count", string(count[protoKeyValueKey][0]))
+		v, _ := protowire.ConsumeVarint(protoFields(t, count[protoKeyValueValue][0])[protoAnyValueInt][0])
+		assert.Equal(t, int64(-3), int64(v))
+		ok := protoFields(t, attrs[1])
+		v, _ = protowire.ConsumeVarint(protoFields(t, ok[protoKeyValueValue][0])[protoAnyValueBool][0])
+		assert.True(t, protowire.DecodeBool(v))
+	}
+
+	_, err = newOTLPExporter(OTLPConfig{Encoding: "xml"}, nil)
+	assert.Error(t, err)
+}
+
+func TestOTLPCloseRetries(t *testing.T) {
+	collector := &otlpCollector{failures: 3}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	// Retries are not capped by MaxRetries when closing.
+	e, err := newOTLPExporter(OTLPConfig{Endpoint: server.URL, MaxRetries: 0}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.enqueue(otlpLogRecord{SeverityText: "INFO", Body: otlpValue("last words")})
+	e.Close()
+	assert.Len(t, collector.records(), 1)
+	assert.Equal(t, uint64(0), e.Dropped())
+}
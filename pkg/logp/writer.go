@@ -0,0 +1,171 @@
+package logp
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// DefaultMaxLineLength is the default maximum length of a line logged by a
+// LineWriter. Longer lines are truncated.
+const DefaultMaxLineLength = 16 * 1024
+
+const truncatedSuffix = "..."
+
+// LineWriter is an io.WriteCloser that buffers writes until a newline and
+// logs each complete line as one entry. Trailing whitespace is trimmed, empty
+// lines are skipped and the level is detected from line prefixes such as
+// "[ERROR]", "warn:" or "[debug]", falling back to the level of the writer.
+//
+// It is safe for concurrent use and suitable for capturing the output of a
+// subprocess:
+//
+//	w := logger.Writer(logp.InfoLevel)
+//	cmd.Stdout = w
+//	err := cmd.Run()
+//	w.Close()
+type LineWriter struct {
+	mu        sync.Mutex
+	logger    *Logger
+	level     Level
+	maxLen    int
+	buf       []byte
+	truncated bool // Rest of the current line is discarded.
+}
+
+// NewLineWriter returns a LineWriter logging to logger. If maxLen is not
+// positive DefaultMaxLineLength is used.
+func NewLineWriter(logger *Logger, level Level, maxLen int) *LineWriter {
+	if maxLen <= 0 {
+		maxLen = DefaultMaxLineLength
+	}
+	return &LineWriter{logger: logger, level: level, maxLen: maxLen}
+}
+
+// Write buffers p and logs every line completed by it.
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		chunk := p
+		if i >= 0 {
+			chunk = p[:i]
+		}
+		w.append(chunk)
+		if i < 0 {
+			break
+		}
+		w.flush()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Close logs any buffered partial line.
+func (w *LineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flush()
+	return nil
+}
+
+func (w *LineWriter) append(chunk []byte) {
+	if w.truncated {
+		return
+	}
+	room := w.maxLen - len(w.buf)
+	if len(chunk) <= room {
+		w.buf = append(w.buf, chunk...)
+		return
+	}
+	w.buf = append(w.buf, chunk[:room]...)
+	w.truncated = true
+	// Don't leave a rune cut in half, which may have started in an earlier
+	// write.
+	for i := len(w.buf) - 1; i >= 0 && i >= len(w.buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(w.buf[i]) {
+			if !utf8.FullRune(w.buf[i:]) {
+				w.buf = w.buf[:i]
+			}
+			break
+		}
+	}
+}
+
+func (w *LineWriter) flush() {
+	line := strings.TrimRight(string(w.buf), " \t\r\n")
+	if w.truncated {
+		line += truncatedSuffix
+	}
+	w.buf = w.buf[:0]
+	w.truncated = false
+	if line == "" {
+		return
+	}
+	w.logger.logAt(detectLevel(line, w.level), line)
+}
+
+// Writer returns a LineWriter logging to l at the given default level.
+// Caller information is omitted because it would always point at the
+// writer itself.
+func (l *Logger) Writer(level Level) *LineWriter {
+	logger := &Logger{sugar: l.sugar.Desugar().WithOptions(zap.WithCaller(false)).Sugar(), name: l.name}
+	return NewLineWriter(logger, level, DefaultMaxLineLength)
+}
+
+var levelTags = map[string]Level{
+	"debug":     DebugLevel,
+	"gin-debug": DebugLevel,
+	"info":      InfoLevel,
+	"warn":      WarnLevel,
+	"warning":   WarnLevel,
+	"error":     ErrorLevel,
+	"err":       ErrorLevel,
+	"fatal":     ErrorLevel,
+	"panic":     ErrorLevel,
+}
+
+// detectLevel looks at the leading tags of msg (e.g. "[debug]", "warn:" or
+// "[GIN-debug] [WARNING]") and returns the most severe level found. Only words
+// in brackets or followed by a colon are tags, so that a message starting with
+// a level word such as "error count is 0" keeps level. If there is no level
+// tag then level is returned.
+func detectLevel(msg string, level Level) Level {
+	found := false
+	detected := DebugLevel
+	rest := msg
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		word := rest[:end]
+		var tag string
+		switch {
+		case len(word) > 2 && word[0] == '[' && word[len(word)-1] == ']':
+			tag = word[1 : len(word)-1]
+		case len(word) > 1 && word[len(word)-1] == ':':
+			tag = word[:len(word)-1]
+		}
+		l, ok := levelTags[strings.ToLower(tag)]
+		if !ok {
+			break
+		}
+		if l > detected {
+			detected = l
+		}
+		found = true
+		rest = rest[end:]
+	}
+	if !found {
+		return level
+	}
+	return detected
+}
@@ -0,0 +1,79 @@
+package logp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDetectLevel(t *testing.T) {
+	cases := []struct {
+		in    string
+		level Level
+	}{
+		{"plain message", InfoLevel},
+		{"error count is 0", InfoLevel},
+		{"ERROR something failed", InfoLevel},
+		{"[ERROR] something failed", ErrorLevel},
+		{"[debug] details", DebugLevel},
+		{"warn: disk almost full", WarnLevel},
+		{"[GIN-debug] GET /ping", DebugLevel},
+		{"[GIN-debug] [WARNING] Running in debug mode", WarnLevel},
+		{"[GIN] 200 | GET /ping", InfoLevel},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.level, detectLevel(c.in, InfoLevel), c.in)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	if err := DevelopmentSetup(ToObserverOutput()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewLineWriter(NewLogger("proc"), InfoLevel, 10)
+	w.Write([]byte("hel"))
+	w.Write([]byte("lo  \r\nerror: bad\n\n"))
+	w.Write([]byte("this line is too long\npartial"))
+	logs := ObserverLogs().TakeAll()
+	if assert.Len(t, logs, 3) {
+		assert.Equal(t, zap.InfoLevel, logs[0].Level)
+		assert.Equal(t, "hello", logs[0].Message)
+		assert.Equal(t, zap.ErrorLevel, logs[1].Level)
+		assert.Equal(t, "error: bad", logs[1].Message)
+		assert.Equal(t, "this line"+truncatedSuffix, logs[2].Message)
+	}
+
+	w.Close()
+	logs = ObserverLogs().TakeAll()
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, "partial", logs[0].Message)
+	}
+
+	// Truncation doesn't split runes, even across writes.
+	w = NewLineWriter(NewLogger("proc"), InfoLevel, 4)
+	w.Write([]byte("abcé\nab\xe2"))
+	w.Write([]byte("\x82\xac\n"))
+	logs = ObserverLogs().TakeAll()
+	if assert.Len(t, logs, 2) {
+		assert.Equal(t, "abc"+truncatedSuffix, logs[0].Message)
+		assert.Equal(t, "ab"+truncatedSuffix, logs[1].Message)
+	}
+}
+
+func TestLoggerWrite(t *testing.T) {
+	if err := DevelopmentSetup(ToObserverOutput()); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := NewLogger("proc")
+	logger.Write([]byte("first\n[warn] sec"))
+	logger.Write([]byte("ond\n"))
+	logs := ObserverLogs().TakeAll()
+	if assert.Len(t, logs, 2) {
+		assert.Equal(t, "first", logs[0].Message)
+		assert.Equal(t, zap.WarnLevel, logs[1].Level)
+		assert.Equal(t, "[warn] second", logs[1].Message)
+	}
+}
@@ -0,0 +1,135 @@
+// Package tracing carries W3C trace context (the traceparent header) through
+// context.Context so that logs and outgoing requests can be correlated with
+// distributed traces.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TraceparentHeader is the W3C trace context header name.
+const TraceparentHeader = "traceparent"
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID string // 32 lowercase hex characters.
+	SpanID  string // 16 lowercase hex characters.
+	Flags   byte   // Trace flags, bit 0 is "sampled".
+}
+
+type contextKey struct{}
+
+// ParseTraceparent parses a traceparent header value such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func ParseTraceparent(value string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return SpanContext{}, errors.Errorf("invalid traceparent %q", value)
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isHex(version, 2) || version == "ff" {
+		return SpanContext{}, errors.Errorf("invalid traceparent version %q", version)
+	}
+	// Version 00 has exactly four fields, future versions may append more.
+	if version == "00" && len(parts) != 4 {
+		return SpanContext{}, errors.Errorf("invalid traceparent %q", value)
+	}
+	if !isHex(traceID, 32) || traceID == strings.Repeat("0", 32) {
+		return SpanContext{}, errors.Errorf("invalid trace id %q", traceID)
+	}
+	if !isHex(spanID, 16) || spanID == strings.Repeat("0", 16) {
+		return SpanContext{}, errors.Errorf("invalid span id %q", spanID)
+	}
+	if !isHex(flags, 2) {
+		return SpanContext{}, errors.Errorf("invalid trace flags %q", flags)
+	}
+	b, _ := hex.DecodeString(flags)
+	return SpanContext{TraceID: traceID, SpanID: spanID, Flags: b[0]}, nil
+}
+
+// Traceparent formats the span context as a version 00 traceparent value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// IsValid reports whether both IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != "" && sc.SpanID != ""
+}
+
+// NewTrace starts a new sampled trace.
+func NewTrace() SpanContext {
+	return SpanContext{TraceID: randomHex(16), SpanID: randomHex(8), Flags: 1}
+}
+
+// NewChild returns a span in the same trace with a new span ID.
+func (sc SpanContext) NewChild() SpanContext {
+	return SpanContext{TraceID: sc.TraceID, SpanID: randomHex(8), Flags: sc.Flags}
+}
+
+// ContextWith returns a copy of ctx carrying sc.
+func ContextWith(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// FromContext returns the span context carried by ctx, if any.
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	if ctx == nil {
+		return SpanContext{}, false
+	}
+	sc, ok := ctx.Value(contextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// Transport is an http.RoundTripper that propagates the span context of the
+// request context in the traceparent header.
+type Transport struct {
+	Base http.RoundTripper // Defaults to http.DefaultTransport.
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if sc, ok := FromContext(req.Context()); ok && req.Header.Get(TraceparentHeader) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(TraceparentHeader, sc.Traceparent())
+	}
+	return base.RoundTrip(req)
+}
+
+// NewHTTPClient returns an http.Client propagating trace context. Outgoing
+// requests built by the project should use it with http.NewRequestWithContext.
+func NewHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: &Transport{}, Timeout: timeout}
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(errors.Wrap(err, "failed to generate random id"))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/colinzuo/tunip/pkg/logp"
+)
+
+// RedirectGin routes gin.DefaultWriter and gin.DefaultErrorWriter into logp
+// according to the gin and gin_error bridges of the log config. Call it
+// after logp is configured and before the gin engine is created.
+func RedirectGin() {
+	if cfg, found := logp.GetBridgeConfig(logp.GinBridge); found && cfg.Enabled {
+		gin.DefaultWriter = logp.NewBridge(logp.GinBridge, cfg)
+	}
+	if cfg, found := logp.GetBridgeConfig(logp.GinErrorBridge); found && cfg.Enabled {
+		gin.DefaultErrorWriter = logp.NewBridge(logp.GinErrorBridge, cfg)
+	}
+}
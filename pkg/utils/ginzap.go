@@ -9,7 +9,8 @@ import (
 	"github.com/colinzuo/tunip/pkg/logp"
 )
 
-//Ginzap gin log middleware using zap
+// Ginzap gin log middleware using zap. Use it after Tracing so that entries
+// carry the trace_id and span_id of the request.
 func Ginzap(logger *logp.Logger) gin.HandlerFunc {
 	timeLongForm := "2006-01-02T15:04:05.000-07:00"
 
@@ -18,6 +19,7 @@ func Ginzap(logger *logp.Logger) gin.HandlerFunc {
 		// some evil middlewares modify this values
 		path := c.Request.URL.Path
 		query := c.Request.URL.RawQuery
+		logger := logger.WithContext(c.Request.Context())
 
 		logger.With(zap.String("method", c.Request.Method),
 			zap.String("path", path),
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/colinzuo/tunip/pkg/tracing"
+)
+
+// Tracing gin middleware parsing the W3C traceparent header. The request
+// context carries a new span of the incoming trace, or of a new trace if the
+// header is missing or invalid, and the traceparent of that span is set on
+// the response.
+func Tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var sc tracing.SpanContext
+		if parent, err := tracing.ParseTraceparent(c.GetHeader(tracing.TraceparentHeader)); err == nil {
+			sc = parent.NewChild()
+		} else {
+			sc = tracing.NewTrace()
+		}
+
+		c.Request = c.Request.WithContext(tracing.ContextWith(c.Request.Context(), sc))
+		c.Header(tracing.TraceparentHeader, sc.Traceparent())
+
+		c.Next()
+	}
+}
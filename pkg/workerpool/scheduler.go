@@ -0,0 +1,132 @@
+package workerpool
+
+// strideScale is divided by weights to get strides. Flows are served in
+// order of their pass, advanced by their stride each time they are served,
+// so a flow of weight 2 is served twice as often as one of weight 1.
+const strideScale = 1 << 20
+
+// ClassConfig describes a priority class of requests.
+type ClassConfig struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"` // Share of the workers relative to other classes, default 1.
+	Limit  int    `json:"limit"`  // Maximum queued requests, unlimited if 0.
+}
+
+// tenantQueue holds the queued requests of one tenant in a class.
+type tenantQueue struct {
+	items []*item
+	pass  uint64
+}
+
+type classQueue struct {
+	ClassConfig
+	stride   uint64
+	pass     uint64
+	vtime    uint64 // Pass of the tenant served last.
+	size     int
+	rejected int64
+	tenants  map[string]*tenantQueue
+}
+
+// scheduler orders queued requests by weighted fair queuing, first between
+// classes and then between the tenants of a class, so that no class or
+// tenant is starved by a flood of requests of another.
+type scheduler struct {
+	classes []*classQueue
+	byName  map[string]*classQueue
+	weights map[string]int // Tenant weights, default 1.
+	vtime   uint64         // Pass of the class served last.
+	size    int
+}
+
+func newScheduler(classes []ClassConfig, weights map[string]int) *scheduler {
+	if len(classes) == 0 {
+		classes = []ClassConfig{{}}
+	}
+	s := &scheduler{byName: map[string]*classQueue{}, weights: weights}
+	for _, cfg := range classes {
+		c := &classQueue{ClassConfig: cfg, stride: stride(cfg.Weight), tenants: map[string]*tenantQueue{}}
+		s.classes = append(s.classes, c)
+		s.byName[cfg.Name] = c
+	}
+	return s
+}
+
+func stride(weight int) uint64 {
+	if weight < 1 {
+		weight = 1
+	}
+	return strideScale / uint64(weight)
+}
+
+// class returns the class of a request, the first one if its class is
+// unknown.
+func (s *scheduler) class(name string) *classQueue {
+	if c, found := s.byName[name]; found {
+		return c
+	}
+	return s.classes[0]
+}
+
+// full reports whether the class of a request reached its limit.
+func (s *scheduler) full(c *classQueue) bool {
+	return c.Limit > 0 && c.size >= c.Limit
+}
+
+func (s *scheduler) push(c *classQueue, it *item) {
+	if c.size == 0 && c.pass < s.vtime {
+		// An idle class doesn't accumulate credit.
+		c.pass = s.vtime
+	}
+	t, found := c.tenants[it.req.Tenant]
+	if !found {
+		t = &tenantQueue{pass: c.vtime}
+		c.tenants[it.req.Tenant] = t
+	}
+	t.items = append(t.items, it)
+	c.size++
+	s.size++
+}
+
+// pop removes the next request to process, nil if none.
+func (s *scheduler) pop() *item {
+	var c *classQueue
+	for _, candidate := range s.classes {
+		if candidate.size > 0 && (c == nil || candidate.pass < c.pass) {
+			c = candidate
+		}
+	}
+	if c == nil {
+		return nil
+	}
+
+	var tenant string
+	var t *tenantQueue
+	for name, candidate := range c.tenants {
+		if t == nil || candidate.pass < t.pass || (candidate.pass == t.pass && name < tenant) {
+			tenant, t = name, candidate
+		}
+	}
+
+	it := t.items[0]
+	t.items[0] = nil
+	t.items = t.items[1:]
+	s.vtime, c.vtime = c.pass, t.pass
+	c.pass += c.stride
+	t.pass += stride(s.weights[tenant])
+	if len(t.items) == 0 {
+		delete(c.tenants, tenant)
+	}
+	c.size--
+	s.size--
+	return it
+}
+
+// drain removes all queued requests.
+func (s *scheduler) drain() []*item {
+	var items []*item
+	for it := s.pop(); it != nil; it = s.pop() {
+		items = append(items, it)
+	}
+	return items
+}
@@ -0,0 +1,517 @@
+// Package workerpool runs requests on a resizable pool of workers fed by a
+// bounded queue. Requests are routed to the handler registered for their
+// type, carry the context they were submitted with, and deliver their
+// outcome on a result channel chosen by the submitter.
+//
+// Queued requests are served by weighted fair queuing between priority
+// classes, and between tenants within a class, so a flood of requests of
+// one class or tenant only delays the others by their share of the workers.
+//
+// Shutdown stops accepting requests and drains the queue; if its context
+// expires first, the requests still queued or running are cancelled.
+package workerpool
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/colinzuo/tunip/pkg/histogram"
+)
+
+// Errors returned by the pool.
+var (
+	ErrClosed    = errors.New("worker pool is shut down")
+	ErrQueueFull = errors.New("worker pool queue is full")
+	ErrNoHandler = errors.New("no handler for request type")
+	ErrClassFull = errors.New("worker pool class queue is full")
+)
+
+// Request is a unit of work.
+type Request struct {
+	Type    string
+	ID      string
+	Body    interface{}
+	Timeout time.Duration // Deadline from submission, including queueing. None if 0.
+	Class   string        // Priority class, the first class if unknown.
+	Tenant  string        // Requests of a class are shared fairly between tenants.
+}
+
+// Result is the outcome of a request.
+type Result struct {
+	Request    *Request
+	Value      interface{}
+	Err        error
+	Queued     time.Duration // Time spent waiting for a worker.
+	Processing time.Duration // Time spent in the handler.
+}
+
+// Handler processes requests of one type.
+type Handler interface {
+	Handle(ctx context.Context, req *Request) (interface{}, error)
+}
+
+// HandlerFunc adapts a function to Handler.
+type HandlerFunc func(ctx context.Context, req *Request) (interface{}, error)
+
+// Handle calls f.
+func (f HandlerFunc) Handle(ctx context.Context, req *Request) (interface{}, error) {
+	return f(ctx, req)
+}
+
+// Config contains the configuration options of a Pool.
+type Config struct {
+	Workers       int            // Number of workers, at least 1.
+	QueueSize     int            // Capacity of the queue, at least 1.
+	Classes       []ClassConfig  // Priority classes, defaults to a single one.
+	TenantWeights map[string]int // Share of each tenant within a class, default 1.
+}
+
+type item struct {
+	ctx      context.Context
+	req      *Request
+	results  chan<- Result
+	enqueued time.Time
+	deadline time.Time
+}
+
+type workerIDKey struct{}
+
+// WorkerID returns the ID of the worker running the handler called with ctx.
+func WorkerID(ctx context.Context) (int, bool) {
+	id, ok := ctx.Value(workerIDKey{}).(int)
+	return id, ok
+}
+
+// Pool is a pool of workers.
+type Pool struct {
+	queue chan *item    // Unbuffered, from the dispatcher to the workers.
+	quit  chan struct{} // Each receive stops one worker.
+
+	// ctx is cancelled once the workers are to stop, after draining or when
+	// shutdown gives up.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	qmu       sync.Mutex
+	sched     *scheduler
+	queueSize int
+	notEmpty  chan struct{} // Signals the dispatcher that a request was queued.
+	space     chan struct{} // Closed, and replaced, when a request leaves the queue.
+	held      int           // Request taken by the dispatcher, not yet by a worker.
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	closed   bool
+	workers  int // Target number of workers.
+	nextID   int
+	inFlight map[*item]context.CancelFunc
+	pending  sync.WaitGroup // Requests submitted and not done.
+	running  sync.WaitGroup // Live workers.
+
+	busy      int64
+	submitted int64
+	completed int64
+	failed    int64
+	rejected  int64
+
+	statsMu    sync.Mutex
+	queued     *histogram.Histogram // Microseconds.
+	processing *histogram.Histogram // Microseconds.
+}
+
+// New returns a pool and starts its workers.
+func New(cfg Config) *Pool {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.QueueSize < 1 {
+		cfg.QueueSize = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		queue:      make(chan *item),
+		quit:       make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+		sched:      newScheduler(cfg.Classes, cfg.TenantWeights),
+		queueSize:  cfg.QueueSize,
+		notEmpty:   make(chan struct{}, 1),
+		space:      make(chan struct{}),
+		handlers:   map[string]Handler{},
+		inFlight:   map[*item]context.CancelFunc{},
+		queued:     histogram.New(),
+		processing: histogram.New(),
+	}
+	p.running.Add(1)
+	go p.dispatch()
+	p.Resize(cfg.Workers)
+	return p
+}
+
+// Handle registers the handler for a request type, replacing any previous
+// one.
+func (p *Pool) Handle(reqType string, handler Handler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handlers[reqType] = handler
+}
+
+// HandleFunc registers a handler function for a request type.
+func (p *Pool) HandleFunc(reqType string, f func(ctx context.Context, req *Request) (interface{}, error)) {
+	p.Handle(reqType, HandlerFunc(f))
+}
+
+// Submit queues a request, waiting for room in the queue until ctx is done.
+// It fails with ErrClassFull, without waiting, if the class of the request
+// reached its limit. The handler is called with ctx, limited by the timeout
+// of the request, so its deadline and cancellation apply while the request
+// is queued and while it is processed; a request past its deadline when a
+// worker picks it up fails with context.DeadlineExceeded without calling the
+// handler. The result is sent to results, if not nil, unless ctx is done by
+// then.
+func (p *Pool) Submit(ctx context.Context, req *Request, results chan<- Result) error {
+	return p.submit(ctx, req, results, true)
+}
+
+// TrySubmit queues a request like Submit, but returns ErrQueueFull instead
+// of waiting if the queue is full.
+func (p *Pool) TrySubmit(ctx context.Context, req *Request, results chan<- Result) error {
+	return p.submit(ctx, req, results, false)
+}
+
+func (p *Pool) submit(ctx context.Context, req *Request, results chan<- Result, wait bool) error {
+	it, err := p.add(ctx, req, results)
+	if err != nil {
+		return err
+	}
+	for {
+		p.qmu.Lock()
+		c := p.sched.class(req.Class)
+		switch {
+		case p.ctx.Err() != nil:
+			p.qmu.Unlock()
+			p.reject()
+			return ErrClosed
+		case p.sched.full(c):
+			c.rejected++
+			p.qmu.Unlock()
+			p.reject()
+			return errors.Wrap(ErrClassFull, c.Name)
+		case p.sched.size+p.held < p.queueSize:
+			p.sched.push(c, it)
+			p.qmu.Unlock()
+			select {
+			case p.notEmpty <- struct{}{}:
+			default:
+			}
+			return nil
+		}
+		space := p.space
+		p.qmu.Unlock()
+
+		if !wait {
+			p.reject()
+			return ErrQueueFull
+		}
+		select {
+		case <-space:
+		case <-ctx.Done():
+			p.reject()
+			return ctx.Err()
+		case <-p.ctx.Done():
+			p.reject()
+			return ErrClosed
+		}
+	}
+}
+
+func (p *Pool) add(ctx context.Context, req *Request, results chan<- Result) (*item, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		atomic.AddInt64(&p.rejected, 1)
+		return nil, ErrClosed
+	}
+	p.pending.Add(1)
+	atomic.AddInt64(&p.submitted, 1)
+	it := &item{ctx: ctx, req: req, results: results, enqueued: time.Now()}
+	if req.Timeout > 0 {
+		it.deadline = it.enqueued.Add(req.Timeout)
+	}
+	return it, nil
+}
+
+func (p *Pool) reject() {
+	atomic.AddInt64(&p.submitted, -1)
+	atomic.AddInt64(&p.rejected, 1)
+	p.pending.Done()
+}
+
+// Resize changes the number of workers. Workers removed finish their current
+// request first.
+func (p *Pool) Resize(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	for ; p.workers < workers; p.workers++ {
+		p.nextID++
+		p.running.Add(1)
+		go p.work(p.nextID)
+	}
+	if surplus := p.workers - workers; surplus > 0 {
+		p.workers = workers
+		go func() {
+			for i := 0; i < surplus; i++ {
+				select {
+				case p.quit <- struct{}{}:
+				case <-p.ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Shutdown stops accepting requests and waits for the queued and running
+// ones to complete. If ctx is done first, they are cancelled and
+// Shutdown returns ctx.Err() once the workers have stopped.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrClosed
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		p.pending.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		p.cancel()
+		p.mu.Lock()
+		for _, cancel := range p.inFlight {
+			cancel()
+		}
+		p.mu.Unlock()
+	}
+	p.cancel()
+	p.running.Wait()
+
+	// Fail what is still queued, every request gets a result.
+	p.qmu.Lock()
+	items := p.sched.drain()
+	p.qmu.Unlock()
+	for _, it := range items {
+		p.process(0, it)
+	}
+	return err
+}
+
+// dispatch hands the queued requests to the workers in scheduling order.
+func (p *Pool) dispatch() {
+	defer p.running.Done()
+	for {
+		p.qmu.Lock()
+		it := p.sched.pop()
+		if it != nil {
+			p.held++
+		}
+		p.qmu.Unlock()
+
+		if it == nil {
+			select {
+			case <-p.notEmpty:
+				continue
+			case <-p.ctx.Done():
+				return
+			}
+		}
+		select {
+		case p.queue <- it:
+		case <-p.ctx.Done():
+			p.taken()
+			p.process(0, it)
+		}
+	}
+}
+
+// taken makes room in the queue for the request held by the dispatcher.
+func (p *Pool) taken() {
+	p.qmu.Lock()
+	p.held--
+	close(p.space)
+	p.space = make(chan struct{})
+	p.qmu.Unlock()
+}
+
+func (p *Pool) work(id int) {
+	defer p.running.Done()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-p.ctx.Done():
+			return
+		case it := <-p.queue:
+			p.taken()
+			p.process(id, it)
+		}
+	}
+}
+
+func (p *Pool) process(id int, it *item) {
+	defer p.pending.Done()
+	start := time.Now()
+	result := Result{Request: it.req, Queued: start.Sub(it.enqueued)}
+
+	ctx, cancel := context.WithCancel(context.WithValue(it.ctx, workerIDKey{}, id))
+	defer cancel()
+	if !it.deadline.IsZero() {
+		// The result of a request past its own deadline is still delivered,
+		// only the cancellation of the submitter's ctx drops it.
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithDeadline(ctx, it.deadline)
+		defer cancelDeadline()
+	}
+	p.mu.Lock()
+	handler, found := p.handlers[it.req.Type]
+	p.inFlight[it] = cancel
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.inFlight, it)
+		p.mu.Unlock()
+	}()
+	if p.ctx.Err() != nil {
+		// Shutdown gave up draining.
+		cancel()
+	}
+
+	called := false
+	switch {
+	case ctx.Err() != nil:
+		result.Err = ctx.Err()
+	case !found:
+		result.Err = errors.Wrap(ErrNoHandler, it.req.Type)
+	default:
+		called = true
+		atomic.AddInt64(&p.busy, 1)
+		result.Value, result.Err = p.call(ctx, handler, it.req)
+		atomic.AddInt64(&p.busy, -1)
+		result.Processing = time.Since(start)
+	}
+
+	p.statsMu.Lock()
+	p.queued.Record(result.Queued.Microseconds())
+	if called {
+		p.processing.Record(result.Processing.Microseconds())
+	}
+	p.statsMu.Unlock()
+	atomic.AddInt64(&p.completed, 1)
+	if result.Err != nil {
+		atomic.AddInt64(&p.failed, 1)
+	}
+
+	if it.results != nil {
+		select {
+		case it.results <- result:
+		case <-it.ctx.Done():
+		}
+	}
+}
+
+func (p *Pool) call(ctx context.Context, handler Handler, req *Request) (value interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic: %v", r)
+		}
+	}()
+	return handler.Handle(ctx, req)
+}
+
+// LatencyStats summarizes a latency distribution.
+type LatencyStats struct {
+	Count int64
+	Mean  time.Duration
+	P50   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// Metrics is a snapshot of the state of a pool.
+type Metrics struct {
+	Workers     int
+	BusyWorkers int
+	QueueDepth  int
+	Submitted   int64
+	Completed   int64
+	Failed      int64 // Completed with an error, including cancellation.
+	Rejected    int64 // Not queued because the pool was full, closed or ctx was done.
+	Queued      LatencyStats
+	Processing  LatencyStats
+	Classes     map[string]ClassMetrics
+}
+
+// ClassMetrics is a snapshot of the state of a priority class.
+type ClassMetrics struct {
+	QueueDepth int
+	Rejected   int64 // Rejected because the class was full.
+}
+
+// Metrics returns the current metrics of the pool.
+func (p *Pool) Metrics() Metrics {
+	p.mu.Lock()
+	workers := p.workers
+	p.mu.Unlock()
+
+	m := Metrics{
+		Workers:     workers,
+		BusyWorkers: int(atomic.LoadInt64(&p.busy)),
+		Classes:     map[string]ClassMetrics{},
+		Submitted:   atomic.LoadInt64(&p.submitted),
+		Completed:   atomic.LoadInt64(&p.completed),
+		Failed:      atomic.LoadInt64(&p.failed),
+		Rejected:    atomic.LoadInt64(&p.rejected),
+	}
+	p.qmu.Lock()
+	m.QueueDepth = p.sched.size + p.held
+	for _, c := range p.sched.classes {
+		m.Classes[c.Name] = ClassMetrics{QueueDepth: c.size, Rejected: c.rejected}
+	}
+	p.qmu.Unlock()
+
+	p.statsMu.Lock()
+	m.Queued = latencyStats(p.queued)
+	m.Processing = latencyStats(p.processing)
+	p.statsMu.Unlock()
+	return m
+}
+
+func latencyStats(h *histogram.Histogram) LatencyStats {
+	us := func(v int64) time.Duration { return time.Duration(v) * time.Microsecond }
+	return LatencyStats{
+		Count: h.Count(),
+		Mean:  time.Duration(h.Mean() * float64(time.Microsecond)),
+		P50:   us(h.ValueAtPercentile(50)),
+		P99:   us(h.ValueAtPercentile(99)),
+		Max:   us(h.Max()),
+	}
+}
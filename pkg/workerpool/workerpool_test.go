@@ -0,0 +1,220 @@
+package workerpool
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func echo(ctx context.Context, req *Request) (interface{}, error) {
+	return req.Body, nil
+}
+
+func TestHandle(t *testing.T) {
+	p := New(Config{Workers: 4, QueueSize: 10})
+	p.HandleFunc("echo", echo)
+	p.HandleFunc("panic", func(ctx context.Context, req *Request) (interface{}, error) {
+		panic("boom")
+	})
+
+	results := make(chan Result, 102)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, p.Submit(context.Background(), &Request{Type: "echo", Body: i}, results))
+	}
+	assert.NoError(t, p.Submit(context.Background(), &Request{Type: "unknown"}, results))
+	assert.NoError(t, p.Submit(context.Background(), &Request{Type: "panic"}, results))
+
+	sum, failed := 0, 0
+	for i := 0; i < 102; i++ {
+		r := <-results
+		if r.Err != nil {
+			failed++
+			continue
+		}
+		sum += r.Value.(int)
+	}
+	assert.Equal(t, 4950, sum)
+	assert.Equal(t, 2, failed)
+
+	assert.NoError(t, p.Shutdown(context.Background()))
+	m := p.Metrics()
+	assert.Equal(t, int64(102), m.Submitted)
+	assert.Equal(t, int64(102), m.Completed)
+	assert.Equal(t, int64(2), m.Failed)
+	assert.Equal(t, 0, m.QueueDepth)
+	assert.Equal(t, ErrClosed, p.Submit(context.Background(), &Request{Type: "echo"}, nil))
+}
+
+func TestDeadlineWhileQueued(t *testing.T) {
+	p := New(Config{Workers: 1, QueueSize: 10})
+	release := make(chan struct{})
+	p.HandleFunc("block", func(ctx context.Context, req *Request) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	p.HandleFunc("echo", echo)
+
+	results := make(chan Result, 2)
+	assert.NoError(t, p.Submit(context.Background(), &Request{Type: "block"}, results))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, p.Submit(ctx, &Request{Type: "echo"}, nil))
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	<-results
+	assert.NoError(t, p.Shutdown(context.Background()))
+	assert.Equal(t, int64(1), p.Metrics().Failed, "expired while queued")
+}
+
+func TestRequestTimeout(t *testing.T) {
+	p := New(Config{Workers: 1, QueueSize: 10})
+	p.HandleFunc("wait", func(ctx context.Context, req *Request) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	results := make(chan Result, 2)
+	start := time.Now()
+	assert.NoError(t, p.Submit(context.Background(), &Request{Type: "wait", Timeout: 20 * time.Millisecond}, results))
+	assert.NoError(t, p.Submit(context.Background(), &Request{Type: "wait", Timeout: 10 * time.Millisecond}, results))
+
+	// Timed out while processing, then while queued behind it.
+	for i := 0; i < 2; i++ {
+		r := <-results
+		assert.Equal(t, context.DeadlineExceeded, r.Err)
+	}
+	assert.True(t, time.Since(start) < time.Second)
+	assert.NoError(t, p.Shutdown(context.Background()))
+	assert.Equal(t, int64(1), p.Metrics().Processing.Count, "expired request isn't processed")
+}
+
+func TestTrySubmitQueueFull(t *testing.T) {
+	p := New(Config{Workers: 1, QueueSize: 1})
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	p.HandleFunc("block", func(ctx context.Context, req *Request) (interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return nil, nil
+	})
+
+	assert.NoError(t, p.TrySubmit(context.Background(), &Request{Type: "block"}, nil))
+	<-started
+	assert.NoError(t, p.TrySubmit(context.Background(), &Request{Type: "block"}, nil))
+	assert.Equal(t, ErrQueueFull, p.TrySubmit(context.Background(), &Request{Type: "block"}, nil))
+	assert.Equal(t, int64(1), p.Metrics().Rejected)
+	close(release)
+	assert.NoError(t, p.Shutdown(context.Background()))
+}
+
+func TestResize(t *testing.T) {
+	p := New(Config{Workers: 1, QueueSize: 100})
+	var current, peak int64
+	p.HandleFunc("sleep", func(ctx context.Context, req *Request) (interface{}, error) {
+		n := atomic.AddInt64(&current, 1)
+		for {
+			old := atomic.LoadInt64(&peak)
+			if n <= old || atomic.CompareAndSwapInt64(&peak, old, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt64(&current, -1)
+		return nil, nil
+	})
+
+	p.Resize(8)
+	assert.Equal(t, 8, p.Metrics().Workers)
+	for i := 0; i < 32; i++ {
+		assert.NoError(t, p.Submit(context.Background(), &Request{Type: "sleep"}, nil))
+	}
+	assert.NoError(t, p.Shutdown(context.Background()))
+	assert.Equal(t, int64(8), peak)
+
+	p = New(Config{Workers: 4, QueueSize: 100})
+	p.HandleFunc("sleep", func(ctx context.Context, req *Request) (interface{}, error) {
+		n := atomic.AddInt64(&current, 1)
+		assert.True(t, n <= 2, "%d workers busy after shrinking to 2", n)
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt64(&current, -1)
+		return nil, nil
+	})
+	p.Resize(2)
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, p.Submit(context.Background(), &Request{Type: "sleep"}, nil))
+	}
+	assert.NoError(t, p.Shutdown(context.Background()))
+}
+
+func TestShutdownTimeoutCancels(t *testing.T) {
+	p := New(Config{Workers: 2, QueueSize: 10})
+	p.HandleFunc("wait", func(ctx context.Context, req *Request) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	results := make(chan Result, 5)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, p.Submit(context.Background(), &Request{Type: "wait"}, results))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, p.Shutdown(ctx))
+	assert.True(t, time.Since(start) < time.Second)
+
+	for i := 0; i < 5; i++ {
+		r := <-results
+		assert.Equal(t, context.Canceled, r.Err)
+	}
+}
+
+func TestWeightedFairQueuing(t *testing.T) {
+	p := New(Config{
+		Workers:       1,
+		QueueSize:     1000,
+		Classes:       []ClassConfig{{Name: "high", Weight: 3}, {Name: "low", Weight: 1, Limit: 100}},
+		TenantWeights: map[string]int{"big": 2},
+	})
+	release := make(chan struct{})
+	var order []string
+	p.HandleFunc("record", func(ctx context.Context, req *Request) (interface{}, error) {
+		<-release
+		order = append(order, req.Class+"/"+req.Tenant)
+		return nil, nil
+	})
+
+	submit := func(class, tenant string, n int) {
+		for i := 0; i < n; i++ {
+			assert.NoError(t, p.Submit(context.Background(), &Request{Type: "record", Class: class, Tenant: tenant}, nil))
+		}
+	}
+	// Blocks the worker while the queue fills up.
+	submit("high", "first", 1)
+	time.Sleep(10 * time.Millisecond)
+	submit("high", "flood", 200)
+	submit("high", "big", 100)
+	submit("high", "small", 100)
+	submit("low", "a", 100)
+	assert.True(t, errors.Is(p.Submit(context.Background(), &Request{Type: "record", Class: "low"}, nil), ErrClassFull))
+	assert.Equal(t, int64(1), p.Metrics().Classes["low"].Rejected)
+	close(release)
+	assert.NoError(t, p.Shutdown(context.Background()))
+
+	// Over the first 120 requests after the blocking one, classes are served
+	// 3:1 and tenants of the high class 1:2:1.
+	counts := map[string]int{}
+	for _, name := range order[1:121] {
+		counts[name]++
+	}
+	assert.Equal(t, 30, counts["low/a"])
+	assert.Equal(t, 45, counts["high/big"])
+	assert.InDelta(t, 22, counts["high/flood"], 1)
+	assert.InDelta(t, 22, counts["high/small"], 1)
+}